@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// jobStatus is a job together with the state of the task running it
+type jobStatus struct {
+	job
+	TaskState string  `json:"taskState,omitempty"`
+	Hostname  string  `json:"hostname,omitempty"`
+	Healthy   *bool   `json:"healthy,omitempty"`
+	Volume    *volume `json:"volume,omitempty"`
+}
+
+// apiServer lets users submit commands to a running scheduler:
+//
+//	POST   /jobs       submit a job spec, e.g. {"cmd": "...", "instances": 1}
+//	GET    /jobs       list the queued jobs in launch order
+//	GET    /jobs/<id>  status of one job
+//	DELETE /jobs/<id>  cancel a job which is still queued, or delete one whose task ended, with its volume
+//	GET    /services   list the services with their desired and actual number of instances
+//	PUT    /services/<name>  scale a service, e.g. {"instances": 3}
+//	PUT    /services/<name>/spec  deploy a new version of the spec of a service as a rolling upgrade
+//	DELETE /tasks/<id>  kill a task
+//	DELETE /tasks?job=<name>&label=<key>=<value>  kill the tasks of a job, or with all the labels
+//	GET    /metrics    metrics in the Prometheus text format
+type apiServer struct {
+	s *demoScheduler
+}
+
+func (a *apiServer) serve(addr string) {
+	log.WithFields(log.Fields{"addr": addr}).Info("serving HTTP API")
+	if err := http.ListenAndServe(addr, a.handler()); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("HTTP API stopped")
+	}
+}
+
+func (a *apiServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", a.handleJobs)
+	mux.HandleFunc("/jobs/", a.handleJob)
+	mux.HandleFunc("/services", a.handleServices)
+	mux.HandleFunc("/services/", a.handleService)
+	mux.HandleFunc("/tasks", a.handleTasks)
+	mux.HandleFunc("/tasks/", a.handleTask)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	return mux
+}
+
+func (a *apiServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, a.s.shellCmdQueue.queued())
+	case "POST":
+		spec := &jobSpec{}
+		if err := json.NewDecoder(r.Body).Decode(spec); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		spec.setDefaults()
+		if errs := append(spec.validate(), spec.checkRole(a.s.role)...); len(errs) > 0 {
+			writeError(w, http.StatusBadRequest, errs.Error())
+			return
+		}
+		jobs, err := a.s.shellCmdQueue.submit(spec)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		log.WithFields(log.Fields{"name": spec.Name, "type": spec.Type, "instances": spec.Instances}).Info("jobs submitted")
+		writeJSON(w, http.StatusCreated, jobs)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *apiServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	switch r.Method {
+	case "GET":
+		j, ok := a.s.shellCmdQueue.get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, errJobNotFound.Error())
+			return
+		}
+		status := jobStatus{job: j}
+		if task, ok := a.s.tasks.get(j.TaskID); ok {
+			status.TaskState = task.state.String()
+			status.Hostname = task.hostname
+			status.Healthy = task.healthy
+		}
+		if v, ok := a.s.shellCmdQueue.volume(j.Name, j.Instance); ok && j.spec.Volume != nil {
+			status.Volume = &v
+		}
+		writeJSON(w, http.StatusOK, status)
+	case "DELETE":
+		j, err := a.s.deleteJob(id)
+		switch err {
+		case nil:
+			log.WithFields(log.Fields{"jobID": id, "state": j.State}).Info("job deleted")
+			writeJSON(w, http.StatusOK, j)
+		case errJobNotFound:
+			writeError(w, http.StatusNotFound, err.Error())
+		default:
+			writeError(w, http.StatusConflict, err.Error())
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *apiServer) handleServices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.s.shellCmdQueue.serviceStatuses())
+}
+
+func (a *apiServer) handleService(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/services/")
+	if strings.HasSuffix(name, "/spec") {
+		a.handleServiceSpec(w, r, strings.TrimSuffix(name, "/spec"))
+		return
+	}
+	if r.Method != "PUT" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	req := struct {
+		Instances *int `json:"instances"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if req.Instances == nil || *req.Instances < 0 {
+		writeError(w, http.StatusBadRequest, "instances must be given and not negative")
+		return
+	}
+	switch err := a.s.scaleService(name, *req.Instances); err {
+	case nil:
+		writeJSON(w, http.StatusOK, map[string]int{"instances": *req.Instances})
+	case errServiceNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	case errDeploying:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (a *apiServer) handleServiceSpec(w http.ResponseWriter, r *http.Request, name string) {
+	if r.Method != "PUT" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	spec := &jobSpec{Name: name, Type: jobTypeService}
+	if err := json.NewDecoder(r.Body).Decode(spec); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		return
+	}
+	if spec.Name != name || spec.Type != jobTypeService {
+		writeError(w, http.StatusBadRequest, "the spec must be a service named "+name)
+		return
+	}
+	spec.setDefaults()
+	if errs := append(spec.validate(), spec.checkRole(a.s.role)...); len(errs) > 0 {
+		writeError(w, http.StatusBadRequest, errs.Error())
+		return
+	}
+	status, err := a.s.shellCmdQueue.deploy(spec)
+	switch err {
+	case nil:
+		log.WithFields(log.Fields{"service": name, "from": status.From, "to": status.To}).Info("deployment started")
+		writeJSON(w, http.StatusAccepted, status)
+	case errServiceNotFound:
+		writeError(w, http.StatusNotFound, err.Error())
+	default:
+		writeError(w, http.StatusConflict, err.Error())
+	}
+}
+
+// handleTasks kills the tasks which match all the given filters
+func (a *apiServer) handleTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := r.URL.Query().Get("job")
+	labels := make(map[string]string)
+	for _, label := range r.URL.Query()["label"] {
+		parts := strings.SplitN(label, "=", 2)
+		if len(parts) != 2 {
+			writeError(w, http.StatusBadRequest, "labels must be given as key=value, got "+label)
+			return
+		}
+		labels[parts[0]] = parts[1]
+	}
+	if name == "" && len(labels) == 0 {
+		writeError(w, http.StatusBadRequest, "a job or labels are required")
+		return
+	}
+	killed := a.s.killTasks(func(t *taskRecord) bool {
+		if name != "" && t.name != name {
+			return false
+		}
+		for key, value := range labels {
+			if v, ok := t.labels[key]; !ok || v != value {
+				return false
+			}
+		}
+		return true
+	})
+	log.WithFields(log.Fields{"job": name, "labels": labels, "tasks": len(killed)}).Info("killing tasks")
+	writeJSON(w, http.StatusAccepted, killed)
+}
+
+func (a *apiServer) handleTask(w http.ResponseWriter, r *http.Request) {
+	taskID := strings.TrimPrefix(r.URL.Path, "/tasks/")
+	if r.Method != "DELETE" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !a.s.killTask(taskID) {
+		writeError(w, http.StatusNotFound, "task not found or already ended")
+		return
+	}
+	writeJSON(w, http.StatusAccepted, []string{taskID})
+}
+
+func (a *apiServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	states, forgotten := a.s.tasks.states()
+	a.s.metrics.write(w, states, forgotten)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("write response failed")
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAPIServer(t *testing.T) {
+	a := &apiServer{s: &demoScheduler{
+		role:          "web",
+		shellCmdQueue: newCommandQueue(),
+		tasks:         newTaskRegistry(),
+		metrics:       newSchedulerMetrics(),
+	}}
+	handler := a.handler()
+	service := `{"name": "web", "type": "service", "cmd": "sleep 60", "instances": 2}`
+
+	// the requests build on each other
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+		want   string
+	}{
+		{method: "POST", path: "/jobs", body: "{", code: http.StatusBadRequest, want: `"error":"invalid request: `},
+		{method: "POST", path: "/jobs", body: `{"name": "web", "type": "service"}`, code: http.StatusBadRequest, want: "cmd"},
+		{method: "POST", path: "/jobs", body: service, code: http.StatusCreated, want: `"id":"job-2"`},
+		{method: "POST", path: "/jobs", body: service, code: http.StatusConflict, want: errServiceExists.Error()},
+		{method: "PUT", path: "/jobs", code: http.StatusMethodNotAllowed, want: "method not allowed"},
+		{method: "GET", path: "/jobs", code: http.StatusOK, want: `"id":"job-1"`},
+		{method: "GET", path: "/jobs/job-1", code: http.StatusOK, want: `"state":"queued"`},
+		{method: "GET", path: "/jobs/job-9", code: http.StatusNotFound, want: errJobNotFound.Error()},
+		{method: "DELETE", path: "/jobs/job-1", code: http.StatusOK, want: `"state":"cancelled"`},
+		{method: "DELETE", path: "/jobs/job-1", code: http.StatusNotFound, want: errJobNotFound.Error()},
+		{method: "GET", path: "/services", code: http.StatusOK, want: `"queued":1`},
+		{method: "PUT", path: "/services/web", body: `{}`, code: http.StatusBadRequest, want: "instances must be given"},
+		{method: "PUT", path: "/services/db", body: `{"instances": 1}`, code: http.StatusNotFound, want: errServiceNotFound.Error()},
+		{method: "PUT", path: "/services/web", body: `{"instances": 3}`, code: http.StatusOK, want: `{"instances":3}`},
+		{method: "PUT", path: "/services/web/spec", body: `{"name": "db", "cmd": "true"}`, code: http.StatusBadRequest, want: "the spec must be a service named web"},
+		{method: "DELETE", path: "/tasks", code: http.StatusBadRequest, want: "a job or labels are required"},
+		{method: "DELETE", path: "/tasks?label=env", code: http.StatusBadRequest, want: "labels must be given as key=value, got env"},
+		{method: "DELETE", path: "/tasks/web.1", code: http.StatusNotFound, want: "task not found or already ended"},
+		{method: "GET", path: "/metrics", code: http.StatusOK, want: `rendler_tasks{state="TASK_RUNNING"} 0`},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.code || !strings.Contains(w.Body.String(), test.want) {
+			t.Errorf("%s %s: got %d %s, want %d with %s", test.method, test.path, w.Code, w.Body, test.code, test.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+// The Call and Event messages of the v1 scheduler API are not part of the vendored mesos-go, so
+// they are declared here with the fields we use. They are only ever sent and received as JSON.
+
+const (
+	callSubscribe   = "SUBSCRIBE"
+	callTeardown    = "TEARDOWN"
+	callAccept      = "ACCEPT"
+	callDecline     = "DECLINE"
+	callKill        = "KILL"
+	callAcknowledge = "ACKNOWLEDGE"
+	callReconcile   = "RECONCILE"
+)
+
+const (
+	eventSubscribed = "SUBSCRIBED"
+	eventOffers     = "OFFERS"
+	eventRescind    = "RESCIND"
+	eventUpdate     = "UPDATE"
+	eventMessage    = "MESSAGE"
+	eventFailure    = "FAILURE"
+	eventError      = "ERROR"
+	eventHeartbeat  = "HEARTBEAT"
+)
+
+var errProtobufUnsupported = errors.New("scheduler calls and events are only encoded as JSON")
+
+type schedulerCall struct {
+	FrameworkID *mesos.FrameworkID `json:"framework_id,omitempty"`
+	Type        string             `json:"type"`
+	Subscribe   *subscribeCall     `json:"subscribe,omitempty"`
+	Accept      *acceptCall        `json:"accept,omitempty"`
+	Decline     *declineCall       `json:"decline,omitempty"`
+	Kill        *killCall          `json:"kill,omitempty"`
+	Acknowledge *acknowledgeCall   `json:"acknowledge,omitempty"`
+	Reconcile   *reconcileCall     `json:"reconcile,omitempty"`
+}
+
+type subscribeCall struct {
+	FrameworkInfo mesos.FrameworkInfo `json:"framework_info"`
+}
+
+type acceptCall struct {
+	OfferIDs   []mesos.OfferID         `json:"offer_ids"`
+	Operations []mesos.Offer_Operation `json:"operations"`
+	Filters    *mesos.Filters          `json:"filters,omitempty"`
+}
+
+// MarshalJSON encodes the tasks of launches as taskInfo, to send their TCP health checks
+func (c *acceptCall) MarshalJSON() ([]byte, error) {
+	operations := make([]offerOperation, len(c.Operations))
+	for i := range c.Operations {
+		operations[i].plainOperation = plainOperation(c.Operations[i])
+		if launch := c.Operations[i].Launch; launch != nil {
+			operations[i].Launch = &launchTasks{TaskInfos: make([]taskInfo, len(launch.TaskInfos))}
+			for k := range launch.TaskInfos {
+				operations[i].Launch.TaskInfos[k] = encodeTaskInfo(&launch.TaskInfos[k])
+			}
+		}
+	}
+	type plain acceptCall
+	return json.Marshal(&struct {
+		*plain
+		Operations []offerOperation `json:"operations"`
+	}{(*plain)(c), operations})
+}
+
+// The plain types have the fields of the vendored ones without their methods, so that they are
+// encoded field by field with the fields declared next to them.
+type (
+	plainOperation   mesos.Offer_Operation
+	plainTaskInfo    mesos.TaskInfo
+	plainHealthCheck mesos.HealthCheck
+)
+
+type offerOperation struct {
+	plainOperation
+	Launch *launchTasks `json:"launch,omitempty"`
+}
+
+type launchTasks struct {
+	TaskInfos []taskInfo `json:"task_infos"`
+}
+
+// taskInfo is a TaskInfo with the HealthCheck of the v1 API, which has TCP checks
+type taskInfo struct {
+	plainTaskInfo
+	HealthCheck *healthCheck `json:"health_check,omitempty"`
+}
+
+type healthCheck struct {
+	plainHealthCheck
+	Type *string                 `json:"type,omitempty"`
+	Http *mesos.HealthCheck_HTTP `json:"http,omitempty"`
+	TCP  *tcpCheckInfo           `json:"tcp,omitempty"`
+}
+
+// tcpCheckInfo checks that a connection can be made to the port from within the task
+type tcpCheckInfo struct {
+	Port uint32 `json:"port"`
+}
+
+// encodeTaskInfo turns the HTTP checks without a path of newHealthCheck into TCP checks
+func encodeTaskInfo(task *mesos.TaskInfo) taskInfo {
+	info := taskInfo{plainTaskInfo: plainTaskInfo(*task)}
+	if check := task.HealthCheck; check != nil {
+		info.HealthCheck = &healthCheck{plainHealthCheck: plainHealthCheck(*check), Http: check.Http}
+		if port, ok := tcpHealthCheckPort(check); ok {
+			info.HealthCheck.Type = proto.String("TCP")
+			info.HealthCheck.Http = nil
+			info.HealthCheck.TCP = &tcpCheckInfo{Port: port}
+		}
+	}
+	return info
+}
+
+type declineCall struct {
+	OfferIDs []mesos.OfferID `json:"offer_ids"`
+	Filters  *mesos.Filters  `json:"filters,omitempty"`
+}
+
+type killCall struct {
+	TaskID     mesos.TaskID   `json:"task_id"`
+	AgentID    *mesos.AgentID `json:"agent_id,omitempty"`
+	KillPolicy *killPolicy    `json:"kill_policy,omitempty"`
+}
+
+// killPolicy overrides how long a task gets to shut down after it was told to, before it is
+// killed forcibly. The vendored TaskInfo has no kill policy, so it can only be given when killing.
+type killPolicy struct {
+	GracePeriod *mesos.DurationInfo `json:"grace_period,omitempty"`
+}
+
+func newKillPolicy(gracePeriod time.Duration) *killPolicy {
+	return &killPolicy{GracePeriod: &mesos.DurationInfo{Nanoseconds: gracePeriod.Nanoseconds()}}
+}
+
+// gracePeriod returns the grace period of the policy, and false if it has none
+func (p *killPolicy) gracePeriod() (time.Duration, bool) {
+	if p == nil || p.GracePeriod == nil {
+		return 0, false
+	}
+	return time.Duration(p.GracePeriod.Nanoseconds), true
+}
+
+type acknowledgeCall struct {
+	AgentID mesos.AgentID `json:"agent_id"`
+	TaskID  mesos.TaskID  `json:"task_id"`
+	UUID    []byte        `json:"uuid"`
+}
+
+type reconcileCall struct {
+	Tasks []reconcileTask `json:"tasks"`
+}
+
+type reconcileTask struct {
+	TaskID  mesos.TaskID   `json:"task_id"`
+	AgentID *mesos.AgentID `json:"agent_id,omitempty"`
+}
+
+// Marshal and MarshalJSON make a call an encoding.Marshaler, so it can go through a mesos.Client
+func (c *schedulerCall) Marshal() ([]byte, error) {
+	return nil, errProtobufUnsupported
+}
+
+func (c *schedulerCall) MarshalJSON() ([]byte, error) {
+	type plain schedulerCall
+	return json.Marshal((*plain)(c))
+}
+
+type schedulerEvent struct {
+	Type       string           `json:"type"`
+	Subscribed *subscribedEvent `json:"subscribed,omitempty"`
+	Offers     *offersEvent     `json:"offers,omitempty"`
+	Rescind    *rescindEvent    `json:"rescind,omitempty"`
+	Update     *updateEvent     `json:"update,omitempty"`
+	Message    *messageEvent    `json:"message,omitempty"`
+	Failure    *failureEvent    `json:"failure,omitempty"`
+	Error      *errorEvent      `json:"error,omitempty"`
+}
+
+type subscribedEvent struct {
+	FrameworkID              mesos.FrameworkID `json:"framework_id"`
+	HeartbeatIntervalSeconds float64           `json:"heartbeat_interval_seconds"`
+	MasterInfo               *mesos.MasterInfo `json:"master_info,omitempty"`
+}
+
+type offersEvent struct {
+	Offers []mesos.Offer `json:"offers"`
+}
+
+type rescindEvent struct {
+	OfferID mesos.OfferID `json:"offer_id"`
+}
+
+type updateEvent struct {
+	Status mesos.TaskStatus `json:"status"`
+}
+
+type messageEvent struct {
+	AgentID    mesos.AgentID    `json:"agent_id"`
+	ExecutorID mesos.ExecutorID `json:"executor_id"`
+	Data       []byte           `json:"data"`
+}
+
+// failureEvent is about a lost agent, or about a terminated executor if ExecutorID is set
+type failureEvent struct {
+	AgentID    *mesos.AgentID    `json:"agent_id,omitempty"`
+	ExecutorID *mesos.ExecutorID `json:"executor_id,omitempty"`
+	Status     *int32            `json:"status,omitempty"`
+}
+
+type errorEvent struct {
+	Message string `json:"message"`
+}
+
+// Reset, String and ProtoMessage make an event a proto.Message, which the framing decoder expects.
+// Unmarshal and UnmarshalJSON make it an encoding.Unmarshaler.
+func (e *schedulerEvent) Reset()         { *e = schedulerEvent{} }
+func (e *schedulerEvent) String() string { return e.Type }
+func (e *schedulerEvent) ProtoMessage()  {}
+
+func (e *schedulerEvent) Unmarshal([]byte) error {
+	return errProtobufUnsupported
+}
+
+func (e *schedulerEvent) UnmarshalJSON(data []byte) error {
+	type plain schedulerEvent
+	return json.Unmarshal(data, (*plain)(e))
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/mesos/mesos-go"
+)
+
+func TestAcceptCallMarshalJSON(t *testing.T) {
+	j := func(spec string) *jobSpec {
+		return testJob(t, `{"name": "web", "cmd": "x", "ports": [{"name": "http"}], `+spec+`}`)
+	}
+	tests := []struct {
+		name string
+		job  *jobSpec
+		want string
+	}{
+		{name: "no health check", job: j(`"labels": {"tier": "web"}`), want: `null`},
+		{
+			name: "http",
+			job:  j(`"healthCheck": {"protocol": "http", "path": "/health"}`),
+			want: `{"http":{"port":31005,"path":"/health"},"interval_seconds":10,"timeout_seconds":5,"consecutive_failures":3,"grace_period_seconds":60}`,
+		},
+		{
+			name: "tcp",
+			job:  j(`"healthCheck": {"protocol": "tcp"}`),
+			want: `{"interval_seconds":10,"timeout_seconds":5,"consecutive_failures":3,"grace_period_seconds":60,"type":"TCP","tcp":{"port":31005}}`,
+		},
+		{
+			name: "tcp on a container port",
+			job:  j(`"healthCheck": {"protocol": "tcp"}, "ports": [{"containerPort": 80}], "container": {"type": "docker", "image": "nginx", "network": "bridge"}`),
+			want: `{"interval_seconds":10,"timeout_seconds":5,"consecutive_failures":3,"grace_period_seconds":60,"type":"TCP","tcp":{"port":80}}`,
+		},
+		{
+			name: "command",
+			job:  j(`"healthCheck": {"protocol": "command", "command": "true"}`),
+			want: `{"interval_seconds":10,"timeout_seconds":5,"consecutive_failures":3,"grace_period_seconds":60,"command":{"uris":null,"value":"true"}}`,
+		},
+	}
+	offer := &mesos.Offer{AgentID: mesos.AgentID{Value: "a1"}, Hostname: "h1"}
+	for _, test := range tests {
+		task := newTaskInfo(test.job, offer, &resourceClaim{hostPorts: []uint64{31005}})
+		call := &acceptCall{
+			OfferIDs:   []mesos.OfferID{{Value: "o1"}},
+			Operations: []mesos.Offer_Operation{launchOperation([]mesos.TaskInfo{*task})},
+		}
+		data, err := json.Marshal(call)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		var decoded struct {
+			OfferIDs   []mesos.OfferID `json:"offer_ids"`
+			Operations []struct {
+				Type   string `json:"type"`
+				Launch struct {
+					TaskInfos []struct {
+						TaskID      mesos.TaskID    `json:"task_id"`
+						Labels      json.RawMessage `json:"labels"`
+						HealthCheck json.RawMessage `json:"health_check"`
+					} `json:"task_infos"`
+				} `json:"launch"`
+			} `json:"operations"`
+		}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(decoded.OfferIDs) != 1 || len(decoded.Operations) != 1 || decoded.Operations[0].Type != "LAUNCH" ||
+			len(decoded.Operations[0].Launch.TaskInfos) != 1 {
+			t.Errorf("%s: got %s", test.name, data)
+			continue
+		}
+		sent := decoded.Operations[0].Launch.TaskInfos[0]
+		if sent.TaskID != task.TaskID {
+			t.Errorf("%s: sent task %s, want %s", test.name, sent.TaskID.Value, task.TaskID.Value)
+		}
+		if !sameJSON(sent.HealthCheck, []byte(test.want)) {
+			t.Errorf("%s: got health check %s, want %s", test.name, sent.HealthCheck, test.want)
+		}
+		if labels, _ := json.Marshal(task.Labels); !sameJSON(sent.Labels, labels) {
+			t.Errorf("%s: got labels %s, want %s", test.name, sent.Labels, labels)
+		}
+	}
+}
+
+// sameJSON tells whether two JSON documents hold the same values, a missing one is null
+func sameJSON(a, b []byte) bool {
+	var va, vb interface{}
+	if len(a) > 0 && json.Unmarshal(a, &va) != nil || len(b) > 0 && json.Unmarshal(b, &vb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/mesos/mesos-go"
+)
+
+// Constraint operators, with the same meaning as in Marathon
+const (
+	constraintUnique  = "UNIQUE"
+	constraintCluster = "CLUSTER"
+	constraintGroupBy = "GROUP_BY"
+	constraintLike    = "LIKE"
+	constraintUnlike  = "UNLIKE"
+	constraintMaxPer  = "MAX_PER"
+)
+
+const hostnameField = "hostname"
+
+// constraint limits the agents the tasks of a job can go to. It is written like in Marathon,
+// as [field, operator] or [field, operator, value], e.g. ["hostname", "UNIQUE"] or
+// ["rack", "GROUP_BY", "3"]. The field is "hostname" or the name of an agent attribute.
+type constraint struct {
+	field    string
+	operator string
+	value    string
+	pattern  *regexp.Regexp
+	limit    int
+}
+
+// taskPlacement is where one task of a job runs, or is about to run
+type taskPlacement struct {
+	slaveID    string
+	hostname   string
+	attributes map[string]string
+}
+
+func (p taskPlacement) field(name string) (string, bool) {
+	if name == hostnameField {
+		return p.hostname, p.hostname != ""
+	}
+	value, ok := p.attributes[name]
+	return value, ok
+}
+
+func parseConstraint(raw []string) (*constraint, error) {
+	if len(raw) < 2 || len(raw) > 3 {
+		return nil, fmt.Errorf("constraint %v must be [field, operator] or [field, operator, value]", raw)
+	}
+	c := &constraint{field: raw[0], operator: strings.ToUpper(raw[1])}
+	if len(raw) == 3 {
+		c.value = raw[2]
+	}
+	switch c.operator {
+	case constraintUnique:
+	case constraintCluster:
+	case constraintGroupBy:
+		// without a number of groups, tasks spread across the groups seen so far
+		if c.value == "" {
+			break
+		}
+		n, err := strconv.Atoi(c.value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("constraint %v: GROUP_BY takes a positive number of groups", raw)
+		}
+		c.limit = n
+	case constraintMaxPer:
+		n, err := strconv.Atoi(c.value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("constraint %v: MAX_PER takes a positive number of tasks", raw)
+		}
+		c.limit = n
+	case constraintLike, constraintUnlike:
+		// an empty pattern only matches agents without a value, which is never what was meant
+		if c.value == "" {
+			return nil, fmt.Errorf("constraint %v: %s takes a regular expression", raw, c.operator)
+		}
+		pattern, err := regexp.Compile("^(?:" + c.value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("constraint %v: %s", raw, err)
+		}
+		c.pattern = pattern
+	default:
+		return nil, fmt.Errorf("constraint %v: unknown operator %s", raw, raw[1])
+	}
+	return c, nil
+}
+
+// offerAttributes returns the text, scalar and set attributes of the offer as strings
+func offerAttributes(offer *mesos.Offer) map[string]string {
+	attributes := make(map[string]string)
+	for _, attribute := range offer.Attributes {
+		switch attribute.GetType() {
+		case mesos.TEXT:
+			attributes[attribute.Name] = attribute.GetText().GetValue()
+		case mesos.SCALAR:
+			attributes[attribute.Name] = strconv.FormatFloat(attribute.GetScalar().GetValue(), 'f', -1, 64)
+		case mesos.SET:
+			attributes[attribute.Name] = strings.Join(attribute.GetSet().GetItem(), ",")
+		}
+	}
+	return attributes
+}
+
+func offerPlacement(offer *mesos.Offer) taskPlacement {
+	return taskPlacement{
+		slaveID:    offer.AgentID.Value,
+		hostname:   offer.Hostname,
+		attributes: offerAttributes(offer),
+	}
+}
+
+// check returns why a new task cannot go to the agent of the offer, given where the other
+// tasks of the job are in the order they were launched, or nil if it can
+func (c *constraint) check(offer taskPlacement, placed []taskPlacement) error {
+	value, ok := offer.field(c.field)
+	if !ok {
+		if c.operator == constraintUnlike {
+			return nil
+		}
+		return fmt.Errorf("%s %s: agent has no %s", c.field, c.operator, c.field)
+	}
+
+	counts := make(map[string]int)
+	for _, p := range placed {
+		if v, ok := p.field(c.field); ok {
+			counts[v]++
+		}
+	}
+
+	switch c.operator {
+	case constraintUnique:
+		if counts[value] > 0 {
+			return fmt.Errorf("%s UNIQUE: a task already runs on %s", c.field, value)
+		}
+	case constraintCluster:
+		want := c.value
+		if want == "" {
+			// without a value, all tasks stay with the first one, placed is in launch order
+			for _, p := range placed {
+				if v, ok := p.field(c.field); ok {
+					want = v
+					break
+				}
+			}
+		}
+		if want != "" && value != want {
+			return fmt.Errorf("%s CLUSTER: %s is not %s", c.field, value, want)
+		}
+	case constraintGroupBy:
+		min := -1
+		for _, n := range counts {
+			if min < 0 || n < min {
+				min = n
+			}
+		}
+		if min < 0 || len(counts) < c.limit {
+			// there are groups without any task yet, the group of the offer may be a new one too
+			min = 0
+		}
+		if counts[value] > min {
+			return fmt.Errorf("%s GROUP_BY: %d tasks on %s already, fewest per group is %d",
+				c.field, counts[value], value, min)
+		}
+	case constraintMaxPer:
+		if counts[value] >= c.limit {
+			return fmt.Errorf("%s MAX_PER: %d tasks on %s already", c.field, counts[value], value)
+		}
+	case constraintLike:
+		if !c.pattern.MatchString(value) {
+			return fmt.Errorf("%s LIKE: %s does not match %s", c.field, value, c.value)
+		}
+	case constraintUnlike:
+		if c.pattern.MatchString(value) {
+			return fmt.Errorf("%s UNLIKE: %s matches %s", c.field, value, c.value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		raw []string
+		err string
+	}{
+		{raw: []string{"hostname", "UNIQUE"}},
+		{raw: []string{"rack", "cluster", "r1"}},
+		{raw: []string{"rack", "CLUSTER"}},
+		{raw: []string{"rack", "GROUP_BY", "3"}},
+		{raw: []string{"rack", "GROUP_BY"}},
+		{raw: []string{"rack", "MAX_PER", "2"}},
+		{raw: []string{"hostname", "LIKE", "host[0-9]+"}},
+		{raw: []string{"hostname", "UNLIKE", "db.*"}},
+		{raw: []string{"hostname"}, err: "constraint [hostname] must be [field, operator] or [field, operator, value]"},
+		{raw: []string{"a", "UNIQUE", "b", "c"}, err: "constraint [a UNIQUE b c] must be [field, operator] or [field, operator, value]"},
+		{raw: []string{"rack", "NEAR"}, err: "constraint [rack NEAR]: unknown operator NEAR"},
+		{raw: []string{"rack", "GROUP_BY", "0"}, err: "constraint [rack GROUP_BY 0]: GROUP_BY takes a positive number of groups"},
+		{raw: []string{"rack", "MAX_PER", "two"}, err: "constraint [rack MAX_PER two]: MAX_PER takes a positive number of tasks"},
+		{raw: []string{"rack", "LIKE"}, err: "constraint [rack LIKE]: LIKE takes a regular expression"},
+		{raw: []string{"rack", "UNLIKE", ""}, err: "constraint [rack UNLIKE ]: UNLIKE takes a regular expression"},
+		{raw: []string{"rack", "LIKE", "("}, err: "constraint [rack LIKE (]: error parsing regexp: missing closing ): `^(?:()$`"},
+	}
+	for _, test := range tests {
+		_, err := parseConstraint(test.raw)
+		if test.err == "" && err != nil {
+			t.Errorf("%v: unexpected error %s", test.raw, err)
+		}
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%v: got error %v, want %q", test.raw, err, test.err)
+		}
+	}
+}
+
+func TestConstraintCheck(t *testing.T) {
+	agent := func(hostname, rack string) taskPlacement {
+		p := taskPlacement{hostname: hostname, attributes: map[string]string{}}
+		if rack != "" {
+			p.attributes["rack"] = rack
+		}
+		return p
+	}
+	tests := []struct {
+		name   string
+		raw    []string
+		offer  taskPlacement
+		placed []taskPlacement
+		err    string
+	}{
+		{
+			name:   "UNIQUE on a new host",
+			raw:    []string{"hostname", "UNIQUE"},
+			offer:  agent("h1", ""),
+			placed: []taskPlacement{agent("h2", "")},
+		},
+		{
+			name:   "UNIQUE on a used host",
+			raw:    []string{"hostname", "UNIQUE"},
+			offer:  agent("h1", ""),
+			placed: []taskPlacement{agent("h1", "")},
+			err:    "hostname UNIQUE: a task already runs on h1",
+		},
+		{
+			name:  "CLUSTER with a value",
+			raw:   []string{"rack", "CLUSTER", "r1"},
+			offer: agent("h1", "r2"),
+			err:   "rack CLUSTER: r2 is not r1",
+		},
+		{
+			name:  "CLUSTER without a value or placed tasks",
+			raw:   []string{"rack", "CLUSTER"},
+			offer: agent("h1", "r2"),
+		},
+		{
+			name:   "CLUSTER without a value follows the first task",
+			raw:    []string{"rack", "CLUSTER"},
+			offer:  agent("h3", "r2"),
+			placed: []taskPlacement{agent("h0", ""), agent("h1", "r1"), agent("h2", "r2")},
+			err:    "rack CLUSTER: r2 is not r1",
+		},
+		{
+			name:   "GROUP_BY with an empty group left",
+			raw:    []string{"rack", "GROUP_BY", "3"},
+			offer:  agent("h1", "r1"),
+			placed: []taskPlacement{agent("h1", "r1"), agent("h2", "r2")},
+			err:    "rack GROUP_BY: 1 tasks on r1 already, fewest per group is 0",
+		},
+		{
+			name:   "GROUP_BY onto the smallest group",
+			raw:    []string{"rack", "GROUP_BY", "2"},
+			offer:  agent("h2", "r2"),
+			placed: []taskPlacement{agent("h1", "r1"), agent("h2", "r2"), agent("h3", "r1")},
+		},
+		{
+			name:   "GROUP_BY without a value onto a new group",
+			raw:    []string{"rack", "GROUP_BY"},
+			offer:  agent("h3", "r3"),
+			placed: []taskPlacement{agent("h1", "r1"), agent("h2", "r2"), agent("h4", "r1")},
+		},
+		{
+			name:   "GROUP_BY without a value onto the biggest group seen",
+			raw:    []string{"rack", "GROUP_BY"},
+			offer:  agent("h1", "r1"),
+			placed: []taskPlacement{agent("h1", "r1"), agent("h2", "r2"), agent("h4", "r1")},
+			err:    "rack GROUP_BY: 2 tasks on r1 already, fewest per group is 1",
+		},
+		{
+			name:   "MAX_PER below the limit",
+			raw:    []string{"rack", "MAX_PER", "2"},
+			offer:  agent("h1", "r1"),
+			placed: []taskPlacement{agent("h2", "r1")},
+		},
+		{
+			name:   "MAX_PER at the limit",
+			raw:    []string{"rack", "MAX_PER", "2"},
+			offer:  agent("h1", "r1"),
+			placed: []taskPlacement{agent("h2", "r1"), agent("h3", "r1")},
+			err:    "rack MAX_PER: 2 tasks on r1 already",
+		},
+		{
+			name:  "LIKE matches the whole value",
+			raw:   []string{"hostname", "LIKE", "web[0-9]"},
+			offer: agent("web12", ""),
+			err:   "hostname LIKE: web12 does not match web[0-9]",
+		},
+		{
+			name:  "UNLIKE",
+			raw:   []string{"hostname", "UNLIKE", "db.*"},
+			offer: agent("db1", ""),
+			err:   "hostname UNLIKE: db1 matches db.*",
+		},
+		{
+			name:  "UNLIKE on an agent without the attribute",
+			raw:   []string{"rack", "UNLIKE", "r1"},
+			offer: agent("h1", ""),
+		},
+		{
+			name:  "agent without the attribute",
+			raw:   []string{"rack", "LIKE", "r1"},
+			offer: agent("h1", ""),
+			err:   "rack LIKE: agent has no rack",
+		},
+	}
+	for _, test := range tests {
+		c, err := parseConstraint(test.raw)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		err = c.check(test.offer, test.placed)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+		}
+		if test.err != "" && (err == nil || err.Error() != test.err) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
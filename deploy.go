@@ -0,0 +1,130 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mesos/mesos-go"
+)
+
+const (
+	deployInterval                    = time.Duration(1) * time.Second
+	defaultMinimumHealthyPercent      = 100
+	defaultMaximumOverCapacityPercent = 25
+	defaultUpgradeMaxFailures         = 3
+)
+
+// isReady reports whether a task is running and, if it has a health check, passed it
+func isReady(task *taskRecord) bool {
+	if task == nil || task.state != mesos.TASK_RUNNING {
+		return false
+	}
+	return task.unhealthyTimeout == 0 || (task.healthy != nil && *task.healthy)
+}
+
+// runDeployments advances the rolling upgrades of all services until stop is closed
+func (s *demoScheduler) runDeployments(stop <-chan struct{}) {
+	ticker := time.NewTicker(deployInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, name := range s.shellCmdQueue.deployments() {
+			s.advanceDeployment(name)
+		}
+	}
+}
+
+// advanceDeployment does one step of a rolling upgrade. It stops instances of the old version
+// for as long as enough instances stay healthy, those which are not up first, and queues the
+// next batch of new instances within the over capacity once all new instances so far are ready.
+// A deployment whose new tasks keep failing is rolled back the same way.
+func (s *demoScheduler) advanceDeployment(name string) {
+	d, jobs, ok := s.shellCmdQueue.deploymentState(name)
+	if !ok {
+		return
+	}
+	fields := log.Fields{"service": name, "from": d.from.version, "to": d.to.version, "rollback": d.rollback}
+	strategy := d.to.UpgradeStrategy
+	if !d.rollback && d.failures >= strategy.MaxFailures {
+		fields["failures"] = d.failures
+		log.WithFields(fields).Error("tasks of the new version keep failing, rolling back")
+		s.shellCmdQueue.rollback(name)
+		return
+	}
+
+	up := make(map[string]bool)
+	old, current := []job{}, []job{}
+	deployed := make(map[int]bool)
+	healthy, ready := 0, 0
+	for _, j := range jobs {
+		if j.State == jobLaunched {
+			task, _ := s.tasks.get(j.TaskID)
+			up[j.ID] = isReady(task)
+		}
+		if j.Version != d.to.version {
+			old = append(old, j)
+			if up[j.ID] {
+				healthy++
+			}
+			continue
+		}
+		current = append(current, j)
+		deployed[j.Instance] = true
+		if up[j.ID] {
+			ready++
+		}
+	}
+
+	if len(old) == 0 && ready >= d.instances {
+		log.WithFields(fields).Info("deployment finished")
+		s.shellCmdQueue.endDeployment(name)
+		return
+	}
+
+	minHealthy, maxRunning := strategy.bounds(d.instances)
+	spare := healthy + ready - minHealthy
+	running := len(old) + len(current)
+	stop := func(j job) {
+		log.WithFields(fields).WithFields(log.Fields{"jobID": j.ID, "version": j.Version}).Info("stopping old instance")
+		s.stopInstance(j.ID)
+		running--
+	}
+	// old instances which are not up don't count as healthy and go first
+	for _, j := range old {
+		if !up[j.ID] {
+			stop(j)
+		}
+	}
+	for _, j := range old {
+		if up[j.ID] && spare > 0 {
+			stop(j)
+			spare--
+		}
+	}
+
+	// the next batch waits until the previous one is ready
+	if ready < len(current) {
+		return
+	}
+	for i := 0; i < d.instances && running < maxRunning; i++ {
+		if deployed[i] {
+			continue
+		}
+		if j, ok := s.shellCmdQueue.addInstance(name, i); ok {
+			log.WithFields(fields).WithFields(log.Fields{"jobID": j.ID, "instance": i}).Info("queued new instance")
+			running++
+		}
+	}
+}
+
+// stopInstance stops an instance of a service and kills its task if it was launched
+func (s *demoScheduler) stopInstance(id string) {
+	j, ok := s.shellCmdQueue.stop(id)
+	if ok && j.State == jobLaunched {
+		s.killTask(j.TaskID)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	masterInfoPrefix      = "json.info_"
+	masterPollInterval    = time.Duration(10) * time.Second
+	masterRequestTimeout  = time.Duration(5) * time.Second
+	zkDetectorSessionTime = time.Duration(10) * time.Second
+)
+
+// masterDetector finds the leading mesos master
+type masterDetector interface {
+	// detect sends the address of the leading master every time it changes, until stop is closed
+	detect(stop <-chan struct{}) <-chan string
+}
+
+// newMasterDetector understands three kinds of -master values: a zk://host1:2181,host2:2181/mesos
+// url, where the leader is read from zookeeper, a comma separated list of masters, which are asked
+// for the leader, and a single host:port, which is the leader.
+func newMasterDetector(master string) (masterDetector, error) {
+	if strings.HasPrefix(master, "zk://") {
+		u, err := url.Parse(master)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" || u.Path == "" {
+			return nil, fmt.Errorf("invalid zookeeper master url %s", master)
+		}
+		return &zkMasterDetector{servers: strings.Split(u.Host, ","), path: strings.TrimRight(u.Path, "/")}, nil
+	}
+	masters := []string{}
+	for _, m := range strings.Split(master, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			masters = append(masters, m)
+		}
+	}
+	if len(masters) == 0 {
+		return nil, fmt.Errorf("no master given")
+	}
+	if len(masters) == 1 {
+		return staticMasterDetector(masters[0]), nil
+	}
+	return &listMasterDetector{masters: masters}, nil
+}
+
+// staticMasterDetector always returns the same master
+type staticMasterDetector string
+
+func (d staticMasterDetector) detect(stop <-chan struct{}) <-chan string {
+	leaders := make(chan string, 1)
+	leaders <- string(d)
+	return leaders
+}
+
+// listMasterDetector polls a fixed list of masters. Non-leading masters redirect /master/redirect
+// to the leader, so any reachable master can tell us who is leading.
+type listMasterDetector struct {
+	masters []string
+}
+
+func (d *listMasterDetector) detect(stop <-chan struct{}) <-chan string {
+	leaders := make(chan string)
+	go func() {
+		defer close(leaders)
+		client := &http.Client{
+			Timeout: masterRequestTimeout,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+		current := ""
+		for {
+			leader, err := d.findLeader(client)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err}).Warn("no leading master found")
+			} else if leader != current {
+				current = leader
+				select {
+				case leaders <- leader:
+				case <-stop:
+					return
+				}
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(masterPollInterval):
+			}
+		}
+	}()
+	return leaders
+}
+
+func (d *listMasterDetector) findLeader(client *http.Client) (string, error) {
+	var lastErr error
+	for _, master := range d.masters {
+		resp, err := client.Get("http://" + master + "/master/redirect")
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		location := resp.Header.Get("Location")
+		if resp.StatusCode != http.StatusTemporaryRedirect || location == "" {
+			lastErr = fmt.Errorf("unexpected response from %s: %s", master, resp.Status)
+			continue
+		}
+		// the location looks like //host:port/master
+		u, err := url.Parse(location)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return u.Host, nil
+	}
+	return "", lastErr
+}
+
+// zkMasterDetector reads the leading master from the json.info_* znodes the masters create
+type zkMasterDetector struct {
+	servers []string
+	path    string
+}
+
+// zkMasterInfo is the part of the master's JSON MasterInfo we need
+type zkMasterInfo struct {
+	Address struct {
+		Hostname string `json:"hostname"`
+		IP       string `json:"ip"`
+		Port     int    `json:"port"`
+	} `json:"address"`
+	Hostname string `json:"hostname"`
+	Port     int    `json:"port"`
+	Pid      string `json:"pid"`
+}
+
+func (m *zkMasterInfo) hostPort() (string, error) {
+	if m.Address.Port != 0 {
+		if m.Address.IP != "" {
+			return net.JoinHostPort(m.Address.IP, strconv.Itoa(m.Address.Port)), nil
+		}
+		if m.Address.Hostname != "" {
+			return net.JoinHostPort(m.Address.Hostname, strconv.Itoa(m.Address.Port)), nil
+		}
+	}
+	if m.Hostname != "" && m.Port != 0 {
+		return net.JoinHostPort(m.Hostname, strconv.Itoa(m.Port)), nil
+	}
+	// pid looks like master@10.0.0.1:5050
+	if i := strings.Index(m.Pid, "@"); i >= 0 {
+		return m.Pid[i+1:], nil
+	}
+	return "", fmt.Errorf("no address in master info")
+}
+
+func (d *zkMasterDetector) detect(stop <-chan struct{}) <-chan string {
+	leaders := make(chan string)
+	go func() {
+		defer close(leaders)
+		conn, _, err := zk.Connect(d.servers, zkDetectorSessionTime)
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("connect to zookeeper failed")
+			return
+		}
+		defer conn.Close()
+
+		current := ""
+		for {
+			leader, watch, err := d.leader(conn)
+			if err != nil {
+				log.WithFields(log.Fields{"err": err, "path": d.path}).Warn("no leading master found")
+			} else if leader != current {
+				current = leader
+				log.WithFields(log.Fields{"master": leader}).Info("detected leading master")
+				select {
+				case leaders <- leader:
+				case <-stop:
+					return
+				}
+			}
+			if watch == nil {
+				select {
+				case <-stop:
+					return
+				case <-time.After(masterPollInterval):
+				}
+				continue
+			}
+			select {
+			case <-stop:
+				return
+			case <-watch:
+			}
+		}
+	}()
+	return leaders
+}
+
+// leader returns the address of the master with the lowest sequence number, and a watch which
+// fires when the set of masters changes
+func (d *zkMasterDetector) leader(conn *zk.Conn) (string, <-chan zk.Event, error) {
+	children, _, watch, err := conn.ChildrenW(d.path)
+	if err != nil {
+		return "", nil, err
+	}
+	infos := []string{}
+	for _, child := range children {
+		if strings.HasPrefix(child, masterInfoPrefix) {
+			infos = append(infos, child)
+		}
+	}
+	if len(infos) == 0 {
+		return "", watch, fmt.Errorf("no master registered in zookeeper")
+	}
+	// the sequence numbers are zero padded, so the lowest one also sorts first
+	sort.Strings(infos)
+	data, _, err := conn.Get(d.path + "/" + infos[0])
+	if err != nil {
+		return "", watch, err
+	}
+	info := zkMasterInfo{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "", watch, err
+	}
+	leader, err := info.hostPort()
+	return leader, watch, err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewMasterDetector(t *testing.T) {
+	tests := []struct {
+		master   string
+		detector masterDetector
+		err      string
+	}{
+		{
+			master:   "zk://zk1:2181,zk2:2181/mesos/",
+			detector: &zkMasterDetector{servers: []string{"zk1:2181", "zk2:2181"}, path: "/mesos"},
+		},
+		{master: "zk://zk1:2181", err: "invalid zookeeper master url zk://zk1:2181"},
+		{master: "zk:///mesos", err: "invalid zookeeper master url zk:///mesos"},
+		{master: "m1:5050", detector: staticMasterDetector("m1:5050")},
+		{master: " m1:5050 , ", detector: staticMasterDetector("m1:5050")},
+		{master: "m1:5050, m2:5050", detector: &listMasterDetector{masters: []string{"m1:5050", "m2:5050"}}},
+		{master: " , ", err: "no master given"},
+	}
+	for _, test := range tests {
+		detector, err := newMasterDetector(test.master)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: got error %v, want %s", test.master, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.master, err)
+			continue
+		}
+		if fmt.Sprintf("%#v", detector) != fmt.Sprintf("%#v", test.detector) {
+			t.Errorf("%q: got %#v, want %#v", test.master, detector, test.detector)
+		}
+	}
+}
+
+func TestZkMasterInfoHostPort(t *testing.T) {
+	tests := []struct {
+		name string
+		info string
+		host string
+		err  string
+	}{
+		{
+			name: "address with ip",
+			info: `{"address": {"hostname": "m1", "ip": "10.0.0.1", "port": 5050}, "hostname": "m1", "port": 5050}`,
+			host: "10.0.0.1:5050",
+		},
+		{
+			name: "address without ip",
+			info: `{"address": {"hostname": "m1", "port": 5050}}`,
+			host: "m1:5050",
+		},
+		{
+			name: "ipv6 address",
+			info: `{"address": {"ip": "fd00::1", "port": 5050}}`,
+			host: "[fd00::1]:5050",
+		},
+		{
+			name: "hostname and port of old masters",
+			info: `{"hostname": "m1", "port": 5051}`,
+			host: "m1:5051",
+		},
+		{
+			name: "pid",
+			info: `{"pid": "master@10.0.0.2:5050"}`,
+			host: "10.0.0.2:5050",
+		},
+		{
+			name: "nothing",
+			info: `{"address": {"hostname": "m1"}}`,
+			err:  "no address in master info",
+		},
+	}
+	for _, test := range tests {
+		info := zkMasterInfo{}
+		if err := json.Unmarshal([]byte(test.info), &info); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		host, err := info.hostPort()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || host != test.host {
+			t.Errorf("%s: got %q and error %v, want %q", test.name, host, err, test.host)
+		}
+	}
+}
+
+func TestListMasterDetectorFindLeader(t *testing.T) {
+	// the leader redirects to itself, the other masters redirect to it
+	redirect := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/master/redirect" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Location", "//leader:5050/master")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	}))
+	defer redirect.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	address := func(s *httptest.Server) string { return strings.TrimPrefix(s.URL, "http://") }
+
+	tests := []struct {
+		name    string
+		masters []string
+		leader  string
+		err     string
+	}{
+		{name: "redirected", masters: []string{address(redirect)}, leader: "leader:5050"},
+		{name: "after a broken master", masters: []string{address(broken), address(redirect)}, leader: "leader:5050"},
+		{name: "only broken masters", masters: []string{address(broken)}, err: "503 Service Unavailable"},
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	for _, test := range tests {
+		d := &listMasterDetector{masters: test.masters}
+		leader, err := d.findLeader(client)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || leader != test.leader {
+			t.Errorf("%s: got %q and error %v, want %q", test.name, leader, err, test.leader)
+		}
+	}
+}
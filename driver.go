@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/mesos/mesos-go"
+)
+
+// schedulerDriver is how the scheduler talks to the master, with the calls of the v1 scheduler API
+type schedulerDriver interface {
+	// Run subscribes to the master and delivers its events to the scheduler until Stop is called,
+	// or the master sent an error
+	Run() error
+	// Stop ends the subscription. Without failover the framework is torn down, which kills all
+	// its tasks.
+	Stop(failover bool) error
+	AcceptOffers(offerIDs []mesos.OfferID, operations []mesos.Offer_Operation, filters *mesos.Filters) error
+	DeclineOffer(offerID mesos.OfferID, filters *mesos.Filters) error
+	// KillTask kills a task, with the grace period of the policy if it is not nil
+	KillTask(taskID mesos.TaskID, agentID *mesos.AgentID, policy *killPolicy) error
+	// ReconcileTasks asks for the state of the given tasks, or of all tasks if there are none
+	ReconcileTasks(statuses []mesos.TaskStatus) error
+}
+
+// scheduler gets the events of the subscription. Status updates are acknowledged by the driver
+// once StatusUpdate returns.
+type scheduler interface {
+	Registered(driver schedulerDriver, frameworkID mesos.FrameworkID, masterInfo *mesos.MasterInfo)
+	Disconnected(driver schedulerDriver)
+	ResourceOffers(driver schedulerDriver, offers []mesos.Offer)
+	OfferRescinded(driver schedulerDriver, offerID mesos.OfferID)
+	StatusUpdate(driver schedulerDriver, status mesos.TaskStatus)
+	FrameworkMessage(driver schedulerDriver, executorID mesos.ExecutorID, agentID mesos.AgentID, data []byte)
+	SlaveLost(driver schedulerDriver, agentID mesos.AgentID)
+	ExecutorLost(driver schedulerDriver, executorID mesos.ExecutorID, agentID mesos.AgentID, status int)
+	Error(driver schedulerDriver, message string)
+}
+
+// driverFactory creates the driver for a newly detected leading master
+type driverFactory func(master string, framework mesos.FrameworkInfo, sched scheduler) schedulerDriver
+
+func newHTTPDriverFactory() driverFactory {
+	return func(master string, framework mesos.FrameworkInfo, sched scheduler) schedulerDriver {
+		return newHTTPDriver(master, framework, sched)
+	}
+}
+
+// newFakeDriverFactory runs the scheduler against a fake master instead of the detected one
+func newFakeDriverFactory(cluster *fakeClusterSpec) driverFactory {
+	return func(_ string, framework mesos.FrameworkInfo, sched scheduler) schedulerDriver {
+		return newFakeDriver(cluster, framework, sched)
+	}
+}
+
+// launchOperation launches tasks on the resources of an offer
+func launchOperation(tasks []mesos.TaskInfo) mesos.Offer_Operation {
+	return mesos.Offer_Operation{
+		Type:   mesos.LAUNCH.Enum(),
+		Launch: &mesos.Offer_Operation_Launch{TaskInfos: tasks},
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+	"github.com/pborman/uuid"
+)
+
+const (
+	fakeFrameworkID          = "fake-framework"
+	defaultFakeOfferInterval = time.Duration(1) * time.Second
+)
+
+// duration is a time.Duration written as a string like "1.5s" in JSON
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// fakeAgentSpec is one agent of a fake cluster
+type fakeAgentSpec struct {
+	ID       string  `json:"id"`
+	Hostname string  `json:"hostname"`
+	Cpus     float64 `json:"cpus"`
+	Mem      float64 `json:"mem"`
+	Disk     float64 `json:"disk"`
+	// Ports are ranges of host ports, e.g. [[31000, 32000]]
+	Ports [][2]uint64 `json:"ports"`
+	// Role statically reserves all resources of the agent for a role
+	Role       string            `json:"role"`
+	Attributes map[string]string `json:"attributes"`
+	// LostAfter loses the agent, with all its tasks, that long after the driver started
+	LostAfter duration `json:"lostAfter"`
+}
+
+// fakeClusterSpec describes what a fake master offers and how the tasks launched on it behave:
+//
+//	{"agents": [{"id": "a1", "hostname": "host1", "cpus": 4, "mem": 4096,
+//	             "ports": [[31000, 32000]], "attributes": {"rack": "r1"}}],
+//	 "offerInterval": "1s", "startDelay": "500ms", "runTime": "30s", "failureRate": 0.1}
+type fakeClusterSpec struct {
+	Agents        []fakeAgentSpec `json:"agents"`
+	OfferInterval duration        `json:"offerInterval"`
+	// StartDelay is how long a task stays staging before it runs or fails
+	StartDelay duration `json:"startDelay"`
+	// RunTime is how long a task runs before it finishes, tasks run until killed if it is 0
+	RunTime   duration `json:"runTime"`
+	KillDelay duration `json:"killDelay"`
+	// FailureRate is the share of tasks which fail instead of starting
+	FailureRate float64 `json:"failureRate"`
+	// DropKillRate is the share of kills the fake master loses
+	DropKillRate float64 `json:"dropKillRate"`
+	// UnhealthyRate is the share of running tasks with a health check which turn unhealthy. The
+	// fake master leaves it to the scheduler to kill them.
+	UnhealthyRate float64 `json:"unhealthyRate"`
+	Seed          int64   `json:"seed"`
+}
+
+func loadFakeCluster(path string) (*fakeClusterSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cluster := &fakeClusterSpec{}
+	if err := json.Unmarshal(data, cluster); err != nil {
+		return nil, err
+	}
+	if len(cluster.Agents) == 0 {
+		return nil, fmt.Errorf("no agents defined")
+	}
+	ids := make(map[string]bool)
+	for i := range cluster.Agents {
+		agent := &cluster.Agents[i]
+		if agent.ID == "" {
+			agent.ID = fmt.Sprintf("agent-%d", i)
+		}
+		if ids[agent.ID] {
+			return nil, fmt.Errorf("agent %q defined more than once", agent.ID)
+		}
+		ids[agent.ID] = true
+		if agent.Hostname == "" {
+			agent.Hostname = agent.ID
+		}
+		if agent.Role == "" {
+			agent.Role = string(mesos.RoleDefault)
+		}
+	}
+	if cluster.OfferInterval.Duration <= 0 {
+		cluster.OfferInterval.Duration = defaultFakeOfferInterval
+	}
+	return cluster, nil
+}
+
+func (spec *fakeAgentSpec) resources() mesos.Resources {
+	resources := mesos.Resources{}
+	resources.Add(
+		*mesos.BuildResource().Name("cpus").Scalar(spec.Cpus).Role(spec.Role).Resource,
+		*mesos.BuildResource().Name("mem").Scalar(spec.Mem).Role(spec.Role).Resource,
+		*mesos.BuildResource().Name("disk").Scalar(spec.Disk).Role(spec.Role).Resource,
+	)
+	if len(spec.Ports) > 0 {
+		ports := mesos.BuildRanges()
+		for _, r := range spec.Ports {
+			ports = ports.Span(r[0], r[1])
+		}
+		resources.Add(*mesos.BuildResource().Name("ports").Ranges(ports.Ranges).Role(spec.Role).Resource)
+	}
+	return resources
+}
+
+func (spec *fakeAgentSpec) attributes() []mesos.Attribute {
+	names := []string{}
+	for name := range spec.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	attributes := []mesos.Attribute{}
+	for _, name := range names {
+		attributes = append(attributes, mesos.Attribute{
+			Name: name,
+			Type: mesos.TEXT.Enum(),
+			Text: &mesos.Value_Text{Value: spec.Attributes[name]},
+		})
+	}
+	return attributes
+}
+
+type fakeAgent struct {
+	spec *fakeAgentSpec
+	// available is what is neither used by tasks nor gone, it includes what is offered
+	available    mesos.Resources
+	offerID      string
+	refusedUntil time.Time
+	lost         bool
+}
+
+type fakeTask struct {
+	info  mesos.TaskInfo
+	agent *fakeAgent
+	state mesos.TaskState
+}
+
+// fakeDriver is a schedulerDriver with an in-process fake master, so the scheduler can run
+// without a cluster. It offers the resources of the agents of a fakeClusterSpec, checks that
+// launched tasks fit into their offers, and moves tasks through their states with the delays and
+// failures of the spec. Like a real driver it delivers all events on the goroutine of Run.
+type fakeDriver struct {
+	sync.Mutex
+	cluster     *fakeClusterSpec
+	framework   mesos.FrameworkInfo
+	sched       scheduler
+	rand        *rand.Rand
+	agents      []*fakeAgent
+	offers      map[string]mesos.Offer
+	tasks       map[string]*fakeTask
+	lastOfferID int
+	// events are run by Run one after the other, wake tells it there are new ones
+	events  []func()
+	wake    chan struct{}
+	stop    chan struct{}
+	stopped bool
+}
+
+func newFakeDriver(cluster *fakeClusterSpec, framework mesos.FrameworkInfo, sched scheduler) *fakeDriver {
+	seed := cluster.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	d := &fakeDriver{
+		cluster:   cluster,
+		framework: framework,
+		sched:     sched,
+		rand:      rand.New(rand.NewSource(seed)),
+		offers:    make(map[string]mesos.Offer),
+		tasks:     make(map[string]*fakeTask),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	for i := range cluster.Agents {
+		spec := &cluster.Agents[i]
+		d.agents = append(d.agents, &fakeAgent{spec: spec, available: spec.resources()})
+	}
+	return d
+}
+
+func (d *fakeDriver) Run() error {
+	d.Lock()
+	if d.framework.ID == nil {
+		d.framework.ID = &mesos.FrameworkID{Value: fakeFrameworkID}
+	}
+	frameworkID := *d.framework.ID
+	d.Unlock()
+	log.WithFields(log.Fields{"agents": len(d.agents), "frameworkID": frameworkID.Value}).Info("fake master started")
+	d.post(func() { d.sched.Registered(d, frameworkID, nil) })
+	for _, agent := range d.agents {
+		if after := agent.spec.LostAfter.Duration; after > 0 {
+			agent := agent
+			d.after(after, func() { d.loseAgent(agent) })
+		}
+	}
+
+	ticker := time.NewTicker(d.cluster.OfferInterval.Duration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return nil
+		case <-ticker.C:
+			d.sendOffers()
+		case <-d.wake:
+		}
+		for _, event := range d.takeEvents() {
+			event()
+		}
+	}
+}
+
+func (d *fakeDriver) Stop(failover bool) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopped {
+		return nil
+	}
+	d.stopped = true
+	close(d.stop)
+	if !failover {
+		log.Info("fake master tears down the framework")
+		for _, t := range d.tasks {
+			if !isTerminal(t.state) {
+				d.finish(t, mesos.TASK_KILLED, mesos.SOURCE_MASTER, nil, "framework torn down")
+			}
+		}
+	}
+	return nil
+}
+
+// post queues an event for Run, it never blocks so it can be called from within a callback
+func (d *fakeDriver) post(event func()) {
+	d.Lock()
+	defer d.Unlock()
+	d.queue(event)
+}
+
+// queue is post for callers which hold the lock
+func (d *fakeDriver) queue(event func()) {
+	d.events = append(d.events, event)
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// after posts an event once the delay passed
+func (d *fakeDriver) after(delay time.Duration, event func()) {
+	time.AfterFunc(delay, func() { d.post(event) })
+}
+
+func (d *fakeDriver) takeEvents() []func() {
+	d.Lock()
+	defer d.Unlock()
+	if d.stopped {
+		return nil
+	}
+	events := d.events
+	d.events = nil
+	return events
+}
+
+// sendOffers offers what is available on every agent which has no outstanding offer
+func (d *fakeDriver) sendOffers() {
+	d.Lock()
+	if d.stopped {
+		d.Unlock()
+		return
+	}
+	now := time.Now()
+	offers := []mesos.Offer{}
+	for _, agent := range d.agents {
+		if agent.lost || agent.offerID != "" || now.Before(agent.refusedUntil) {
+			continue
+		}
+		resources := mesos.Resources{}
+		for _, r := range agent.available {
+			// resources of other roles are never offered to us
+			if r.IsUnreserved() || r.GetRole() == d.framework.GetRole() {
+				resources.Add(r)
+			}
+		}
+		if len(resources) == 0 {
+			continue
+		}
+		d.lastOfferID++
+		offer := mesos.Offer{
+			ID:          mesos.OfferID{Value: fmt.Sprintf("fake-offer-%d", d.lastOfferID)},
+			FrameworkID: *d.framework.ID,
+			AgentID:     mesos.AgentID{Value: agent.spec.ID},
+			Hostname:    agent.spec.Hostname,
+			Resources:   resources,
+			Attributes:  agent.spec.attributes(),
+		}
+		d.offers[offer.ID.Value] = offer
+		agent.offerID = offer.ID.Value
+		offers = append(offers, offer)
+	}
+	d.Unlock()
+	if len(offers) > 0 {
+		d.sched.ResourceOffers(d, offers)
+	}
+}
+
+func (d *fakeDriver) agent(agentID string) *fakeAgent {
+	for _, agent := range d.agents {
+		if agent.spec.ID == agentID {
+			return agent
+		}
+	}
+	return nil
+}
+
+// takeOffers removes the offers, which must all be of one agent, and returns their resources.
+// The caller must hold the lock.
+func (d *fakeDriver) takeOffers(offerIDs []mesos.OfferID) (*fakeAgent, mesos.Resources, error) {
+	if len(offerIDs) == 0 {
+		return nil, nil, fmt.Errorf("no offers")
+	}
+	var agent *fakeAgent
+	resources := mesos.Resources{}
+	for _, offerID := range offerIDs {
+		offer, ok := d.offers[offerID.Value]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown offer %s", offerID.Value)
+		}
+		if agent != nil && agent.spec.ID != offer.AgentID.Value {
+			return nil, nil, fmt.Errorf("offers of more than one agent")
+		}
+		agent = d.agent(offer.AgentID.Value)
+		resources.Add(offer.Resources...)
+	}
+	for _, offerID := range offerIDs {
+		delete(d.offers, offerID.Value)
+	}
+	agent.offerID = ""
+	return agent, resources, nil
+}
+
+func (d *fakeDriver) refuse(agent *fakeAgent, filters *mesos.Filters) {
+	seconds := filters.GetRefuseSeconds()
+	agent.refusedUntil = time.Now().Add(time.Duration(seconds * float64(time.Second)))
+}
+
+func (d *fakeDriver) AcceptOffers(offerIDs []mesos.OfferID, operations []mesos.Offer_Operation, filters *mesos.Filters) error {
+	d.Lock()
+	defer d.Unlock()
+	agent, resources, err := d.takeOffers(offerIDs)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Warn("fake master got invalid offers")
+		for _, operation := range operations {
+			for _, task := range operation.GetLaunch().GetTaskInfos() {
+				status := fakeStatus(task.TaskID, task.AgentID, mesos.TASK_LOST, mesos.SOURCE_MASTER)
+				status.Reason = mesos.REASON_INVALID_OFFERS.Enum()
+				status.Message = proto.String(err.Error())
+				d.sendStatus(status)
+			}
+		}
+		return nil
+	}
+
+	for _, operation := range operations {
+		if operation.GetType() != mesos.LAUNCH {
+			result, err := operation.Apply(resources)
+			if err != nil {
+				log.WithFields(log.Fields{"operation": operation.GetType().String(), "err": err}).Warn("fake master dropped operation")
+				continue
+			}
+			// the agent keeps the changed resources, e.g. reservations, after the offer is gone
+			agent.available.Subtract(resources...)
+			agent.available.Add(result...)
+			resources = result
+			continue
+		}
+		for _, task := range operation.GetLaunch().GetTaskInfos() {
+			taskResources := mesos.Resources(task.Resources)
+			if !resources.ContainsAll(taskResources) {
+				status := fakeStatus(task.TaskID, task.AgentID, mesos.TASK_ERROR, mesos.SOURCE_MASTER)
+				status.Reason = mesos.REASON_TASK_INVALID.Enum()
+				status.Message = proto.String(fmt.Sprintf("task uses %s which is not in the offer, left is %s", taskResources, resources))
+				d.sendStatus(status)
+				continue
+			}
+			resources.Subtract(taskResources...)
+			agent.available.Subtract(taskResources...)
+			d.launch(task, agent)
+		}
+	}
+	d.refuse(agent, filters)
+	return nil
+}
+
+func (d *fakeDriver) DeclineOffer(offerID mesos.OfferID, filters *mesos.Filters) error {
+	d.Lock()
+	defer d.Unlock()
+	agent, _, err := d.takeOffers([]mesos.OfferID{offerID})
+	if err != nil {
+		return nil
+	}
+	d.refuse(agent, filters)
+	return nil
+}
+
+// launch starts a task, the caller must hold the lock
+func (d *fakeDriver) launch(info mesos.TaskInfo, agent *fakeAgent) {
+	t := &fakeTask{info: info, agent: agent, state: mesos.TASK_STAGING}
+	d.tasks[info.TaskID.Value] = t
+	d.after(d.cluster.StartDelay.Duration, func() {
+		d.Lock()
+		defer d.Unlock()
+		if t.state != mesos.TASK_STAGING {
+			return
+		}
+		if d.rand.Float64() < d.cluster.FailureRate {
+			d.finish(t, mesos.TASK_FAILED, mesos.SOURCE_EXECUTOR, nil, "fake failure")
+			return
+		}
+		t.state = mesos.TASK_RUNNING
+		d.sendStatus(d.taskStatus(t, mesos.SOURCE_EXECUTOR))
+		if t.info.HealthCheck != nil {
+			healthy := d.rand.Float64() >= d.cluster.UnhealthyRate
+			d.after(d.cluster.StartDelay.Duration, func() {
+				d.Lock()
+				defer d.Unlock()
+				if t.state == mesos.TASK_RUNNING {
+					status := d.taskStatus(t, mesos.SOURCE_EXECUTOR)
+					status.Healthy = proto.Bool(healthy)
+					d.sendStatus(status)
+				}
+			})
+		}
+		if runTime := d.cluster.RunTime.Duration; runTime > 0 {
+			d.after(runTime, func() {
+				d.Lock()
+				defer d.Unlock()
+				if t.state == mesos.TASK_RUNNING {
+					d.finish(t, mesos.TASK_FINISHED, mesos.SOURCE_EXECUTOR, nil, "")
+				}
+			})
+		}
+	})
+}
+
+// finish moves a task to a terminal state and gives its resources back, the caller must hold
+// the lock
+func (d *fakeDriver) finish(t *fakeTask, state mesos.TaskState, source mesos.TaskStatus_Source,
+	reason *mesos.TaskStatus_Reason, message string) {
+	t.state = state
+	if !t.agent.lost {
+		t.agent.available.Add(t.info.Resources...)
+	}
+	status := d.taskStatus(t, source)
+	status.Reason = reason
+	if message != "" {
+		status.Message = proto.String(message)
+	}
+	d.sendStatus(status)
+}
+
+// KillTask kills a task after the kill delay, or after the grace period of the policy if that is
+// shorter, as if the task stopped on its own when told to
+func (d *fakeDriver) KillTask(taskID mesos.TaskID, agentID *mesos.AgentID, policy *killPolicy) error {
+	d.Lock()
+	defer d.Unlock()
+	if d.rand.Float64() < d.cluster.DropKillRate {
+		log.WithFields(log.Fields{"taskID": taskID.Value}).Info("fake master dropped kill")
+		return nil
+	}
+	t, ok := d.tasks[taskID.Value]
+	if !ok {
+		status := fakeStatus(taskID, mesos.AgentID{}, mesos.TASK_LOST, mesos.SOURCE_MASTER)
+		status.Message = proto.String("unknown task")
+		d.sendStatus(status)
+		return nil
+	}
+	delay := d.cluster.KillDelay.Duration
+	if gracePeriod, ok := policy.gracePeriod(); ok && gracePeriod < delay {
+		delay = gracePeriod
+	}
+	d.after(delay, func() {
+		d.Lock()
+		defer d.Unlock()
+		if !isTerminal(t.state) {
+			d.finish(t, mesos.TASK_KILLED, mesos.SOURCE_EXECUTOR, nil, "")
+		}
+	})
+	return nil
+}
+
+func (d *fakeDriver) ReconcileTasks(statuses []mesos.TaskStatus) error {
+	d.Lock()
+	defer d.Unlock()
+	if len(statuses) == 0 {
+		for _, t := range d.tasks {
+			if !isTerminal(t.state) {
+				d.sendStatus(d.reconciled(d.taskStatus(t, mesos.SOURCE_MASTER)))
+			}
+		}
+		return nil
+	}
+	for _, s := range statuses {
+		t, ok := d.tasks[s.TaskID.Value]
+		if !ok {
+			agentID := mesos.AgentID{}
+			if s.AgentID != nil {
+				agentID = *s.AgentID
+			}
+			d.sendStatus(d.reconciled(fakeStatus(s.TaskID, agentID, mesos.TASK_LOST, mesos.SOURCE_MASTER)))
+			continue
+		}
+		d.sendStatus(d.reconciled(d.taskStatus(t, mesos.SOURCE_MASTER)))
+	}
+	return nil
+}
+
+// loseAgent removes an agent with everything on it
+func (d *fakeDriver) loseAgent(agent *fakeAgent) {
+	d.Lock()
+	defer d.Unlock()
+	log.WithFields(log.Fields{"agentID": agent.spec.ID}).Warn("fake master lost agent")
+	agent.lost = true
+	if agent.offerID != "" {
+		offerID := mesos.OfferID{Value: agent.offerID}
+		delete(d.offers, agent.offerID)
+		agent.offerID = ""
+		d.queue(func() { d.sched.OfferRescinded(d, offerID) })
+	}
+	for _, t := range d.tasks {
+		if t.agent == agent && !isTerminal(t.state) {
+			d.finish(t, mesos.TASK_LOST, mesos.SOURCE_MASTER, mesos.REASON_AGENT_REMOVED.Enum(), "agent lost")
+		}
+	}
+	agentID := mesos.AgentID{Value: agent.spec.ID}
+	d.queue(func() { d.sched.SlaveLost(d, agentID) })
+}
+
+func (d *fakeDriver) taskStatus(t *fakeTask, source mesos.TaskStatus_Source) mesos.TaskStatus {
+	return fakeStatus(t.info.TaskID, t.info.AgentID, t.state, source)
+}
+
+// reconciled turns a status into an answer to reconciliation, which is not acknowledged
+func (d *fakeDriver) reconciled(status mesos.TaskStatus) mesos.TaskStatus {
+	status.Reason = mesos.REASON_RECONCILIATION.Enum()
+	status.UUID = nil
+	return status
+}
+
+// sendStatus posts a status update, the caller must hold the lock
+func (d *fakeDriver) sendStatus(status mesos.TaskStatus) {
+	d.queue(func() { d.sched.StatusUpdate(d, status) })
+}
+
+func fakeStatus(taskID mesos.TaskID, agentID mesos.AgentID, state mesos.TaskState, source mesos.TaskStatus_Source) mesos.TaskStatus {
+	return mesos.TaskStatus{
+		TaskID:    taskID,
+		State:     state.Enum(),
+		Source:    source.Enum(),
+		AgentID:   &agentID,
+		UUID:      []byte(uuid.NewRandom()),
+		Timestamp: proto.Float64(float64(time.Now().UnixNano()) / float64(time.Second)),
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+// waitFor polls until done returns true, or fails the test after the timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, done func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runFakeCluster runs a scheduler for role web with a reservation for it against a fake master
+// with one agent, until both instances of a docker service are running
+func runFakeCluster(t *testing.T, cluster *fakeClusterSpec) (*demoScheduler, *fakeDriver, schedulerDriver, <-chan error) {
+	cluster.Agents = []fakeAgentSpec{{
+		ID: "a1", Hostname: "h1", Cpus: 4, Mem: 1024, Disk: 100, Ports: [][2]uint64{{31000, 31009}},
+		Role: string(mesos.RoleDefault),
+	}}
+	cluster.OfferInterval = duration{10 * time.Millisecond}
+	cluster.StartDelay = duration{10 * time.Millisecond}
+	cluster.KillDelay = duration{10 * time.Millisecond}
+	cluster.Seed = 1
+	s := &demoScheduler{
+		role:          "web",
+		principal:     "rendler",
+		maxRetries:    3,
+		store:         &memoryFrameworkStore{},
+		shutdown:      make(chan struct{}),
+		stopped:       make(chan struct{}),
+		shutdownMode:  shutdownTeardown,
+		shellCmdQueue: newCommandQueue(),
+		tasks:         newTaskRegistry(),
+		metrics:       newSchedulerMetrics(),
+	}
+	target := &reservationTarget{Name: defaultReservationName, CPUs: 1, Mem: 128}
+	s.reservations = newReservationManager([]*reservationTarget{target}, s.role, s.principal, s.tasks)
+	spec := testJob(t, `{"name": "web", "type": "service", "instances": 2, "cpus": 0.5, "mem": 64,
+		"container": {"type": "docker", "image": "nginx", "network": "bridge"},
+		"ports": [{"name": "http", "containerPort": 80}]}`)
+	if _, err := s.shellCmdQueue.submit(spec); err != nil {
+		t.Fatal(err)
+	}
+	s.start()
+
+	framework := mesos.FrameworkInfo{Name: "RENDLER", Role: proto.String(s.role), Principal: proto.String(s.principal)}
+	var fake *fakeDriver
+	connect := newPlanningDriverFactory(func(master string, framework mesos.FrameworkInfo, sched scheduler) schedulerDriver {
+		fake = newFakeDriver(cluster, framework, sched)
+		return fake
+	}, false)
+	driver := connect("fake", framework, s)
+	done := make(chan error, 1)
+	go func() { done <- driver.Run() }()
+
+	running := func(t *taskRecord) bool { return t.state == mesos.TASK_RUNNING }
+	waitFor(t, 5*time.Second, "both instances to run", func() bool { return len(s.tasks.list(running)) == 2 })
+	return s, fake, driver, done
+}
+
+// stopFakeCluster checks that the scheduler's tasks were killed and its reservations released,
+// and stops the driver
+func stopFakeCluster(t *testing.T, s *demoScheduler, fake *fakeDriver, driver schedulerDriver, done <-chan error) {
+	if n := len(s.tasks.list(func(t *taskRecord) bool { return t.state != mesos.TASK_KILLED })); n != 0 {
+		t.Errorf("%d tasks were not killed", n)
+	}
+	fake.Lock()
+	for _, r := range fake.agents[0].available {
+		if !r.IsUnreserved() {
+			t.Errorf("%s is still reserved", &r)
+		}
+	}
+	fake.Unlock()
+	close(s.stopped)
+	driver.Stop(false)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("driver stopped with %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("driver did not stop")
+	}
+}
+
+// TestFakeClusterScenario runs a service against the fake master: it reserves resources for its
+// role, launches docker tasks with mapped ports on them, and releases the reservations again when
+// it tears down.
+func TestFakeClusterScenario(t *testing.T) {
+	s, fake, driver, done := runFakeCluster(t, &fakeClusterSpec{})
+
+	hostPorts := make(map[uint32]bool)
+	fake.Lock()
+	for _, task := range fake.tasks {
+		// the reservation covers both tasks
+		for _, r := range task.info.Resources {
+			if r.GetName() != "ports" && (r.GetRole() != s.role || !s.reservations.ours(&r)) {
+				t.Errorf("task %s runs on %s, which is not reserved by us", task.info.TaskID.Value, &r)
+			}
+		}
+		mappings := task.info.GetContainer().GetDocker().GetPortMappings()
+		if len(mappings) != 1 || mappings[0].ContainerPort != 80 || mappings[0].GetProtocol() != portProtocolTCP {
+			t.Errorf("task %s has port mappings %v", task.info.TaskID.Value, mappings)
+			continue
+		}
+		port := mappings[0].HostPort
+		if port < 31000 || port > 31009 || hostPorts[port] {
+			t.Errorf("task %s got host port %d, which is not offered or taken twice", task.info.TaskID.Value, port)
+		}
+		hostPorts[port] = true
+		if p := task.info.GetDiscovery().GetPorts().GetPorts(); len(p) != 1 || p[0].Number != port || p[0].GetName() != "http" {
+			t.Errorf("task %s has discovery ports %v", task.info.TaskID.Value, p)
+		}
+	}
+	fake.Unlock()
+	if len(hostPorts) != 2 {
+		t.Errorf("got host ports %v for 2 tasks", hostPorts)
+	}
+
+	if s.shutDown() {
+		t.Errorf("teardown stops the driver with failover")
+	}
+	stopFakeCluster(t, s, fake, driver, done)
+}
+
+// TestShutdownRetriesDroppedKills loses the kills of a teardown, which the killer must send again
+// while the scheduler is shutting down
+func TestShutdownRetriesDroppedKills(t *testing.T) {
+	s, fake, driver, done := runFakeCluster(t, &fakeClusterSpec{DropKillRate: 1})
+	s.killer.Lock()
+	s.killer.timeout = 10 * time.Millisecond
+	s.killer.Unlock()
+
+	failover := make(chan bool, 1)
+	go func() { failover <- s.shutDown() }()
+	waitFor(t, time.Second, "both kills", func() bool {
+		s.killer.Lock()
+		defer s.killer.Unlock()
+		return len(s.killer.pending) == 2
+	})
+	fake.Lock()
+	fake.cluster.DropKillRate = 0
+	fake.Unlock()
+	select {
+	case <-failover:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("teardown did not finish")
+	}
+	stopFakeCluster(t, s, fake, driver, done)
+}
+
+func TestFakeDriverTakeOffers(t *testing.T) {
+	cluster := &fakeClusterSpec{Agents: []fakeAgentSpec{
+		{ID: "a1", Hostname: "h1", Cpus: 1},
+		{ID: "a2", Hostname: "h2", Cpus: 1},
+	}}
+	tests := []struct {
+		name     string
+		offerIDs []string
+		err      string
+	}{
+		{name: "none", err: "no offers"},
+		{name: "unknown", offerIDs: []string{"o3"}, err: "unknown offer o3"},
+		{name: "two agents", offerIDs: []string{"o1", "o2"}, err: "offers of more than one agent"},
+		{name: "one agent", offerIDs: []string{"o1"}},
+	}
+	for _, test := range tests {
+		d := newFakeDriver(cluster, mesos.FrameworkInfo{}, nil)
+		for i, agent := range d.agents {
+			id := fmt.Sprintf("o%d", i+1)
+			d.offers[id] = mesos.Offer{ID: mesos.OfferID{Value: id}, AgentID: mesos.AgentID{Value: agent.spec.ID}}
+			agent.offerID = id
+		}
+		offerIDs := []mesos.OfferID{}
+		for _, id := range test.offerIDs {
+			offerIDs = append(offerIDs, mesos.OfferID{Value: id})
+		}
+		agent, _, err := d.takeOffers(offerIDs)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if agent.spec.ID != "a1" || agent.offerID != "" || len(d.offers) != 1 {
+			t.Errorf("%s: took the offers of %s, %d offers left", test.name, agent.spec.ID, len(d.offers))
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+const (
+	defaultHealthGracePeriod = 60.0
+	defaultHealthInterval    = 10.0
+	defaultHealthTimeout     = 5.0
+	defaultHealthMaxFailures = 3
+	healthMonitorInterval    = time.Duration(5) * time.Second
+)
+
+// newHealthCheck builds the HealthCheck of a task of the job, or nil if the job has none
+func newHealthCheck(j *jobSpec, hostPorts []uint64) *mesos.HealthCheck {
+	h := j.HealthCheck
+	if h == nil {
+		return nil
+	}
+	check := &mesos.HealthCheck{
+		IntervalSeconds:     proto.Float64(h.IntervalSeconds),
+		TimeoutSeconds:      proto.Float64(h.TimeoutSeconds),
+		ConsecutiveFailures: proto.Uint32(uint32(h.MaxConsecutiveFailures)),
+		GracePeriodSeconds:  proto.Float64(h.GracePeriodSeconds),
+	}
+	switch h.Protocol {
+	case healthCheckHTTP:
+		check.Http = &mesos.HealthCheck_HTTP{
+			Port: uint32(healthCheckPort(j, hostPorts)),
+			Path: proto.String(h.Path),
+		}
+	case healthCheckTCP:
+		// the vendored HealthCheck predates TCP checks, until the task is sent they are HTTP checks
+		// without a path, see encodeTaskInfo
+		check.Http = &mesos.HealthCheck_HTTP{Port: uint32(healthCheckPort(j, hostPorts))}
+	case healthCheckCommand:
+		check.Command = &mesos.CommandInfo{Value: proto.String(h.Command)}
+	}
+	return check
+}
+
+// tcpHealthCheckPort returns the port of a TCP health check built by newHealthCheck, and false for
+// other checks
+func tcpHealthCheckPort(check *mesos.HealthCheck) (uint32, bool) {
+	if check.Http == nil || check.Http.Path != nil {
+		return 0, false
+	}
+	return check.Http.Port, true
+}
+
+// healthCheckPort is the port the health check of the job connects to from within the task
+func healthCheckPort(j *jobSpec, hostPorts []uint64) uint64 {
+	i := j.HealthCheck.PortIndex
+	c := j.Container
+	if c != nil && c.Type == containerTypeDocker && c.Network == dockerNetworkBridge && j.Ports[i].ContainerPort > 0 {
+		return uint64(j.Ports[i].ContainerPort)
+	}
+	return hostPorts[i]
+}
+
+// unhealthyTimeout is how long a task may stay unhealthy before the scheduler kills it. Mesos
+// kills it by itself after the consecutive failures, this is for when it doesn't.
+func unhealthyTimeout(check *mesos.HealthCheck) time.Duration {
+	if check == nil {
+		return 0
+	}
+	seconds := check.GetIntervalSeconds()*float64(check.GetConsecutiveFailures()) + check.GetTimeoutSeconds()
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// runHealthMonitor kills tasks which stayed unhealthy for longer than their unhealthyTimeout,
+// until stop is closed. They are replaced once they are gone, like all tasks that end while
+// unhealthy.
+func runHealthMonitor(tasks *taskRegistry, kill func(taskID string) bool, stop <-chan struct{}) {
+	ticker := time.NewTicker(healthMonitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		for _, task := range tasks.unhealthy(time.Now()) {
+			log.WithFields(log.Fields{
+				"taskID":         task.taskID,
+				"unhealthySince": task.unhealthySince,
+			}).Warn("killing unhealthy task")
+			kill(task.taskID)
+		}
+	}
+}
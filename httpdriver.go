@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mesos/mesos-go"
+	"github.com/mesos/mesos-go/encoding"
+)
+
+const (
+	schedulerAPIPath = "/api/v1/scheduler"
+	streamIDHeader   = "Mesos-Stream-Id"
+	callTimeout      = time.Duration(10) * time.Second
+	// defaultHeartbeatInterval is used until the master told us its interval
+	defaultHeartbeatInterval = time.Duration(15) * time.Second
+	// missedHeartbeats is how many heartbeats may go missing before the connection counts as broken
+	missedHeartbeats           = 3
+	resubscribeInitialBackoff  = time.Duration(1) * time.Second
+	resubscribeMaxBackoff      = time.Duration(30) * time.Second
+	maxErrorResponseBodyLength = 4096
+)
+
+// httpClient is a mesos.Client which posts calls as JSON to the scheduler endpoint of a master.
+// It remembers the stream ID of the last subscription and sends it along with every other call.
+type httpClient struct {
+	sync.Mutex
+	master   string
+	streamID string
+	// stream has no timeout, the subscription stays open for as long as we are connected
+	stream *http.Client
+	calls  *http.Client
+}
+
+func newHTTPClient(master string) *httpClient {
+	return &httpClient{
+		master: master,
+		stream: &http.Client{},
+		calls:  &http.Client{Timeout: callTimeout},
+	}
+}
+
+// Do implements mesos.Client
+func (c *httpClient) Do(m encoding.Marshaler) (mesos.Response, error) {
+	body := &bytes.Buffer{}
+	if err := encoding.JSONCodec.NewEncoder(body).Invoke(m); err != nil {
+		return nil, err
+	}
+	subscribe := false
+	if call, ok := m.(*schedulerCall); ok {
+		subscribe = call.Type == callSubscribe
+	}
+
+	c.Lock()
+	url := "http://" + c.master + schedulerAPIPath
+	streamID := c.streamID
+	c.Unlock()
+
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", encoding.JSONMediaType)
+	req.Header.Set("Accept", encoding.JSONMediaType)
+	client := c.calls
+	if subscribe {
+		client = c.stream
+	} else if streamID != "" {
+		req.Header.Set(streamIDHeader, streamID)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		defer resp.Body.Close()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorResponseBodyLength))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if subscribe {
+		c.Lock()
+		c.streamID = resp.Header.Get(streamIDHeader)
+		// a master which is not the leader redirects us, keep talking to the one we ended up at
+		c.master = resp.Request.URL.Host
+		c.Unlock()
+	}
+	return &httpResponse{resp: resp}, nil
+}
+
+type httpResponse struct {
+	resp *http.Response
+}
+
+func (r *httpResponse) Close() error {
+	return r.resp.Body.Close()
+}
+
+// Decoder reads the events of a subscription, which come as RecordIO frames of JSON
+func (r *httpResponse) Decoder() encoding.Decoder {
+	return encoding.JSONCodec.NewDecoder(newRecordIOReader(r.resp.Body))
+}
+
+// recordIOReader is a framing.Reader for RecordIO, where every record is its length in bytes
+// in decimal, a newline, and then the record itself
+type recordIOReader struct {
+	r *bufio.Reader
+	// remaining is what is left to read of the current record
+	remaining int
+}
+
+func newRecordIOReader(r io.Reader) *recordIOReader {
+	return &recordIOReader{r: bufio.NewReader(r)}
+}
+
+func (r *recordIOReader) ReadFrame(buf []byte) (bool, int, error) {
+	if r.remaining == 0 {
+		header, err := r.r.ReadString('\n')
+		if err != nil {
+			return false, 0, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(header))
+		if err != nil || size < 0 {
+			return false, 0, fmt.Errorf("invalid RecordIO header %q", header)
+		}
+		if size == 0 {
+			return true, 0, nil
+		}
+		r.remaining = size
+	}
+	if len(buf) > r.remaining {
+		buf = buf[:r.remaining]
+	}
+	n, err := io.ReadFull(r.r, buf)
+	r.remaining -= n
+	return r.remaining == 0, n, err
+}
+
+// httpDriver is a schedulerDriver for the v1 scheduler HTTP API. It resubscribes with backoff
+// when the event stream breaks, and treats a stream without heartbeats as broken.
+type httpDriver struct {
+	sync.Mutex
+	client    *httpClient
+	framework mesos.FrameworkInfo
+	sched     scheduler
+	resp      mesos.Response
+	stop      chan struct{}
+	stopped   bool
+	// aborted is set when the master sent an error, after which we must not resubscribe
+	aborted error
+}
+
+func newHTTPDriver(master string, framework mesos.FrameworkInfo, sched scheduler) *httpDriver {
+	return &httpDriver{
+		client:    newHTTPClient(master),
+		framework: framework,
+		sched:     sched,
+		stop:      make(chan struct{}),
+	}
+}
+
+func (d *httpDriver) Run() error {
+	backoff := resubscribeInitialBackoff
+	for {
+		subscribed, err := d.subscribe()
+		d.Lock()
+		stopped, aborted := d.stopped, d.aborted
+		d.Unlock()
+		if stopped {
+			return nil
+		}
+		if aborted != nil {
+			return aborted
+		}
+		if subscribed {
+			d.sched.Disconnected(d)
+			backoff = resubscribeInitialBackoff
+		}
+		log.WithFields(log.Fields{"err": err, "backoff": backoff.String()}).Warn("subscription ended, resubscribing")
+
+		select {
+		case <-d.stop:
+			return nil
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > resubscribeMaxBackoff {
+			backoff = resubscribeMaxBackoff
+		}
+	}
+}
+
+// subscribe opens the event stream and handles its events until the stream breaks. It reports
+// whether the master accepted the subscription.
+func (d *httpDriver) subscribe() (bool, error) {
+	d.Lock()
+	framework := d.framework
+	d.Unlock()
+	resp, err := d.client.Do(&schedulerCall{
+		FrameworkID: framework.ID,
+		Type:        callSubscribe,
+		Subscribe:   &subscribeCall{FrameworkInfo: framework},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Close()
+
+	d.Lock()
+	if d.stopped {
+		d.Unlock()
+		return false, nil
+	}
+	d.resp = resp
+	d.Unlock()
+
+	// closing the response makes the decoder return, which is how a silent master is dropped
+	heartbeat := defaultHeartbeatInterval
+	watchdog := time.AfterFunc(missedHeartbeats*heartbeat, func() { resp.Close() })
+	defer watchdog.Stop()
+
+	subscribed := false
+	decoder := resp.Decoder()
+	for {
+		event := &schedulerEvent{}
+		if err := decoder.Invoke(event); err != nil {
+			return subscribed, err
+		}
+		if event.Type == eventSubscribed && event.Subscribed != nil {
+			subscribed = true
+			if seconds := event.Subscribed.HeartbeatIntervalSeconds; seconds > 0 {
+				heartbeat = time.Duration(seconds * float64(time.Second))
+			}
+			d.Lock()
+			frameworkID := event.Subscribed.FrameworkID
+			d.framework.ID = &frameworkID
+			d.Unlock()
+		}
+		watchdog.Reset(missedHeartbeats * heartbeat)
+		d.handle(event)
+		if event.Type == eventError {
+			return subscribed, nil
+		}
+	}
+}
+
+func (d *httpDriver) handle(e *schedulerEvent) {
+	switch {
+	case e.Type == eventHeartbeat:
+	case e.Type == eventSubscribed && e.Subscribed != nil:
+		d.sched.Registered(d, e.Subscribed.FrameworkID, e.Subscribed.MasterInfo)
+	case e.Type == eventOffers && e.Offers != nil:
+		d.sched.ResourceOffers(d, e.Offers.Offers)
+	case e.Type == eventRescind && e.Rescind != nil:
+		d.sched.OfferRescinded(d, e.Rescind.OfferID)
+	case e.Type == eventUpdate && e.Update != nil:
+		status := e.Update.Status
+		d.sched.StatusUpdate(d, status)
+		// updates which are not sent reliably, e.g. answers to reconciliation, have no UUID
+		if len(status.UUID) > 0 && status.AgentID != nil {
+			if err := d.acknowledge(status); err != nil {
+				log.WithFields(log.Fields{"taskID": status.TaskID.Value, "err": err}).Error("acknowledge status update failed")
+			}
+		}
+	case e.Type == eventMessage && e.Message != nil:
+		d.sched.FrameworkMessage(d, e.Message.ExecutorID, e.Message.AgentID, e.Message.Data)
+	case e.Type == eventFailure && e.Failure != nil && e.Failure.ExecutorID != nil:
+		agentID := mesos.AgentID{}
+		if e.Failure.AgentID != nil {
+			agentID = *e.Failure.AgentID
+		}
+		status := 0
+		if e.Failure.Status != nil {
+			status = int(*e.Failure.Status)
+		}
+		d.sched.ExecutorLost(d, *e.Failure.ExecutorID, agentID, status)
+	case e.Type == eventFailure && e.Failure != nil && e.Failure.AgentID != nil:
+		d.sched.SlaveLost(d, *e.Failure.AgentID)
+	case e.Type == eventError && e.Error != nil:
+		d.Lock()
+		d.aborted = errors.New(e.Error.Message)
+		d.Unlock()
+		d.sched.Error(d, e.Error.Message)
+	default:
+		log.WithFields(log.Fields{"type": e.Type}).Warn("ignoring unknown event")
+	}
+}
+
+func (d *httpDriver) Stop(failover bool) error {
+	d.Lock()
+	if d.stopped {
+		d.Unlock()
+		return nil
+	}
+	d.stopped = true
+	close(d.stop)
+	resp := d.resp
+	d.Unlock()
+
+	var err error
+	if !failover {
+		err = d.call(&schedulerCall{Type: callTeardown})
+	}
+	if resp != nil {
+		resp.Close()
+	}
+	return err
+}
+
+// call sends a call of our framework which the master answers without a body
+func (d *httpDriver) call(c *schedulerCall) error {
+	d.Lock()
+	c.FrameworkID = d.framework.ID
+	d.Unlock()
+	if c.FrameworkID == nil {
+		return errors.New("not subscribed")
+	}
+	resp, err := d.client.Do(c)
+	if err != nil {
+		return err
+	}
+	return resp.Close()
+}
+
+func (d *httpDriver) AcceptOffers(offerIDs []mesos.OfferID, operations []mesos.Offer_Operation, filters *mesos.Filters) error {
+	return d.call(&schedulerCall{
+		Type:   callAccept,
+		Accept: &acceptCall{OfferIDs: offerIDs, Operations: operations, Filters: filters},
+	})
+}
+
+func (d *httpDriver) DeclineOffer(offerID mesos.OfferID, filters *mesos.Filters) error {
+	return d.call(&schedulerCall{
+		Type:    callDecline,
+		Decline: &declineCall{OfferIDs: []mesos.OfferID{offerID}, Filters: filters},
+	})
+}
+
+func (d *httpDriver) KillTask(taskID mesos.TaskID, agentID *mesos.AgentID, policy *killPolicy) error {
+	return d.call(&schedulerCall{
+		Type: callKill,
+		Kill: &killCall{TaskID: taskID, AgentID: agentID, KillPolicy: policy},
+	})
+}
+
+func (d *httpDriver) ReconcileTasks(statuses []mesos.TaskStatus) error {
+	tasks := []reconcileTask{}
+	for _, status := range statuses {
+		tasks = append(tasks, reconcileTask{TaskID: status.TaskID, AgentID: status.AgentID})
+	}
+	return d.call(&schedulerCall{
+		Type:      callReconcile,
+		Reconcile: &reconcileCall{Tasks: tasks},
+	})
+}
+
+func (d *httpDriver) acknowledge(status mesos.TaskStatus) error {
+	return d.call(&schedulerCall{
+		Type: callAcknowledge,
+		Acknowledge: &acknowledgeCall{
+			AgentID: *status.AgentID,
+			TaskID:  status.TaskID,
+			UUID:    status.UUID,
+		},
+	})
+}
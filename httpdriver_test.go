@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRecordIOReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		bufSize int
+		records []string
+		err     string
+	}{
+		{name: "records", stream: "5\nhello3\nabc", bufSize: 64, records: []string{"hello", "abc"}, err: "EOF"},
+		{name: "records in chunks", stream: "5\nhello3\nabc", bufSize: 2, records: []string{"hello", "abc"}, err: "EOF"},
+		{name: "empty record", stream: "0\n5\nhello", bufSize: 64, records: []string{"", "hello"}, err: "EOF"},
+		{name: "crlf header", stream: "3\r\n{}\n", bufSize: 64, records: []string{"{}\n"}, err: "EOF"},
+		{name: "invalid header", stream: "x\nabc", bufSize: 64, err: `invalid RecordIO header "x\n"`},
+		{name: "negative size", stream: "3\nabc-1\n", bufSize: 64, records: []string{"abc"}, err: `invalid RecordIO header "-1\n"`},
+		{name: "truncated record", stream: "5\nhel", bufSize: 64, err: "unexpected EOF"},
+	}
+	for _, test := range tests {
+		r := newRecordIOReader(strings.NewReader(test.stream))
+		records := []string{}
+		record := ""
+		var err error
+		for {
+			buf := make([]byte, test.bufSize)
+			var end bool
+			var n int
+			end, n, err = r.ReadFrame(buf)
+			record += string(buf[:n])
+			if err != nil {
+				break
+			}
+			if end {
+				records = append(records, record)
+				record = ""
+			}
+		}
+		if err == io.EOF && record != "" {
+			t.Errorf("%s: %q left after the last record", test.name, record)
+		}
+		if fmt.Sprintf("%q", records) != fmt.Sprintf("%q", test.records) {
+			t.Errorf("%s: got records %q, want %q", test.name, records, test.records)
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+		}
+	}
+}
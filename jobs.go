@@ -0,0 +1,408 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/mesos/mesos-go"
+)
+
+// jobSpec declares the shape of the tasks of one job. A job spec file holds several of them:
+//
+//	{"jobs": [{"name": "web", "instances": 2, "cpus": 0.5, "mem": 128,
+//	           "cmd": "python -m SimpleHTTPServer 8080",
+//	           "container": {"type": "docker", "image": "python:2", "network": "bridge"},
+//	           "ports": [{"name": "http", "containerPort": 8080}]}]}
+//
+// Files ending in .yaml or .yml hold the same fields in YAML.
+type jobSpec struct {
+	Name string `json:"name"`
+	// Type is batch, whose tasks run once and are retried on failure, or service, whose instances
+	// are kept running and relaunched whenever their task ends
+	Type      string            `json:"type"`
+	Instances int               `json:"instances"`
+	Cpus      float64           `json:"cpus"`
+	Mem       float64           `json:"mem"`
+	Disk      float64           `json:"disk"`
+	Ports     []portSpec        `json:"ports"`
+	Cmd       string            `json:"cmd"`
+	Args      []string          `json:"args"`
+	Env       map[string]string `json:"env"`
+	URIs      []string          `json:"uris"`
+	Labels    map[string]string `json:"labels"`
+	Container *containerSpec    `json:"container"`
+	// Placement is the strategy to pick offers with: firstFit, bestFit, spread or random
+	Placement string `json:"placement"`
+	// PortAllocation picks the host ports of tasks from the offered ranges: sequential takes the
+	// lowest ports left, random any of them
+	PortAllocation string `json:"portAllocation"`
+	// ReservedOnly runs tasks only on cpus, mem and disk reserved for the framework role, otherwise
+	// they use unreserved resources when the reserved ones don't suffice. Ports are taken from
+	// reserved ranges first either way.
+	ReservedOnly bool `json:"reservedOnly"`
+	// Constraints are Marathon style, e.g. [["hostname", "UNIQUE"], ["rack", "GROUP_BY", "3"]]
+	Constraints [][]string `json:"constraints"`
+	// HealthCheck is run by Mesos on every task, tasks which stay unhealthy are killed and replaced
+	HealthCheck *healthCheckSpec `json:"healthCheck"`
+	// UpgradeStrategy bounds how a service is replaced by a new version of its spec
+	UpgradeStrategy *upgradeStrategy `json:"upgradeStrategy"`
+	// KillPolicy is e.g. {"gracePeriodSeconds": 30}, the time tasks get to shut down when killed
+	KillPolicy *killPolicySpec `json:"killPolicy"`
+	// Volume is a persistent volume each instance keeps across its tasks, which then all run on
+	// the agent it was created on
+	Volume *volumeSpec `json:"volume"`
+
+	constraints []*constraint
+	// version counts the specs a service had, it is assigned when the spec is submitted
+	version int
+}
+
+// portSpec asks for one host port from the offer, HostPort if it is set. With docker bridge
+// networking the host port is mapped to containerPort. Tasks get their host ports as PORT0,
+// PORT1, ... and named ones also as PORT_<NAME>.
+type portSpec struct {
+	Name          string `json:"name"`
+	ContainerPort int    `json:"containerPort"`
+	HostPort      int    `json:"hostPort"`
+	// Protocol is tcp or udp
+	Protocol string `json:"protocol"`
+}
+
+type containerSpec struct {
+	// Type is docker, mesosproto or mesosprotoWithImage
+	Type  string `json:"type"`
+	Image string `json:"image"`
+	// Network is the docker network type: host, bridge or none
+	Network string `json:"network"`
+	// NetworkName is the CNI network a mesos container joins. It is not supported yet, NetworkInfo
+	// of the vendored mesos protos has no name.
+	NetworkName string `json:"networkName"`
+}
+
+const (
+	jobTypeBatch   = "batch"
+	jobTypeService = "service"
+)
+
+const (
+	healthCheckHTTP    = "http"
+	healthCheckTCP     = "tcp"
+	healthCheckCommand = "command"
+)
+
+// healthCheckSpec is e.g. {"protocol": "http", "portIndex": 0, "path": "/health"}. Http and tcp
+// checks connect to a port of the job, the container port with docker bridge networking and the
+// host port otherwise. Tcp checks are sent as the TCP checks of the v1 API, which need Mesos 1.2
+// or later.
+type healthCheckSpec struct {
+	// Protocol is http, tcp or command
+	Protocol  string `json:"protocol"`
+	PortIndex int    `json:"portIndex"`
+	Path      string `json:"path"`
+	Command   string `json:"command"`
+	// GracePeriodSeconds is how long failures are ignored after the task started
+	GracePeriodSeconds float64 `json:"gracePeriodSeconds"`
+	IntervalSeconds    float64 `json:"intervalSeconds"`
+	TimeoutSeconds     float64 `json:"timeoutSeconds"`
+	// MaxConsecutiveFailures is how many checks in a row may fail before the task is killed
+	MaxConsecutiveFailures int `json:"maxConsecutiveFailures"`
+}
+
+// volumeSpec is e.g. {"size": 1024, "containerPath": "data"}, size is in MB and the path is
+// relative to the sandbox of the task
+type volumeSpec struct {
+	Size          float64 `json:"size"`
+	ContainerPath string  `json:"containerPath"`
+}
+
+type killPolicySpec struct {
+	GracePeriodSeconds float64 `json:"gracePeriodSeconds"`
+}
+
+// upgradeStrategy is e.g. {"minimumHealthyPercent": 50, "maximumOverCapacityPercent": 25}.
+// During a rolling upgrade at least the minimum healthy share of instances keeps running, old
+// and new ones together, and at most the over capacity share runs in addition to all instances.
+// The upgrade rolls back once tasks of the new version failed maxFailures times.
+type upgradeStrategy struct {
+	MinimumHealthyPercent      *int `json:"minimumHealthyPercent"`
+	MaximumOverCapacityPercent *int `json:"maximumOverCapacityPercent"`
+	MaxFailures                int  `json:"maxFailures"`
+}
+
+// bounds returns how many instances must stay healthy, and how many may run at most, when
+// upgrading to the given number of instances. Both shares are rounded up.
+func (u *upgradeStrategy) bounds(instances int) (int, int) {
+	minHealthy := (instances**u.MinimumHealthyPercent + 99) / 100
+	overCapacity := (instances**u.MaximumOverCapacityPercent + 99) / 100
+	return minHealthy, instances + overCapacity
+}
+
+type jobSpecFile struct {
+	Jobs []*jobSpec `json:"jobs"`
+}
+
+// validationErrors collects every problem in a job spec file, so they can be fixed in one go
+type validationErrors []string
+
+func (v validationErrors) Error() string {
+	return strings.Join(v, "; ")
+}
+
+// defaultJobName names a job after the kind of tasks it runs
+func defaultJobName(c *containerSpec) string {
+	if c == nil {
+		return "ShellCommandTask"
+	}
+	switch c.Type {
+	case containerTypeDocker:
+		return "DockerContainerTask"
+	case containerTypeMesos:
+		return "MesosContainerTask"
+	}
+	return "MesosContainerWithDockerImageTask"
+}
+
+// setDefaults fills in what a job spec does not say
+func (j *jobSpec) setDefaults() {
+	if j.Name == "" {
+		j.Name = defaultJobName(j.Container)
+	}
+	if j.Type == "" {
+		j.Type = jobTypeBatch
+	}
+	if j.Instances == 0 {
+		j.Instances = 1
+	}
+	if j.Cpus == 0 {
+		j.Cpus = taskCPUs
+	}
+	if j.Mem == 0 {
+		j.Mem = taskMem
+	}
+	if j.Placement == "" {
+		j.Placement = placementFirstFit
+	}
+	if j.PortAllocation == "" {
+		j.PortAllocation = portAllocationSequential
+	}
+	for i := range j.Ports {
+		if j.Ports[i].Protocol == "" {
+			j.Ports[i].Protocol = portProtocolTCP
+		}
+	}
+	if j.Container != nil && j.Container.Type == containerTypeDocker && j.Container.Network == "" {
+		j.Container.Network = dockerNetworkHost
+	}
+	if j.Type == jobTypeService {
+		if j.UpgradeStrategy == nil {
+			j.UpgradeStrategy = &upgradeStrategy{}
+		}
+		u := j.UpgradeStrategy
+		if u.MinimumHealthyPercent == nil {
+			minHealthy := defaultMinimumHealthyPercent
+			u.MinimumHealthyPercent = &minHealthy
+		}
+		if u.MaximumOverCapacityPercent == nil {
+			overCapacity := defaultMaximumOverCapacityPercent
+			u.MaximumOverCapacityPercent = &overCapacity
+		}
+		if u.MaxFailures == 0 {
+			u.MaxFailures = defaultUpgradeMaxFailures
+		}
+	}
+	if h := j.HealthCheck; h != nil {
+		if h.Protocol == healthCheckHTTP && h.Path == "" {
+			h.Path = "/"
+		}
+		if h.GracePeriodSeconds == 0 {
+			h.GracePeriodSeconds = defaultHealthGracePeriod
+		}
+		if h.IntervalSeconds == 0 {
+			h.IntervalSeconds = defaultHealthInterval
+		}
+		if h.TimeoutSeconds == 0 {
+			h.TimeoutSeconds = defaultHealthTimeout
+		}
+		if h.MaxConsecutiveFailures == 0 {
+			h.MaxConsecutiveFailures = defaultHealthMaxFailures
+		}
+	}
+}
+
+// validate returns every problem of the job spec, prefixed with the job name. It also compiles
+// the constraints.
+func (j *jobSpec) validate() validationErrors {
+	errs := validationErrors{}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("job %q: ", j.Name)+fmt.Sprintf(format, args...))
+	}
+
+	if strings.ContainsAny(j.Name, " /.") {
+		fail("name must not contain spaces, slashes or dots")
+	}
+	if j.Type != jobTypeBatch && j.Type != jobTypeService {
+		fail("unknown job type %q", j.Type)
+	}
+	if j.Instances < 1 {
+		fail("instances must be at least 1, got %d", j.Instances)
+	}
+	if j.Cpus <= 0 {
+		fail("cpus must be positive, got %g", j.Cpus)
+	}
+	if j.Mem <= 0 {
+		fail("mem must be positive, got %g", j.Mem)
+	}
+	if j.Disk < 0 {
+		fail("disk must not be negative, got %g", j.Disk)
+	}
+	if j.Cmd != "" && len(j.Args) > 0 {
+		fail("only one of cmd and args can be set")
+	}
+	if j.Cmd == "" && len(j.Args) == 0 && (j.Container == nil || j.Container.Type != containerTypeDocker) {
+		fail("cmd or args is required")
+	}
+	if _, ok := placementStrategies[j.Placement]; !ok {
+		fail("unknown placement strategy %q", j.Placement)
+	}
+	j.constraints = nil
+	for _, raw := range j.Constraints {
+		c, err := parseConstraint(raw)
+		if err != nil {
+			fail("%s", err)
+			continue
+		}
+		j.constraints = append(j.constraints, c)
+	}
+	if j.PortAllocation != portAllocationSequential && j.PortAllocation != portAllocationRandom {
+		fail("unknown port allocation %q", j.PortAllocation)
+	}
+	validatePorts(j.Ports, fail)
+
+	if u := j.UpgradeStrategy; u != nil {
+		if j.Type != jobTypeService {
+			fail("upgradeStrategy is only supported for services")
+		} else if *u.MinimumHealthyPercent < 0 || *u.MinimumHealthyPercent > 100 || *u.MaximumOverCapacityPercent < 0 {
+			fail("upgradeStrategy: minimumHealthyPercent must be within 0 and 100, maximumOverCapacityPercent not negative")
+		} else if minHealthy, maxTotal := u.bounds(j.Instances); maxTotal <= minHealthy {
+			fail("upgradeStrategy: allows no instance to be replaced, lower minimumHealthyPercent or raise maximumOverCapacityPercent")
+		}
+		if u.MaxFailures < 1 {
+			fail("upgradeStrategy: maxFailures must be at least 1, got %d", u.MaxFailures)
+		}
+	}
+	if j.KillPolicy != nil && j.KillPolicy.GracePeriodSeconds < 0 {
+		fail("killPolicy: gracePeriodSeconds must not be negative, got %g", j.KillPolicy.GracePeriodSeconds)
+	}
+	if v := j.Volume; v != nil {
+		if v.Size <= 0 {
+			fail("volume: size must be positive, got %g", v.Size)
+		}
+		if v.ContainerPath == "" || strings.HasPrefix(v.ContainerPath, "/") {
+			fail("volume: containerPath must be a path relative to the sandbox, got %q", v.ContainerPath)
+		}
+	}
+	if h := j.HealthCheck; h != nil {
+		switch h.Protocol {
+		case healthCheckHTTP, healthCheckTCP:
+			if h.PortIndex < 0 || h.PortIndex >= len(j.Ports) {
+				fail("healthCheck: portIndex %d does not refer to a port of the job", h.PortIndex)
+			}
+		case healthCheckCommand:
+			if h.Command == "" {
+				fail("healthCheck: command is required")
+			}
+		default:
+			fail("healthCheck: unsupported protocol %q", h.Protocol)
+		}
+		if h.GracePeriodSeconds < 0 || h.IntervalSeconds <= 0 || h.TimeoutSeconds <= 0 {
+			fail("healthCheck: intervalSeconds and timeoutSeconds must be positive, gracePeriodSeconds not negative")
+		}
+		if h.MaxConsecutiveFailures < 1 {
+			fail("healthCheck: maxConsecutiveFailures must be at least 1, got %d", h.MaxConsecutiveFailures)
+		}
+	}
+
+	if c := j.Container; c != nil {
+		switch c.Type {
+		case containerTypeDocker:
+			if _, err := dockerNetwork(c.Network); err != nil {
+				fail("%s", err)
+			}
+			if c.Image == "" {
+				fail("container image is required")
+			}
+		case containerTypeMesosWithImage:
+			if c.Image == "" {
+				fail("container image is required")
+			}
+		case containerTypeMesos:
+		default:
+			fail("unsupported container type %q", c.Type)
+		}
+		if c.NetworkName != "" {
+			fail("joining CNI network %q is not supported", c.NetworkName)
+		}
+	}
+	return errs
+}
+
+// checkRole returns the problems of running the job spec under the framework role
+func (j *jobSpec) checkRole(role string) validationErrors {
+	errs := validationErrors{}
+	if j.Volume != nil && role == string(mesos.RoleDefault) {
+		errs = append(errs, fmt.Sprintf("job %q: volumes need a framework role to reserve their disk for, not %q", j.Name, role))
+	}
+	if j.ReservedOnly && role == string(mesos.RoleDefault) {
+		errs = append(errs, fmt.Sprintf("job %q: reservedOnly needs a framework role resources are reserved for, not %q", j.Name, role))
+	}
+	return errs
+}
+
+// parseJobSpecs decodes and validates a job spec file
+func parseJobSpecs(data []byte) ([]*jobSpec, error) {
+	file := jobSpecFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if len(file.Jobs) == 0 {
+		return nil, fmt.Errorf("no jobs defined")
+	}
+
+	errs := validationErrors{}
+	names := make(map[string]bool)
+	for i, j := range file.Jobs {
+		if j == nil {
+			errs = append(errs, fmt.Sprintf("jobs[%d]: empty job", i))
+			continue
+		}
+		j.setDefaults()
+		errs = append(errs, j.validate()...)
+		if names[j.Name] {
+			errs = append(errs, fmt.Sprintf("job %q: defined more than once", j.Name))
+		}
+		names[j.Name] = true
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return file.Jobs, nil
+}
+
+// loadJobSpecs reads a JSON job spec file, or a YAML one by its extension
+func loadJobSpecs(path string) ([]*jobSpec, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return parseJobSpecs(data)
+}
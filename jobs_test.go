@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testJob parses one job spec as it would be in a job spec file, with its defaults
+func testJob(t *testing.T, spec string) *jobSpec {
+	jobs, err := parseJobSpecs([]byte(`{"jobs": [` + spec + `]}`))
+	if err != nil {
+		t.Fatalf("invalid job %s: %s", spec, err)
+	}
+	return jobs[0]
+}
+
+func TestLoadJobSpecs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"jobs.json": `{"jobs": [{"name": "web", "type": "service", "instances": 2, "cpus": 0.5, "mem": 128,
+			"cmd": "python -m SimpleHTTPServer 8080", "env": {"MODE": "prod"},
+			"container": {"type": "docker", "image": "python:2", "network": "bridge"},
+			"ports": [{"name": "http", "containerPort": 8080}],
+			"constraints": [["hostname", "UNIQUE"], ["rack", "GROUP_BY", "3"]],
+			"healthCheck": {"protocol": "http", "path": "/health", "intervalSeconds": 5}}]}`,
+		"jobs.yaml": `
+jobs:
+- name: web
+  type: service
+  instances: 2
+  cpus: 0.5
+  mem: 128
+  cmd: python -m SimpleHTTPServer 8080
+  env:
+    MODE: prod
+  container: {type: docker, image: "python:2", network: bridge}
+  ports:
+  - name: http
+    containerPort: 8080
+  constraints:
+  - [hostname, UNIQUE]
+  - [rack, GROUP_BY, "3"]
+  healthCheck:
+    protocol: http
+    path: /health
+    intervalSeconds: 5
+`,
+		"invalid.yml": "jobs:\n- name: web\n  cpus: [",
+		"unknown.YML": "jobs:\n- name: web\n  cpus: 0.5\n  mem: 64\n  cmd: x\n  placement: closest\n",
+	}
+	for file, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := loadJobSpecs(filepath.Join(dir, "jobs.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadJobSpecs(filepath.Join(dir, "jobs.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("YAML jobs differ from JSON ones:\n%s\n%s", jobsJSON(got), jobsJSON(want))
+	}
+	if _, err := loadJobSpecs(filepath.Join(dir, "invalid.yml")); err == nil {
+		t.Errorf("invalid YAML: got no error")
+	}
+	if _, err := loadJobSpecs(filepath.Join(dir, "unknown.YML")); err == nil || !strings.Contains(err.Error(), "closest") {
+		t.Errorf("invalid job in YAML: got error %v", err)
+	}
+}
+
+// jobsJSON prints job specs with the fields they point to
+func jobsJSON(jobs []*jobSpec) string {
+	data, _ := json.Marshal(jobs)
+	return string(data)
+}
+
+func TestUpgradeStrategyBounds(t *testing.T) {
+	tests := []struct {
+		instances, minHealthyPercent, overCapacityPercent int
+		minHealthy, maxRunning                            int
+	}{
+		{instances: 4, minHealthyPercent: 50, overCapacityPercent: 50, minHealthy: 2, maxRunning: 6},
+		{instances: 4, minHealthyPercent: 100, overCapacityPercent: 0, minHealthy: 4, maxRunning: 4},
+		{instances: 3, minHealthyPercent: 50, overCapacityPercent: 0, minHealthy: 2, maxRunning: 3},
+		{instances: 3, minHealthyPercent: 100, overCapacityPercent: 10, minHealthy: 3, maxRunning: 4},
+		{instances: 1, minHealthyPercent: 0, overCapacityPercent: 100, minHealthy: 0, maxRunning: 2},
+		{instances: 0, minHealthyPercent: 100, overCapacityPercent: 100, minHealthy: 0, maxRunning: 0},
+	}
+	for _, test := range tests {
+		u := &upgradeStrategy{
+			MinimumHealthyPercent:      &test.minHealthyPercent,
+			MaximumOverCapacityPercent: &test.overCapacityPercent,
+		}
+		minHealthy, maxRunning := u.bounds(test.instances)
+		if minHealthy != test.minHealthy || maxRunning != test.maxRunning {
+			t.Errorf("%d instances, %d%% healthy, %d%% over capacity: got %d, %d, want %d, %d",
+				test.instances, test.minHealthyPercent, test.overCapacityPercent,
+				minHealthy, maxRunning, test.minHealthy, test.maxRunning)
+		}
+	}
+}
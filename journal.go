@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mesos/mesos-go"
+)
+
+const (
+	journalRegistered   = "REGISTERED"
+	journalDisconnected = "DISCONNECTED"
+	journalOffer        = "OFFER"
+	journalRescind      = "RESCIND"
+	journalUpdate       = "UPDATE"
+	journalMessage      = "MESSAGE"
+	journalAgentLost    = "AGENT_LOST"
+	journalExecutorLost = "EXECUTOR_LOST"
+	journalError        = "ERROR"
+
+	defaultJournalMaxSize  = 64 << 20
+	defaultJournalMaxFiles = 5
+)
+
+// journalEntry is a line of the journal. Only the fields of the callback are set, offers get a
+// line each so that they can be found by agent.
+type journalEntry struct {
+	Time        time.Time `json:"time"`
+	Type        string    `json:"type"`
+	FrameworkID string    `json:"frameworkID,omitempty"`
+	OfferID     string    `json:"offerID,omitempty"`
+	AgentID     string    `json:"agentID,omitempty"`
+	Hostname    string    `json:"hostname,omitempty"`
+	ExecutorID  string    `json:"executorID,omitempty"`
+	TaskID      string    `json:"taskID,omitempty"`
+	State       string    `json:"state,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	Healthy     *bool     `json:"healthy,omitempty"`
+	Status      *int      `json:"status,omitempty"`
+	Message     string    `json:"message,omitempty"`
+}
+
+// journal appends entries to a file of JSON lines. Once the file grows beyond maxSize, it is
+// moved to path.1, the one before to path.2 and so on, keeping at most maxFiles old files.
+type journal struct {
+	sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	// closed is set once the journal is closed, file is also nil while it can't be opened
+	closed bool
+}
+
+func newJournal(path string, maxSize int64, maxFiles int) (*journal, error) {
+	j := &journal{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *journal) open() error {
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	j.file = file
+	j.size = info.Size()
+	return nil
+}
+
+// rotate moves the full journal out of the way and starts a new one, the lock must be held. If
+// it fails after closing the journal, the file is nil and the next write opens it again.
+func (j *journal) rotate() error {
+	err := j.file.Close()
+	j.file = nil
+	if err != nil {
+		return err
+	}
+	os.Remove(fmt.Sprintf("%s.%d", j.path, j.maxFiles))
+	for i := j.maxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", j.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", j.path, i+1)); err != nil {
+				return err
+			}
+		}
+	}
+	if j.maxFiles > 0 {
+		if err := os.Rename(j.path, j.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(j.path); err != nil {
+		return err
+	}
+	return j.open()
+}
+
+func (j *journal) write(e journalEntry) {
+	e.Time = time.Now()
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("encode journal entry failed")
+		return
+	}
+	line = append(line, '\n')
+
+	j.Lock()
+	defer j.Unlock()
+	if j.closed {
+		return
+	}
+	if j.file == nil {
+		// a rotation failed, the journal goes on in the file at path as it is
+		if err := j.open(); err != nil {
+			log.WithFields(log.Fields{"file": j.path, "err": err}).Error("reopen journal failed")
+			return
+		}
+	}
+	if j.size > 0 && j.size+int64(len(line)) > j.maxSize {
+		if err := j.rotate(); err != nil {
+			log.WithFields(log.Fields{"file": j.path, "err": err}).Error("rotate journal failed")
+			if err := j.open(); err != nil {
+				log.WithFields(log.Fields{"file": j.path, "err": err}).Error("reopen journal failed")
+				return
+			}
+		}
+	}
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		log.WithFields(log.Fields{"file": j.path, "err": err}).Error("write journal failed")
+	}
+}
+
+func (j *journal) close() error {
+	j.Lock()
+	defer j.Unlock()
+	j.closed = true
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+// journalFiles are the files of the journal at path from the oldest to the current one
+func journalFiles(path string) []string {
+	files := []string{}
+	for i := 1; ; i++ {
+		rotated := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(rotated); err != nil {
+			break
+		}
+		files = append([]string{rotated}, files...)
+	}
+	return append(files, path)
+}
+
+// newJournalDriverFactory writes every callback of the drivers which connect creates to j
+func newJournalDriverFactory(connect driverFactory, j *journal) driverFactory {
+	return func(master string, framework mesos.FrameworkInfo, sched scheduler) schedulerDriver {
+		return connect(master, framework, &journalScheduler{sched: sched, journal: j})
+	}
+}
+
+// journalScheduler writes each callback to the journal before passing it on
+type journalScheduler struct {
+	sched   scheduler
+	journal *journal
+}
+
+func (s *journalScheduler) Registered(driver schedulerDriver, frameworkID mesos.FrameworkID, masterInfo *mesos.MasterInfo) {
+	e := journalEntry{Type: journalRegistered, FrameworkID: frameworkID.Value}
+	if masterInfo != nil {
+		e.Hostname = masterInfo.GetHostname()
+	}
+	s.journal.write(e)
+	s.sched.Registered(driver, frameworkID, masterInfo)
+}
+
+func (s *journalScheduler) Disconnected(driver schedulerDriver) {
+	s.journal.write(journalEntry{Type: journalDisconnected})
+	s.sched.Disconnected(driver)
+}
+
+func (s *journalScheduler) ResourceOffers(driver schedulerDriver, offers []mesos.Offer) {
+	for _, offer := range offers {
+		s.journal.write(journalEntry{
+			Type:     journalOffer,
+			OfferID:  offer.ID.Value,
+			AgentID:  offer.AgentID.Value,
+			Hostname: offer.Hostname,
+		})
+	}
+	s.sched.ResourceOffers(driver, offers)
+}
+
+func (s *journalScheduler) OfferRescinded(driver schedulerDriver, offerID mesos.OfferID) {
+	s.journal.write(journalEntry{Type: journalRescind, OfferID: offerID.Value})
+	s.sched.OfferRescinded(driver, offerID)
+}
+
+func (s *journalScheduler) StatusUpdate(driver schedulerDriver, status mesos.TaskStatus) {
+	e := journalEntry{
+		Type:    journalUpdate,
+		TaskID:  status.TaskID.Value,
+		State:   status.GetState().String(),
+		Healthy: status.Healthy,
+		Message: status.GetMessage(),
+	}
+	if status.AgentID != nil {
+		e.AgentID = status.AgentID.Value
+	}
+	if status.ExecutorID != nil {
+		e.ExecutorID = status.ExecutorID.Value
+	}
+	if status.Reason != nil {
+		e.Reason = status.Reason.String()
+	}
+	if status.Source != nil {
+		e.Source = status.Source.String()
+	}
+	s.journal.write(e)
+	s.sched.StatusUpdate(driver, status)
+}
+
+func (s *journalScheduler) FrameworkMessage(driver schedulerDriver, executorID mesos.ExecutorID, agentID mesos.AgentID, data []byte) {
+	s.journal.write(journalEntry{
+		Type:       journalMessage,
+		AgentID:    agentID.Value,
+		ExecutorID: executorID.Value,
+		Message:    string(data),
+	})
+	s.sched.FrameworkMessage(driver, executorID, agentID, data)
+}
+
+func (s *journalScheduler) SlaveLost(driver schedulerDriver, agentID mesos.AgentID) {
+	s.journal.write(journalEntry{Type: journalAgentLost, AgentID: agentID.Value})
+	s.sched.SlaveLost(driver, agentID)
+}
+
+func (s *journalScheduler) ExecutorLost(driver schedulerDriver, executorID mesos.ExecutorID, agentID mesos.AgentID, status int) {
+	s.journal.write(journalEntry{
+		Type:       journalExecutorLost,
+		AgentID:    agentID.Value,
+		ExecutorID: executorID.Value,
+		Status:     &status,
+	})
+	s.sched.ExecutorLost(driver, executorID, agentID, status)
+}
+
+func (s *journalScheduler) Error(driver schedulerDriver, message string) {
+	s.journal.write(journalEntry{Type: journalError, Message: message})
+	s.sched.Error(driver, message)
+}
+
+// journalFilter selects journal entries, empty fields match everything
+type journalFilter struct {
+	taskID  string
+	agentID string
+	types   map[string]bool
+	since   time.Time
+	until   time.Time
+}
+
+func (f *journalFilter) match(e *journalEntry) bool {
+	if f.taskID != "" && e.TaskID != f.taskID {
+		return false
+	}
+	if f.agentID != "" && e.AgentID != f.agentID {
+		return false
+	}
+	if len(f.types) > 0 && !f.types[e.Type] {
+		return false
+	}
+	if !f.since.IsZero() && e.Time.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && e.Time.After(f.until) {
+		return false
+	}
+	return true
+}
+
+// parseJournalTime reads a time as RFC 3339, or as a duration before now, like 30m
+func parseJournalTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// queryJournal writes the entries of the journal files matching f to w, as they are in the files
+func queryJournal(files []string, f *journalFilter, w io.Writer) error {
+	for _, path := range files {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for n := 1; scanner.Scan(); n++ {
+			var e journalEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				file.Close()
+				return fmt.Errorf("%s:%d: %s", path, n, err)
+			}
+			if f.match(&e) {
+				w.Write(scanner.Bytes())
+				w.Write([]byte("\n"))
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// journalCommand runs `rendler journal`, which prints the entries of a journal matching its flags
+// and returns the exit code
+func journalCommand(args []string) int {
+	flags := flag.NewFlagSet("journal", flag.ExitOnError)
+	path := flags.String("file", "rendler.journal", "journal to read, rotated files next to it are read as well")
+	taskID := flags.String("task", "", "only entries of this task ID")
+	agentID := flags.String("agent", "", "only entries of this agent ID")
+	types := flags.String("type", "",
+		"comma separated entry types: REGISTERED|DISCONNECTED|OFFER|RESCIND|UPDATE|MESSAGE|AGENT_LOST|EXECUTOR_LOST|ERROR")
+	since := flags.String("since", "", "only entries from this time on, RFC 3339 or a duration ago, e.g. 2h")
+	until := flags.String("until", "", "only entries up to this time, RFC 3339 or a duration ago")
+	flags.Parse(args)
+
+	f := &journalFilter{taskID: *taskID, agentID: *agentID, types: make(map[string]bool)}
+	for _, t := range strings.Split(*types, ",") {
+		if t = strings.ToUpper(strings.TrimSpace(t)); t != "" {
+			f.types[t] = true
+		}
+	}
+	var err error
+	if f.since, err = parseJournalTime(*since); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -since %s: %s\n", *since, err)
+		return 2
+	}
+	if f.until, err = parseJournalTime(*until); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -until %s: %s\n", *until, err)
+		return 2
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if err := queryJournal(journalFiles(*path), f, w); err != nil {
+		fmt.Fprintf(os.Stderr, "read journal failed: %s\n", err)
+		return 1
+	}
+	return 0
+}
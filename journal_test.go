@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// journalMessages returns the messages of the entries in each file of the journal at path, from
+// the oldest file to the current one
+func journalMessages(t *testing.T, path string) []string {
+	files := []string{}
+	for _, name := range journalFiles(path) {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages := []string{}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			e := journalEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				t.Fatal(err)
+			}
+			messages = append(messages, e.Message)
+		}
+		file.Close()
+		files = append(files, strings.Join(messages, " "))
+	}
+	return files
+}
+
+func TestJournalRotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxSize  int64
+		maxFiles int
+		// blocked makes path.1 a directory which can't be replaced, so that rotations fail
+		blocked bool
+		files   []string
+	}{
+		{name: "not full", maxSize: 1 << 20, maxFiles: 2, files: []string{"m1 m2 m3 m4"}},
+		{name: "rotated every entry", maxSize: 1, maxFiles: 2, files: []string{"m2", "m3", "m4"}},
+		{name: "no old files", maxSize: 1, maxFiles: 0, files: []string{"m4"}},
+		{name: "rotation failed", maxSize: 1, maxFiles: 1, blocked: true, files: []string{"m1 m2 m3 m4"}},
+	}
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "journal")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "journal")
+		if test.blocked {
+			if err := os.MkdirAll(filepath.Join(path+".1", "keep"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		j, err := newJournal(path, test.maxSize, test.maxFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i <= 4; i++ {
+			j.write(journalEntry{Type: journalMessage, Message: fmt.Sprintf("m%d", i)})
+		}
+		if err := j.close(); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if test.blocked {
+			os.RemoveAll(path + ".1")
+		}
+		if files := journalMessages(t, path); fmt.Sprintf("%q", files) != fmt.Sprintf("%q", test.files) {
+			t.Errorf("%s: got files %q, want %q", test.name, files, test.files)
+		}
+	}
+}
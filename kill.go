@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mesos/mesos-go"
+)
+
+const (
+	killCheckInterval = time.Duration(1) * time.Second
+	// killTimeout is how long after the grace period a kill may take to be confirmed
+	killTimeout     = time.Duration(10) * time.Second
+	killMaxAttempts = 5
+)
+
+// pendingKill is a task we asked to be killed which has not ended yet
+type pendingKill struct {
+	taskID   string
+	agentID  *mesos.AgentID
+	policy   *killPolicy
+	attempts int
+	deadline time.Time
+}
+
+// taskKiller kills tasks and makes sure they end. The first kill has the kill policy of the
+// task's job, without one the executor uses its default grace period. Whenever no terminal
+// status confirmed a kill in time, the kill is sent again without a grace period, until it ran
+// out of attempts.
+type taskKiller struct {
+	sync.Mutex
+	pending map[string]*pendingKill
+	// driver returns the driver of the current subscription
+	driver  func() schedulerDriver
+	timeout time.Duration
+}
+
+func newTaskKiller(driver func() schedulerDriver) *taskKiller {
+	return &taskKiller{pending: make(map[string]*pendingKill), driver: driver, timeout: killTimeout}
+}
+
+// kill starts killing a task, unless it is being killed already
+func (k *taskKiller) kill(taskID string, agentID *mesos.AgentID, policy *killPolicy) {
+	k.Lock()
+	if _, ok := k.pending[taskID]; ok {
+		k.Unlock()
+		return
+	}
+	p := &pendingKill{taskID: taskID, agentID: agentID, policy: policy}
+	k.pending[taskID] = p
+	first := k.attempt(p)
+	k.Unlock()
+	k.send(p.taskID, p.agentID, first)
+}
+
+// attempt counts another attempt at killing the task and returns the kill policy to send it
+// with, the lock must be held
+func (k *taskKiller) attempt(p *pendingKill) *killPolicy {
+	p.attempts++
+	policy := newKillPolicy(0)
+	if p.attempts == 1 {
+		policy = p.policy
+	}
+	gracePeriod, _ := policy.gracePeriod()
+	p.deadline = time.Now().Add(gracePeriod + k.timeout)
+	return policy
+}
+
+func (k *taskKiller) send(taskID string, agentID *mesos.AgentID, policy *killPolicy) {
+	fields := log.Fields{"taskID": taskID}
+	if gracePeriod, ok := policy.gracePeriod(); ok {
+		fields["gracePeriod"] = gracePeriod.String()
+	}
+	driver := k.driver()
+	if driver == nil {
+		log.WithFields(fields).Error("kill task failed: not subscribed")
+		return
+	}
+	log.WithFields(fields).Info("killing task")
+	if err := driver.KillTask(mesos.TaskID{Value: taskID}, agentID, policy); err != nil {
+		fields["err"] = err
+		log.WithFields(fields).Error("kill task failed")
+	}
+}
+
+// done forgets about a task which ended
+func (k *taskKiller) done(taskID string) {
+	k.Lock()
+	defer k.Unlock()
+	delete(k.pending, taskID)
+}
+
+// run sends the kills again which were not confirmed in time, until stop is closed
+func (k *taskKiller) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(killCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		k.retry(time.Now())
+	}
+}
+
+// retry sends the kills again whose deadline passed by now, and gives up on those which ran out
+// of attempts
+func (k *taskKiller) retry(now time.Time) {
+	type retry struct {
+		taskID  string
+		agentID *mesos.AgentID
+		policy  *killPolicy
+	}
+	retries := []retry{}
+	k.Lock()
+	for taskID, p := range k.pending {
+		if now.Before(p.deadline) {
+			continue
+		}
+		if p.attempts >= killMaxAttempts {
+			log.WithFields(log.Fields{"taskID": taskID, "attempts": p.attempts}).Error("kill not confirmed, giving up")
+			delete(k.pending, taskID)
+			continue
+		}
+		log.WithFields(log.Fields{"taskID": taskID, "attempts": p.attempts}).Warn("kill not confirmed, escalating")
+		retries = append(retries, retry{taskID, p.agentID, k.attempt(p)})
+	}
+	k.Unlock()
+	for _, r := range retries {
+		k.send(r.taskID, r.agentID, r.policy)
+	}
+}
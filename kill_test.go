@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mesos/mesos-go"
+)
+
+// killDriver records the kills sent, with their grace period if they have one
+type killDriver struct {
+	schedulerDriver
+	kills []string
+}
+
+func (d *killDriver) KillTask(taskID mesos.TaskID, agentID *mesos.AgentID, policy *killPolicy) error {
+	kill := taskID.Value
+	if gracePeriod, ok := policy.gracePeriod(); ok {
+		kill += " " + gracePeriod.String()
+	}
+	d.kills = append(d.kills, kill)
+	return nil
+}
+
+func TestTaskKiller(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *killPolicy
+		// done is the retry after which the task ended, 0 if it never does
+		done    int
+		retries int
+		kills   []string
+	}{
+		{
+			name:    "confirmed",
+			policy:  newKillPolicy(30 * time.Second),
+			done:    1,
+			retries: 3,
+			kills:   []string{"t1 30s"},
+		},
+		{
+			name:    "escalated without a grace period",
+			policy:  newKillPolicy(30 * time.Second),
+			done:    2,
+			retries: 3,
+			kills:   []string{"t1 30s", "t1 0s"},
+		},
+		{
+			name:    "default grace period first",
+			done:    2,
+			retries: 3,
+			kills:   []string{"t1", "t1 0s"},
+		},
+		{
+			name:    "given up",
+			retries: killMaxAttempts + 2,
+			kills:   []string{"t1", "t1 0s", "t1 0s", "t1 0s", "t1 0s"},
+		},
+	}
+	for _, test := range tests {
+		d := &killDriver{}
+		k := newTaskKiller(func() schedulerDriver { return d })
+		k.kill("t1", &mesos.AgentID{Value: "a1"}, test.policy)
+		// a second kill of the same task waits for the first one
+		k.kill("t1", &mesos.AgentID{Value: "a1"}, test.policy)
+		now := time.Now()
+		for i := 1; i <= test.retries; i++ {
+			if i == test.done {
+				k.done("t1")
+			}
+			// each retry comes after the deadline of the last attempt
+			now = now.Add(time.Minute)
+			k.retry(now)
+		}
+		if fmt.Sprint(d.kills) != fmt.Sprint(test.kills) {
+			t.Errorf("%s: got kills %q, want %q", test.name, d.kills, test.kills)
+		}
+		if len(k.pending) != 0 {
+			t.Errorf("%s: still killing %d tasks", test.name, len(k.pending))
+		}
+	}
+}
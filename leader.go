@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+const (
+	electionMemberPrefix = "member-"
+	frameworkIDNode      = "frameworkID"
+)
+
+var errCampaignCanceled = errors.New("leader election canceled")
+
+// leaderElector lets several scheduler replicas run at the same time. Every replica creates an
+// ephemeral sequential znode under path, the one holding the lowest sequence number is the leader.
+type leaderElector struct {
+	sync.Mutex
+	conn     *zk.Conn
+	path     string
+	node     string
+	expired  chan struct{}
+	identity string
+}
+
+func newLeaderElector(servers []string, path string, sessionTimeout time.Duration) (*leaderElector, error) {
+	conn, events, err := zk.Connect(servers, sessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	e := &leaderElector{
+		conn:     conn,
+		path:     strings.TrimRight(path, "/"),
+		expired:  make(chan struct{}),
+		identity: fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+	}
+	go e.watchSession(events)
+	return e, nil
+}
+
+// watchSession closes the expired channel once our session is gone, because our member znode
+// is gone with it and somebody else may already be the leader
+func (e *leaderElector) watchSession(events <-chan zk.Event) {
+	for event := range events {
+		if event.Type != zk.EventSession {
+			continue
+		}
+		log.WithFields(log.Fields{"state": event.State.String()}).Debug("zookeeper session event")
+		if event.State == zk.StateExpired {
+			e.Lock()
+			close(e.expired)
+			e.expired = make(chan struct{})
+			e.Unlock()
+		}
+	}
+}
+
+// ensurePath creates the election znode and its parents
+func (e *leaderElector) ensurePath() error {
+	parts := strings.Split(e.path, "/")
+	p := ""
+	for _, part := range parts[1:] {
+		p += "/" + part
+		_, err := e.conn.Create(p, []byte{}, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// members returns the election znodes ordered by their sequence number
+func (e *leaderElector) members() ([]string, error) {
+	children, _, err := e.conn.Children(e.path)
+	if err != nil {
+		return nil, err
+	}
+	return electionMembers(children), nil
+}
+
+// electionMembers picks the member znodes out of the children of the election znode, e.g. not
+// the frameworkID znode, ordered by their sequence number
+func electionMembers(children []string) []string {
+	members := []string{}
+	for _, child := range children {
+		if strings.Contains(child, electionMemberPrefix) {
+			members = append(members, child)
+		}
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return memberSeq(members[i]) < memberSeq(members[j])
+	})
+	return members
+}
+
+func memberSeq(node string) int {
+	parts := strings.Split(node, "-")
+	seq, err := strconv.Atoi(parts[len(parts)-1])
+	if err != nil {
+		return -1
+	}
+	return seq
+}
+
+func indexOf(items []string, item string) int {
+	for i := range items {
+		if items[i] == item {
+			return i
+		}
+	}
+	return -1
+}
+
+// campaign blocks until this replica is the leader, or cancel is closed. The returned channel is
+// closed when the leadership is lost again, the caller must stop scheduling by then.
+func (e *leaderElector) campaign(cancel <-chan struct{}) (lost <-chan struct{}, err error) {
+	if err := e.ensurePath(); err != nil {
+		return nil, err
+	}
+	e.Lock()
+	expired := e.expired
+	e.Unlock()
+	node, err := e.conn.CreateProtectedEphemeralSequential(
+		e.path+"/"+electionMemberPrefix, []byte(e.identity), zk.WorldACL(zk.PermAll))
+	if err != nil {
+		return nil, err
+	}
+	e.node = node[strings.LastIndex(node, "/")+1:]
+	log.WithFields(log.Fields{"node": node}).Info("joined leader election")
+	// a member znode left behind would stay ahead of every other replica until our session ends
+	defer func() {
+		if err != nil {
+			e.resign()
+		}
+	}()
+
+	for {
+		members, err := e.members()
+		if err != nil {
+			return nil, err
+		}
+		i := indexOf(members, e.node)
+		if i < 0 {
+			return nil, fmt.Errorf("election node %s disappeared", e.node)
+		}
+		if i == 0 {
+			break
+		}
+
+		// wait for the member just before us, not the leader, to avoid a herd effect
+		predecessor := e.path + "/" + members[i-1]
+		log.WithFields(log.Fields{"watching": predecessor}).Info("standing by")
+		exists, _, watch, err := e.conn.ExistsW(predecessor)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		select {
+		case <-watch:
+		case <-expired:
+			return nil, zk.ErrSessionExpired
+		case <-cancel:
+			return nil, errCampaignCanceled
+		}
+	}
+
+	log.WithFields(log.Fields{"node": e.node, "identity": e.identity}).Info("elected as leader")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			exists, _, watch, err := e.conn.ExistsW(e.path + "/" + e.node)
+			if err != nil || !exists {
+				return
+			}
+			select {
+			case event := <-watch:
+				if event.Type == zk.EventNodeDeleted {
+					return
+				}
+			case <-expired:
+				return
+			}
+		}
+	}()
+	return done, nil
+}
+
+// resign leaves the election by deleting our member znode, if it is still there
+func (e *leaderElector) resign() {
+	if e.node == "" {
+		return
+	}
+	err := e.conn.Delete(e.path+"/"+e.node, -1)
+	if err != nil && err != zk.ErrNoNode {
+		log.WithFields(log.Fields{"node": e.node, "err": err}).Warn("unable to leave leader election")
+	}
+	e.node = ""
+}
+
+// close gives up leadership by closing the session
+func (e *leaderElector) close() {
+	e.conn.Close()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestElectionMembers(t *testing.T) {
+	tests := []struct {
+		name     string
+		children []string
+		members  []string
+		leader   string
+	}{
+		{
+			name:     "no members",
+			children: []string{frameworkIDNode},
+			members:  []string{},
+		},
+		{
+			name: "ordered by sequence, not by the guid of the protected name",
+			children: []string{
+				"_c_ffff-member-0000000010",
+				frameworkIDNode,
+				"_c_0000-member-0000000012",
+				"_c_aaaa-member-0000000002",
+			},
+			members: []string{
+				"_c_aaaa-member-0000000002",
+				"_c_ffff-member-0000000010",
+				"_c_0000-member-0000000012",
+			},
+			leader: "_c_aaaa-member-0000000002",
+		},
+		{
+			name:     "sequence numbers beyond the padding",
+			children: []string{"_c_aaaa-member-10000000000", "_c_bbbb-member-9999999999"},
+			members:  []string{"_c_bbbb-member-9999999999", "_c_aaaa-member-10000000000"},
+			leader:   "_c_bbbb-member-9999999999",
+		},
+	}
+	for _, test := range tests {
+		members := electionMembers(test.children)
+		if fmt.Sprint(members) != fmt.Sprint(test.members) {
+			t.Errorf("%s: got members %v, want %v", test.name, members, test.members)
+		}
+		if test.leader != "" && indexOf(members, test.leader) != 0 {
+			t.Errorf("%s: %s is not the leader", test.name, test.leader)
+		}
+	}
+}
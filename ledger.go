@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+// offerLedger is what is left of an offer while tasks are put on it. Each task takes exactly the
+// resources it is launched with, role by role and port by port, so that the tasks launched with
+// one offer never share any of them. Tasks use what is reserved for the framework role before
+// unreserved resources, which other frameworks could use as well.
+type offerLedger struct {
+	role      string
+	total     mesos.Resources
+	remaining mesos.Resources
+}
+
+// resourceClaim is what one task takes from an offer: the resources it is launched with, its
+// host ports in the order of the job's ports, and the unreserved disk a new volume of the task
+// is reserved from
+type resourceClaim struct {
+	resources  mesos.Resources
+	hostPorts  []uint64
+	volumeDisk mesos.Resources
+}
+
+func newOfferLedger(offer *mesos.Offer, role string) *offerLedger {
+	total := mesos.Resources{}
+	for _, r := range offer.Resources {
+		// persistent volumes are only for the tasks they were created for, and revocable
+		// resources may be taken away from a running task
+		if r.IsPersistentVolume() || r.IsRevocable() {
+			continue
+		}
+		total.Add(r)
+	}
+	return &offerLedger{role: role, total: total, remaining: total.Clone()}
+}
+
+// scalar sums a scalar resource which is left over all roles
+func (l *offerLedger) scalar(name string) float64 {
+	return sumScalar(l.remaining, name)
+}
+
+func sumScalar(resources mesos.Resources, name string) float64 {
+	if v := resources.SumScalars(mesos.NamedResources(name)); v != nil {
+		return v.Value
+	}
+	return 0
+}
+
+// sources are the resources a task of the job draws from, in order: those reserved for the
+// framework role, then unreserved ones unless the job runs on reserved resources only
+func (l *offerLedger) sources(j *jobSpec) []mesos.ResourceFilter {
+	sources := []mesos.ResourceFilter{mesos.ReservedResources(l.role)}
+	if !j.ReservedOnly {
+		sources = append(sources, mesos.UnreservedResources)
+	}
+	return sources
+}
+
+// claim picks the resources of one task of the job from what is left, and volumeDisk more of
+// unreserved disk if the volume of the task is created along with it. It takes nothing yet.
+func (l *offerLedger) claim(j *jobSpec, volumeDisk float64) (*resourceClaim, error) {
+	left := l.remaining.Clone()
+	c := &resourceClaim{}
+	if volumeDisk > 0 {
+		// only unreserved disk can be reserved for the volume
+		disk, err := drawScalar(&left, "disk", volumeDisk, []mesos.ResourceFilter{mesos.UnreservedResources})
+		if err != nil {
+			return nil, fmt.Errorf("volume %s", err)
+		}
+		c.volumeDisk = disk
+	}
+	for _, s := range []struct {
+		name   string
+		amount float64
+	}{{"cpus", j.Cpus}, {"mem", j.Mem}, {"disk", j.Disk}} {
+		if s.amount <= 0 {
+			continue
+		}
+		drawn, err := drawScalar(&left, s.name, s.amount, l.sources(j))
+		if err != nil {
+			return nil, l.shortage(j, err)
+		}
+		c.resources.Add(drawn...)
+	}
+	// ports can't be reserved with reservation targets, so any job may use unreserved ones
+	ports, hostPorts, err := drawPorts(&left, j, []mesos.ResourceFilter{mesos.ReservedResources(l.role), mesos.UnreservedResources})
+	if err != nil {
+		return nil, l.shortage(j, err)
+	}
+	c.resources.Add(ports...)
+	c.hostPorts = hostPorts
+	return c, nil
+}
+
+// shortage tells which resources a job which did not fit was short of
+func (l *offerLedger) shortage(j *jobSpec, err error) error {
+	if j.ReservedOnly {
+		return fmt.Errorf("reserved for role %s: %s", l.role, err)
+	}
+	return err
+}
+
+// take subtracts a claim from what is left
+func (l *offerLedger) take(c *resourceClaim) {
+	l.remaining = l.remaining.Minus(c.resources...).Minus(c.volumeDisk...)
+}
+
+// drawScalar takes amount of the scalar resource from left, from the resources which match the
+// first of the sources, then the next one and so on, each in the order they were offered. The
+// parts keep the role and reservation they come from.
+func drawScalar(left *mesos.Resources, name string, amount float64, sources []mesos.ResourceFilter) (mesos.Resources, error) {
+	drawn := mesos.Resources{}
+	need := amount
+	for _, source := range sources {
+		for i := range *left {
+			r := &(*left)[i]
+			if need < scalarEpsilon {
+				break
+			}
+			if r.GetName() != name || r.GetType() != mesos.SCALAR || !source(r) {
+				continue
+			}
+			part := *proto.Clone(r).(*mesos.Resource)
+			part.Scalar = &mesos.Value_Scalar{Value: roundScalar(math.Min(need, r.GetScalar().GetValue()))}
+			drawn.Add(part)
+			need = roundScalar(need - part.Scalar.Value)
+		}
+	}
+	if need >= scalarEpsilon {
+		return nil, fmt.Errorf("needs %g %s, %g left", amount, name, roundScalar(amount-need))
+	}
+	left.Subtract(drawn...)
+	return drawn, nil
+}
+
+// roundScalar rounds to the precision Mesos keeps scalars with
+func roundScalar(v float64) float64 {
+	return math.Floor(v*1000+0.5) / 1000
+}
+
+// drawPorts allocates the ports of the job from the ports resources in left which match the first
+// of the sources, or if they don't have all of them, the first two sources and so on. Each port
+// is taken from the resource it was offered with.
+func drawPorts(left *mesos.Resources, j *jobSpec, sources []mesos.ResourceFilter) (mesos.Resources, []uint64, error) {
+	if len(j.Ports) == 0 {
+		return nil, nil, nil
+	}
+	var hostPorts []uint64
+	var err error
+	available := mesos.Ranges{}
+	for _, source := range sources {
+		for i := range *left {
+			r := &(*left)[i]
+			if r.GetName() == "ports" && r.GetType() == mesos.RANGES && source(r) {
+				available = append(available, r.GetRanges().GetRange()...)
+			}
+		}
+		if hostPorts, err = allocatePorts(available.Sort().Squash(), j.Ports, j.PortAllocation); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	drawn := mesos.Resources{}
+	for _, port := range hostPorts {
+		for i := range *left {
+			r := &(*left)[i]
+			if r.GetName() != "ports" || mesos.Ranges(r.GetRanges().GetRange()).Search(port) < 0 {
+				continue
+			}
+			part := *proto.Clone(r).(*mesos.Resource)
+			part.Ranges = &mesos.Value_Ranges{Range: mesos.NewRanges(port)}
+			drawn.Add(part)
+			break
+		}
+	}
+	left.Subtract(drawn...)
+	return drawn, hostPorts, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+func portsResource(begin, end uint64, role string) mesos.Resource {
+	return *mesos.BuildResource().Name("ports").Ranges(mesos.BuildRanges().Span(begin, end).Ranges).Role(role).Resource
+}
+
+// testOffer has resources reserved for role web, and more unreserved ones
+func testOffer() *mesos.Offer {
+	return &mesos.Offer{
+		ID:       mesos.OfferID{Value: "o1"},
+		AgentID:  mesos.AgentID{Value: "a1"},
+		Hostname: "h1",
+		Resources: mesos.Resources{
+			scalarResource("cpus", 1, "web"),
+			scalarResource("cpus", 2, "*"),
+			scalarResource("mem", 256, "web"),
+			scalarResource("mem", 1024, "*"),
+			scalarResource("disk", 100, "*"),
+			portsResource(31000, 31000, "web"),
+			portsResource(32000, 32009, "*"),
+		},
+	}
+}
+
+func TestOfferLedgerClaim(t *testing.T) {
+	tests := []struct {
+		name       string
+		job        string
+		volumeDisk float64
+		resources  string
+		hostPorts  []uint64
+		volume     string
+		err        string
+	}{
+		{
+			name:      "reserved before unreserved",
+			job:       `{"cmd": "x", "cpus": 1.5, "mem": 128, "ports": [{}, {}]}`,
+			resources: "cpus(web):1;cpus(*):0.5;mem(web):128;ports(web):[31000-31000];ports(*):[32000-32000]",
+			hostPorts: []uint64{31000, 32000},
+		},
+		{
+			name:      "reserved only",
+			job:       `{"cmd": "x", "cpus": 1, "mem": 256, "reservedOnly": true}`,
+			resources: "cpus(web):1;mem(web):256",
+		},
+		{
+			name: "reserved only, short of reserved",
+			job:  `{"cmd": "x", "cpus": 1.5, "mem": 128, "reservedOnly": true}`,
+			err:  "reserved for role web: needs 1.5 cpus, 1 left",
+		},
+		{
+			name:      "reserved only takes unreserved ports",
+			job:       `{"cmd": "x", "cpus": 0.5, "mem": 64, "reservedOnly": true, "ports": [{}, {"hostPort": 32005}]}`,
+			resources: "cpus(web):0.5;mem(web):64;ports(web):[31000-31000];ports(*):[32005-32005]",
+			hostPorts: []uint64{31000, 32005},
+		},
+		{
+			name: "too few cpus",
+			job:  `{"cmd": "x", "cpus": 4, "mem": 64}`,
+			err:  "needs 4 cpus, 3 left",
+		},
+		{
+			name:       "volume from unreserved disk",
+			job:        `{"cmd": "x", "cpus": 0.5, "mem": 64, "disk": 10}`,
+			volumeDisk: 50,
+			resources:  "cpus(web):0.5;mem(web):64;disk(*):10",
+			volume:     "disk(*):50",
+		},
+		{
+			name:       "volume larger than the disk",
+			job:        `{"cmd": "x", "cpus": 0.5, "mem": 64}`,
+			volumeDisk: 200,
+			err:        "volume needs 200 disk, 100 left",
+		},
+	}
+	for _, test := range tests {
+		l := newOfferLedger(testOffer(), "web")
+		c, err := l.claim(testJob(t, test.job), test.volumeDisk)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if got := c.resources.String(); got != test.resources {
+			t.Errorf("%s: got resources %s, want %s", test.name, got, test.resources)
+		}
+		if !reflect.DeepEqual(c.hostPorts, test.hostPorts) {
+			t.Errorf("%s: got host ports %v, want %v", test.name, c.hostPorts, test.hostPorts)
+		}
+		if got := c.volumeDisk.String(); got != test.volume {
+			t.Errorf("%s: got volume disk %s, want %s", test.name, got, test.volume)
+		}
+	}
+}
+
+func TestOfferLedgerTake(t *testing.T) {
+	l := newOfferLedger(testOffer(), "web")
+	j := testJob(t, `{"cmd": "x", "cpus": 0.75, "mem": 200, "ports": [{}]}`)
+	want := []string{
+		"cpus(web):0.75;mem(web):200;ports(web):[31000-31000]",
+		"cpus(web):0.25;cpus(*):0.5;mem(web):56;mem(*):144;ports(*):[32000-32000]",
+		"cpus(*):0.75;mem(*):200;ports(*):[32001-32001]",
+	}
+	for i, resources := range want {
+		c, err := l.claim(j, 0)
+		if err != nil {
+			t.Fatalf("task %d: %s", i, err)
+		}
+		if got := c.resources.String(); got != resources {
+			t.Errorf("task %d: got %s, want %s", i, got, resources)
+		}
+		l.take(c)
+	}
+	if cpus := l.scalar("cpus"); cpus != 0.75 {
+		t.Errorf("got %g cpus left, want 0.75", cpus)
+	}
+}
+
+func TestDrawScalar(t *testing.T) {
+	dynamic := scalarResource("cpus", 0.5, "web")
+	dynamic.Reservation = &mesos.Resource_ReservationInfo{Principal: proto.String("p")}
+	left := mesos.Resources{}
+	left.Add(
+		scalarResource("cpus", 1, "web"),
+		scalarResource("cpus", 1.5, "*"),
+		scalarResource("mem", 64, "*"),
+		dynamic,
+	)
+	reserved := mesos.ReservedResources("web")
+	both := []mesos.ResourceFilter{reserved, mesos.UnreservedResources}
+	tests := []struct {
+		name    string
+		amount  float64
+		sources []mesos.ResourceFilter
+		drawn   string
+		err     string
+	}{
+		{name: "one source", amount: 0.5, sources: []mesos.ResourceFilter{mesos.UnreservedResources}, drawn: "cpus(*):0.5"},
+		{name: "reservations in offered order", amount: 1.2, sources: []mesos.ResourceFilter{reserved}, drawn: "cpus(web):1;cpus(web, p):0.2"},
+		{name: "sources in order", amount: 2, sources: both, drawn: "cpus(web):1;cpus(web, p):0.5;cpus(*):0.5"},
+		{name: "rounded", amount: 0.1 + 0.2, sources: both, drawn: "cpus(web):0.3"},
+		{name: "all of it", amount: 3, sources: both, drawn: "cpus(web):1;cpus(web, p):0.5;cpus(*):1.5"},
+		{name: "too much", amount: 3.1, sources: both, err: "needs 3.1 cpus, 3 left"},
+		{name: "too much of a source", amount: 2, sources: []mesos.ResourceFilter{reserved}, err: "needs 2 cpus, 1.5 left"},
+	}
+	for _, test := range tests {
+		l := left.Clone()
+		drawn, err := drawScalar(&l, "cpus", test.amount, test.sources)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			if !l.Equivalent(left) {
+				t.Errorf("%s: left changed to %s", test.name, l)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if drawn.String() != test.drawn {
+			t.Errorf("%s: got %s, want %s", test.name, drawn, test.drawn)
+		}
+		if !l.Plus(drawn...).Equivalent(left) {
+			t.Errorf("%s: %s left after drawing %s from %s", test.name, l, drawn, left)
+		}
+	}
+}
+
+func TestDrawPorts(t *testing.T) {
+	left := mesos.Resources{
+		portsResource(31000, 31001, "web"),
+		portsResource(32000, 32002, "*"),
+	}
+	reserved := mesos.ReservedResources("web")
+	both := []mesos.ResourceFilter{reserved, mesos.UnreservedResources}
+	tests := []struct {
+		name      string
+		ports     string
+		sources   []mesos.ResourceFilter
+		drawn     string
+		hostPorts []uint64
+		err       string
+	}{
+		{name: "no ports", ports: `[]`, sources: both},
+		{name: "reserved first", ports: `[{}, {}]`, sources: both, drawn: "ports(web):[31000-31001]", hostPorts: []uint64{31000, 31001}},
+		{
+			name:      "unreserved when reserved are short",
+			ports:     `[{}, {}, {}]`,
+			sources:   both,
+			drawn:     "ports(web):[31000-31001];ports(*):[32000-32000]",
+			hostPorts: []uint64{31000, 31001, 32000},
+		},
+		{name: "asked for host port", ports: `[{"hostPort": 32002}]`, sources: both, drawn: "ports(*):[32002-32002]", hostPorts: []uint64{32002}},
+		{name: "asked for host port of another source", ports: `[{"hostPort": 32002}]`, sources: []mesos.ResourceFilter{reserved}, err: "ports[0]: host port 32002 is not offered or already taken"},
+		{name: "too many", ports: `[{}, {}, {}, {}, {}, {}]`, sources: both, err: "needs 6 ports, 5 left"},
+	}
+	for _, test := range tests {
+		l := left.Clone()
+		j := testJob(t, `{"cmd": "x", "ports": `+test.ports+`}`)
+		drawn, hostPorts, err := drawPorts(&l, j, test.sources)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if drawn.String() != test.drawn || !reflect.DeepEqual(hostPorts, test.hostPorts) {
+			t.Errorf("%s: got %s %v, want %s %v", test.name, drawn, hostPorts, test.drawn, test.hostPorts)
+		}
+		if !l.Plus(drawn...).Equivalent(left) {
+			t.Errorf("%s: %s left after drawing %s from %s", test.name, l, drawn, left)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mesos/mesos-go"
+)
+
+// There is no Prometheus client library in vendor, so the few metric types we need are written
+// out in the Prometheus text format by hand.
+
+var (
+	offerHoldBuckets    = []float64{0.001, 0.01, 0.1, 0.5, 1, 5, 10, 30, 60}
+	startLatencyBuckets = []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+)
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", name, h.sum, name, h.count)
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+}
+
+// schedulerMetrics counts what the scheduler does with offers and tasks. Driver callbacks and
+// the HTTP API run on different goroutines, so all access goes through the lock.
+type schedulerMetrics struct {
+	sync.Mutex
+	offersReceived  uint64
+	offersDeclined  uint64
+	offersRescinded uint64
+	offersUsed      uint64
+	errors          uint64
+	// launched counts tasks by container type
+	launched  map[string]uint64
+	connected bool
+	lastOffer time.Time
+	offerHold *histogram
+	// startLatency is the time from a job entering the queue until its task runs
+	startLatency *histogram
+	// offeredAt and queuedAt are kept until the offer is gone and the task is running
+	offeredAt map[string]time.Time
+	queuedAt  map[string]time.Time
+}
+
+func newSchedulerMetrics() *schedulerMetrics {
+	return &schedulerMetrics{
+		launched:     make(map[string]uint64),
+		offerHold:    newHistogram(offerHoldBuckets),
+		startLatency: newHistogram(startLatencyBuckets),
+		offeredAt:    make(map[string]time.Time),
+		queuedAt:     make(map[string]time.Time),
+	}
+}
+
+func (m *schedulerMetrics) setConnected(connected bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.connected = connected
+}
+
+func (m *schedulerMetrics) errorReceived() {
+	m.Lock()
+	defer m.Unlock()
+	m.errors++
+}
+
+func (m *schedulerMetrics) offersOffered(offers []mesos.Offer) {
+	m.Lock()
+	defer m.Unlock()
+	m.offersReceived += uint64(len(offers))
+	m.lastOffer = time.Now()
+	for _, offer := range offers {
+		m.offeredAt[offer.ID.Value] = m.lastOffer
+	}
+}
+
+// offersPrinted counts offers which are only printed, they are held without being used or
+// declined, so how long is not observed
+func (m *schedulerMetrics) offersPrinted(offers []mesos.Offer) {
+	m.Lock()
+	defer m.Unlock()
+	m.offersReceived += uint64(len(offers))
+	m.lastOffer = time.Now()
+}
+
+// offerGone observes how long an offer was held, the lock must be held
+func (m *schedulerMetrics) offerGone(offerID string) {
+	if offeredAt, ok := m.offeredAt[offerID]; ok {
+		m.offerHold.observe(time.Since(offeredAt).Seconds())
+		delete(m.offeredAt, offerID)
+	}
+}
+
+func (m *schedulerMetrics) offerDeclined(offerID mesos.OfferID) {
+	m.Lock()
+	defer m.Unlock()
+	m.offersDeclined++
+	m.offerGone(offerID.Value)
+}
+
+func (m *schedulerMetrics) offerRescinded(offerID mesos.OfferID) {
+	m.Lock()
+	defer m.Unlock()
+	m.offersRescinded++
+	m.offerGone(offerID.Value)
+}
+
+func (m *schedulerMetrics) offerUsed(offerID mesos.OfferID) {
+	m.Lock()
+	defer m.Unlock()
+	m.offersUsed++
+	m.offerGone(offerID.Value)
+}
+
+// taskLaunched counts a task of a job which entered the queue at queuedAt
+func (m *schedulerMetrics) taskLaunched(containerType, taskID string, queuedAt time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	m.launched[containerType]++
+	m.queuedAt[taskID] = queuedAt
+}
+
+func (m *schedulerMetrics) taskStatus(status mesos.TaskStatus) {
+	m.Lock()
+	defer m.Unlock()
+	taskID := status.TaskID.Value
+	queuedAt, ok := m.queuedAt[taskID]
+	if !ok {
+		return
+	}
+	if status.GetState() == mesos.TASK_RUNNING {
+		m.startLatency.observe(time.Since(queuedAt).Seconds())
+		delete(m.queuedAt, taskID)
+	} else if isTerminal(status.GetState()) {
+		delete(m.queuedAt, taskID)
+	}
+}
+
+// write writes all metrics in the Prometheus text format, together with the number of tasks in
+// each state and of the tasks which were forgotten after they ended
+func (m *schedulerMetrics) write(w io.Writer, states, forgotten map[mesos.TaskState]int) {
+	m.Lock()
+	defer m.Unlock()
+	writeMetric(w, "rendler_offers_received_total", "counter", "Offers received.", float64(m.offersReceived))
+	writeMetric(w, "rendler_offers_declined_total", "counter", "Offers declined.", float64(m.offersDeclined))
+	writeMetric(w, "rendler_offers_rescinded_total", "counter", "Offers rescinded by the master.", float64(m.offersRescinded))
+	writeMetric(w, "rendler_offers_used_total", "counter", "Offers accepted with operations.", float64(m.offersUsed))
+	writeMetric(w, "rendler_errors_total", "counter", "Errors sent by the master.", float64(m.errors))
+	connected := 0.0
+	if m.connected {
+		connected = 1
+	}
+	writeMetric(w, "rendler_master_connected", "gauge", "Whether the scheduler is subscribed to a master.", connected)
+	lastOffer := 0.0
+	if !m.lastOffer.IsZero() {
+		lastOffer = float64(m.lastOffer.UnixNano()) / float64(time.Second)
+	}
+	writeMetric(w, "rendler_last_offer_timestamp_seconds", "gauge", "When offers were received last.", lastOffer)
+
+	fmt.Fprintf(w, "# HELP rendler_tasks_launched_total Tasks launched by container type.\n")
+	fmt.Fprintf(w, "# TYPE rendler_tasks_launched_total counter\n")
+	containerTypes := []string{}
+	for containerType := range m.launched {
+		containerTypes = append(containerTypes, containerType)
+	}
+	sort.Strings(containerTypes)
+	for _, containerType := range containerTypes {
+		fmt.Fprintf(w, "rendler_tasks_launched_total{container=%q} %d\n", containerType, m.launched[containerType])
+	}
+
+	fmt.Fprintf(w, "# HELP rendler_tasks Tasks by state.\n# TYPE rendler_tasks gauge\n")
+	names := []string{}
+	for _, name := range mesos.TaskState_name {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		state := mesos.TaskState(mesos.TaskState_value[name])
+		fmt.Fprintf(w, "rendler_tasks{state=%q} %d\n", name, states[state])
+	}
+	fmt.Fprintf(w, "# HELP rendler_tasks_forgotten_total Tasks which ended and were forgotten, by final state.\n")
+	fmt.Fprintf(w, "# TYPE rendler_tasks_forgotten_total counter\n")
+	for _, name := range names {
+		state := mesos.TaskState(mesos.TaskState_value[name])
+		if isTerminal(state) {
+			fmt.Fprintf(w, "rendler_tasks_forgotten_total{state=%q} %d\n", name, forgotten[state])
+		}
+	}
+
+	m.offerHold.write(w, "rendler_offer_hold_seconds", "Time from receiving an offer until it was used, declined or rescinded.")
+	m.startLatency.write(w, "rendler_task_start_latency_seconds", "Time from queuing a job until its task was running.")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mesos/mesos-go"
+)
+
+func TestSchedulerMetricsOfferHold(t *testing.T) {
+	offer := mesos.Offer{ID: mesos.OfferID{Value: "o1"}}
+	tests := []struct {
+		name    string
+		offered func(m *schedulerMetrics)
+		gone    func(m *schedulerMetrics)
+		held    bool
+	}{
+		{
+			name:    "declined",
+			offered: func(m *schedulerMetrics) { m.offersOffered([]mesos.Offer{offer}) },
+			gone:    func(m *schedulerMetrics) { m.offerDeclined(offer.ID) },
+		},
+		{
+			name:    "rescinded",
+			offered: func(m *schedulerMetrics) { m.offersOffered([]mesos.Offer{offer}) },
+			gone:    func(m *schedulerMetrics) { m.offerRescinded(offer.ID) },
+		},
+		{
+			name:    "used",
+			offered: func(m *schedulerMetrics) { m.offersOffered([]mesos.Offer{offer}) },
+			gone:    func(m *schedulerMetrics) { m.offerUsed(offer.ID) },
+		},
+		{
+			name:    "held",
+			offered: func(m *schedulerMetrics) { m.offersOffered([]mesos.Offer{offer}) },
+			gone:    func(m *schedulerMetrics) {},
+			held:    true,
+		},
+		{
+			name:    "only printed",
+			offered: func(m *schedulerMetrics) { m.offersPrinted([]mesos.Offer{offer}) },
+			gone:    func(m *schedulerMetrics) {},
+		},
+	}
+	for _, test := range tests {
+		m := newSchedulerMetrics()
+		test.offered(m)
+		test.gone(m)
+		if m.offersReceived != 1 {
+			t.Errorf("%s: %d offers received, want 1", test.name, m.offersReceived)
+		}
+		if _, held := m.offeredAt[offer.ID.Value]; held != test.held {
+			t.Errorf("%s: held is %t, want %t", test.name, held, test.held)
+		}
+	}
+}
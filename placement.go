@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+
+	"github.com/mesos/mesos-go"
+)
+
+const (
+	placementFirstFit = "firstFit"
+	placementBestFit  = "bestFit"
+	placementSpread   = "spread"
+	placementRandom   = "random"
+)
+
+// placementStrategy picks the offer one task of a job goes to. It is given every offer of the
+// ResourceOffers batch the task fits in, in the order the offers arrived.
+type placementStrategy interface {
+	pick(j *jobSpec, candidates []*offerSlot, batch *placementBatch) *offerSlot
+}
+
+var placementStrategies = map[string]placementStrategy{
+	placementFirstFit: firstFit{},
+	placementBestFit:  bestFit{},
+	placementSpread:   spread{},
+	placementRandom:   randomFit{},
+}
+
+// offerSlot is one offer of a batch, together with what is left of it and the tasks put on it
+type offerSlot struct {
+	offer  *mesos.Offer
+	agent  taskPlacement
+	ledger *offerLedger
+	tasks  []mesos.TaskInfo
+	// jobs are the jobs of the tasks, and newVolumes the volumes by key which are created for them
+	jobs       []job
+	newVolumes map[string]string
+	// operations run before the tasks are launched, e.g. to create their volumes
+	operations []mesos.Offer_Operation
+	// rejections tells for each job why none of its tasks went to this offer
+	rejections map[string]string
+}
+
+func newOfferSlot(offer *mesos.Offer, role string) *offerSlot {
+	return &offerSlot{
+		offer:      offer,
+		agent:      offerPlacement(offer),
+		ledger:     newOfferLedger(offer, role),
+		newVolumes: make(map[string]string),
+		rejections: make(map[string]string),
+	}
+}
+
+// declineReasons lists why the queued jobs did not use the offer
+func (slot *offerSlot) declineReasons() []string {
+	reasons := []string{}
+	for name, reason := range slot.rejections {
+		reasons = append(reasons, fmt.Sprintf("job %s: %s", name, reason))
+	}
+	return reasons
+}
+
+// placementBatch places tasks on all offers of one ResourceOffers call together
+type placementBatch struct {
+	slots []*offerSlot
+	// placed is where the running and just placed tasks of each job are, in launch order
+	placed map[string][]taskPlacement
+}
+
+// newPlacementBatch places tasks on the offers, with the resources of role before unreserved ones
+func newPlacementBatch(offers []mesos.Offer, tasks *taskRegistry, role string) *placementBatch {
+	b := &placementBatch{placed: make(map[string][]taskPlacement)}
+	for i := range offers {
+		b.slots = append(b.slots, newOfferSlot(&offers[i], role))
+	}
+	running := tasks.list(func(t *taskRecord) bool { return !isTerminal(t.state) })
+	// constraints see the tasks in a stable order, the order they were launched in
+	sort.Slice(running, func(i, k int) bool {
+		if !running[i].launchedAt.Equal(running[k].launchedAt) {
+			return running[i].launchedAt.Before(running[k].launchedAt)
+		}
+		return running[i].taskID < running[k].taskID
+	})
+	for _, task := range running {
+		b.placed[task.name] = append(b.placed[task.name], taskPlacement{
+			slaveID:    task.slaveID,
+			hostname:   task.hostname,
+			attributes: task.attributes,
+		})
+	}
+	return b
+}
+
+// tasksOnAgent counts the running and just placed tasks of the job on the agent
+func (b *placementBatch) tasksOnAgent(jobName, slaveID string) int {
+	count := 0
+	for _, p := range b.placed[jobName] {
+		if p.slaveID == slaveID {
+			count++
+		}
+	}
+	return count
+}
+
+// fits reports whether one task of the job, with the volume of its instance if there is one,
+// fits into any of the offers
+func (b *placementBatch) fits(j *jobSpec, v *volume) bool {
+	return len(b.candidates(j, v)) > 0
+}
+
+// candidates returns the offers which have enough resources left for a task of the job and
+// satisfy all its constraints. A task with a volume which exists goes to the offer with the
+// volume, otherwise it needs the disk to create one. A volume which is being created stays on
+// its agent, creating it elsewhere could leave two volumes for the instance.
+func (b *placementBatch) candidates(j *jobSpec, v *volume) []*offerSlot {
+	candidates := []*offerSlot{}
+	for _, slot := range b.slots {
+		if j.Volume != nil && v != nil && offeredVolume(slot.offer, v.ID) == nil {
+			if v.Created {
+				slot.rejections[j.Name] = fmt.Sprintf("volume %s is on agent %s", v.ID, v.Hostname)
+				continue
+			}
+			if v.AgentID != slot.offer.AgentID.Value {
+				slot.rejections[j.Name] = fmt.Sprintf("volume %s is being created on agent %s", v.ID, v.Hostname)
+				continue
+			}
+		}
+		if _, err := slot.ledger.claim(j, volumeDisk(j, v, slot.offer)); err != nil {
+			slot.rejections[j.Name] = "not enough resources: " + err.Error()
+			continue
+		}
+		if err := b.checkConstraints(j, slot); err != nil {
+			slot.rejections[j.Name] = err.Error()
+			continue
+		}
+		candidates = append(candidates, slot)
+	}
+	return candidates
+}
+
+func (b *placementBatch) checkConstraints(j *jobSpec, slot *offerSlot) error {
+	for _, c := range j.constraints {
+		if err := c.check(slot.agent, b.placed[j.Name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// place picks an offer for one task of the job with the job's strategy and takes the resources
+// the task is launched with from it, it returns nil if the task fits nowhere
+func (b *placementBatch) place(j *jobSpec, v *volume) (*offerSlot, *resourceClaim) {
+	candidates := b.candidates(j, v)
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+	strategy, ok := placementStrategies[j.Placement]
+	if !ok {
+		strategy = firstFit{}
+	}
+	slot := strategy.pick(j, candidates, b)
+	claim, err := slot.ledger.claim(j, volumeDisk(j, v, slot.offer))
+	if err != nil {
+		// candidates all had room for the task
+		panic(err)
+	}
+	slot.ledger.take(claim)
+	delete(slot.rejections, j.Name)
+	b.placed[j.Name] = append(b.placed[j.Name], slot.agent)
+	return slot, claim
+}
+
+// firstFit takes the first offer the task fits in
+type firstFit struct{}
+
+func (firstFit) pick(j *jobSpec, candidates []*offerSlot, batch *placementBatch) *offerSlot {
+	return candidates[0]
+}
+
+// bestFit takes the offer which is left with the least cpus and mem, packing tasks densely
+// onto few agents
+type bestFit struct{}
+
+func (bestFit) pick(j *jobSpec, candidates []*offerSlot, batch *placementBatch) *offerSlot {
+	best := candidates[0]
+	bestScore := bestFitScore(j, best)
+	for _, slot := range candidates[1:] {
+		if score := bestFitScore(j, slot); score < bestScore {
+			best, bestScore = slot, score
+		}
+	}
+	return best
+}
+
+// bestFitScore is the share of the offer which would be left unused after placing the task
+func bestFitScore(j *jobSpec, slot *offerSlot) float64 {
+	score := 0.0
+	if total := sumScalar(slot.ledger.total, "cpus"); total > 0 {
+		score += (slot.ledger.scalar("cpus") - j.Cpus) / total
+	}
+	if total := sumScalar(slot.ledger.total, "mem"); total > 0 {
+		score += (slot.ledger.scalar("mem") - j.Mem) / total
+	}
+	return score
+}
+
+// spread takes an offer from the agent running the fewest tasks of the job
+type spread struct{}
+
+func (spread) pick(j *jobSpec, candidates []*offerSlot, batch *placementBatch) *offerSlot {
+	best := candidates[0]
+	bestCount := batch.tasksOnAgent(j.Name, best.agent.slaveID)
+	for _, slot := range candidates[1:] {
+		if count := batch.tasksOnAgent(j.Name, slot.agent.slaveID); count < bestCount {
+			best, bestCount = slot, count
+		}
+	}
+	return best
+}
+
+// randomFit takes any offer the task fits in
+type randomFit struct{}
+
+func (randomFit) pick(j *jobSpec, candidates []*offerSlot, batch *placementBatch) *offerSlot {
+	return candidates[rand.Intn(len(candidates))]
+}
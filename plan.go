@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+// errDryRun is returned by AcceptOffers in dry run, the offers were declined instead
+var errDryRun = errors.New("dry run, offers declined")
+
+// resolvePlan applies the operations to the offered resources like the master does and returns
+// what is left of them. Tasks whose resources are not left when their LAUNCH comes are not
+// launched, the master fails them alone; they are returned with the reason. Any other operation
+// which can't be applied makes the whole plan invalid.
+func resolvePlan(offered mesos.Resources, operations []mesos.Offer_Operation) (left mesos.Resources, launch []mesos.Offer_Operation, invalid map[string]string, err error) {
+	defer func() {
+		// Apply panics when an operation changed the totals of the resources
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	left = offered.Clone()
+	invalid = make(map[string]string)
+	for i, op := range operations {
+		if op.GetType() != mesos.LAUNCH {
+			result, err := op.Apply(left)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("operation %d (%s): %s", i, op.GetType(), err)
+			}
+			left = result
+			launch = append(launch, op)
+			continue
+		}
+		tasks := []mesos.TaskInfo{}
+		for _, task := range op.GetLaunch().GetTaskInfos() {
+			resources := mesos.Resources(task.Resources)
+			if err := resources.Validate(); err != nil {
+				invalid[task.TaskID.Value] = err.Error()
+				continue
+			}
+			if !left.ContainsAll(resources) {
+				invalid[task.TaskID.Value] = fmt.Sprintf("task needs %s, what is left of the offer is %s", resources, left)
+				continue
+			}
+			left.Subtract(resources...)
+			tasks = append(tasks, task)
+		}
+		if len(tasks) > 0 {
+			launch = append(launch, launchOperation(tasks))
+		}
+	}
+	return left, launch, invalid, nil
+}
+
+// planStep is an operation of a plan as the dry run prints it
+type planStep struct {
+	Type      string   `json:"type"`
+	Resources string   `json:"resources,omitempty"`
+	Tasks     []string `json:"tasks,omitempty"`
+}
+
+func describePlan(operations []mesos.Offer_Operation) []planStep {
+	steps := []planStep{}
+	for _, op := range operations {
+		step := planStep{Type: op.GetType().String()}
+		switch op.GetType() {
+		case mesos.RESERVE:
+			step.Resources = mesos.Resources(op.GetReserve().GetResources()).String()
+		case mesos.UNRESERVE:
+			step.Resources = mesos.Resources(op.GetUnreserve().GetResources()).String()
+		case mesos.CREATE:
+			step.Resources = mesos.Resources(op.GetCreate().GetVolumes()).String()
+		case mesos.DESTROY:
+			step.Resources = mesos.Resources(op.GetDestroy().GetVolumes()).String()
+		case mesos.LAUNCH:
+			for _, task := range op.GetLaunch().GetTaskInfos() {
+				step.Tasks = append(step.Tasks, fmt.Sprintf("%s %s", task.TaskID.Value, mesos.Resources(task.Resources)))
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps
+}
+
+// newPlanningDriverFactory checks every plan the scheduler accepts offers with before it goes
+// to the drivers which connect creates. With dryRun, plans are printed and the offers declined.
+func newPlanningDriverFactory(connect driverFactory, dryRun bool) driverFactory {
+	return func(master string, framework mesos.FrameworkInfo, sched scheduler) schedulerDriver {
+		p := &planner{dryRun: dryRun, offers: make(map[string]mesos.Offer)}
+		return connect(master, framework, &planningScheduler{sched: sched, planner: p})
+	}
+}
+
+// planner keeps the offers of a driver, so that plans can be resolved against them
+type planner struct {
+	sync.Mutex
+	dryRun bool
+	offers map[string]mesos.Offer
+}
+
+func (p *planner) take(offerIDs []mesos.OfferID) (mesos.Resources, []string, error) {
+	p.Lock()
+	defer p.Unlock()
+	resources := mesos.Resources{}
+	hostnames := []string{}
+	for _, id := range offerIDs {
+		offer, ok := p.offers[id.Value]
+		if !ok {
+			return nil, nil, fmt.Errorf("offer %s is unknown or gone", id.Value)
+		}
+		resources.Add(offer.Resources...)
+		hostnames = append(hostnames, offer.Hostname)
+	}
+	for _, id := range offerIDs {
+		delete(p.offers, id.Value)
+	}
+	return resources, hostnames, nil
+}
+
+func (p *planner) forget(offerID mesos.OfferID) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.offers, offerID.Value)
+}
+
+// planningScheduler hands the scheduler a planningDriver, and keeps track of the offers
+type planningScheduler struct {
+	sched   scheduler
+	planner *planner
+}
+
+func (s *planningScheduler) wrap(driver schedulerDriver) schedulerDriver {
+	return &planningDriver{schedulerDriver: driver, planner: s.planner, sched: s.sched}
+}
+
+func (s *planningScheduler) Registered(driver schedulerDriver, frameworkID mesos.FrameworkID, masterInfo *mesos.MasterInfo) {
+	s.sched.Registered(s.wrap(driver), frameworkID, masterInfo)
+}
+
+func (s *planningScheduler) Disconnected(driver schedulerDriver) {
+	s.planner.Lock()
+	s.planner.offers = make(map[string]mesos.Offer)
+	s.planner.Unlock()
+	s.sched.Disconnected(s.wrap(driver))
+}
+
+func (s *planningScheduler) ResourceOffers(driver schedulerDriver, offers []mesos.Offer) {
+	s.planner.Lock()
+	for _, offer := range offers {
+		s.planner.offers[offer.ID.Value] = offer
+	}
+	s.planner.Unlock()
+	s.sched.ResourceOffers(s.wrap(driver), offers)
+}
+
+func (s *planningScheduler) OfferRescinded(driver schedulerDriver, offerID mesos.OfferID) {
+	s.planner.forget(offerID)
+	s.sched.OfferRescinded(s.wrap(driver), offerID)
+}
+
+func (s *planningScheduler) StatusUpdate(driver schedulerDriver, status mesos.TaskStatus) {
+	s.sched.StatusUpdate(s.wrap(driver), status)
+}
+
+func (s *planningScheduler) FrameworkMessage(driver schedulerDriver, executorID mesos.ExecutorID, agentID mesos.AgentID, data []byte) {
+	s.sched.FrameworkMessage(s.wrap(driver), executorID, agentID, data)
+}
+
+func (s *planningScheduler) SlaveLost(driver schedulerDriver, agentID mesos.AgentID) {
+	s.sched.SlaveLost(s.wrap(driver), agentID)
+}
+
+func (s *planningScheduler) ExecutorLost(driver schedulerDriver, executorID mesos.ExecutorID, agentID mesos.AgentID, status int) {
+	s.sched.ExecutorLost(s.wrap(driver), executorID, agentID, status)
+}
+
+func (s *planningScheduler) Error(driver schedulerDriver, message string) {
+	s.sched.Error(s.wrap(driver), message)
+}
+
+// planningDriver resolves each plan before accepting offers with it. Invalid plans never reach
+// the master: the offers are declined and their tasks fail with TASK_ERROR, as they would on the
+// master. Tasks which alone are invalid are left out of a plan which is valid otherwise. Whenever
+// the offers are not accepted, AcceptOffers returns an error.
+type planningDriver struct {
+	schedulerDriver
+	planner *planner
+	sched   scheduler
+}
+
+func (d *planningDriver) AcceptOffers(offerIDs []mesos.OfferID, operations []mesos.Offer_Operation, filters *mesos.Filters) error {
+	offered, hostnames, err := d.planner.take(offerIDs)
+	if err != nil {
+		d.fail(operations, nil, err.Error())
+		return err
+	}
+	fields := log.Fields{"offerIDs": offerIDs, "hostnames": hostnames}
+	left, launch, invalid, err := resolvePlan(offered, operations)
+	if err != nil {
+		fields["err"] = err
+		log.WithFields(fields).Error("invalid plan, declining the offers")
+		d.decline(offerIDs, filters)
+		d.fail(operations, nil, "invalid plan: "+err.Error())
+		return fmt.Errorf("invalid plan: %s", err)
+	}
+	if len(invalid) > 0 {
+		log.WithFields(fields).WithFields(log.Fields{"tasks": invalid}).Error("invalid tasks left out of the plan")
+		d.fail(operations, invalid, "")
+	}
+	if d.planner.dryRun {
+		fields["plan"] = describePlan(launch)
+		fields["left"] = left.String()
+		log.WithFields(fields).Info("dry run, not accepting")
+		d.decline(offerIDs, filters)
+		return errDryRun
+	}
+	if len(launch) == 0 {
+		d.decline(offerIDs, filters)
+		return errors.New("no valid operation left, offers declined")
+	}
+	return d.schedulerDriver.AcceptOffers(offerIDs, launch, filters)
+}
+
+func (d *planningDriver) DeclineOffer(offerID mesos.OfferID, filters *mesos.Filters) error {
+	d.planner.forget(offerID)
+	return d.schedulerDriver.DeclineOffer(offerID, filters)
+}
+
+func (d *planningDriver) decline(offerIDs []mesos.OfferID, filters *mesos.Filters) {
+	for _, id := range offerIDs {
+		if err := d.schedulerDriver.DeclineOffer(id, filters); err != nil {
+			log.WithFields(log.Fields{"offerID": id.Value, "err": err}).Error("decline offer failed")
+		}
+	}
+}
+
+// fail sends TASK_ERROR for the tasks of the operations, only for those in invalid if it is not
+// nil, with their reason there or else with reason
+func (d *planningDriver) fail(operations []mesos.Offer_Operation, invalid map[string]string, reason string) {
+	for _, op := range operations {
+		for _, task := range op.GetLaunch().GetTaskInfos() {
+			message := reason
+			if invalid != nil {
+				var ok bool
+				if message, ok = invalid[task.TaskID.Value]; !ok {
+					continue
+				}
+			}
+			agentID := task.AgentID
+			d.sched.StatusUpdate(d, mesos.TaskStatus{
+				TaskID:    task.TaskID,
+				State:     mesos.TASK_ERROR.Enum(),
+				Reason:    mesos.REASON_TASK_INVALID.Enum(),
+				Message:   proto.String(message),
+				AgentID:   &agentID,
+				Timestamp: proto.Float64(float64(time.Now().UnixNano()) / float64(time.Second)),
+			})
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+func scalarResource(name string, value float64, role string) mesos.Resource {
+	return *mesos.BuildResource().Name(name).Scalar(value).Role(role).Resource
+}
+
+func testTask(id string, resources ...mesos.Resource) mesos.TaskInfo {
+	return mesos.TaskInfo{
+		TaskID:    mesos.TaskID{Value: id},
+		Name:      id,
+		AgentID:   mesos.AgentID{Value: "a1"},
+		Resources: resources,
+	}
+}
+
+func TestResolvePlan(t *testing.T) {
+	offered := mesos.Resources{scalarResource("cpus", 2, "*"), scalarResource("mem", 128, "*")}
+	reserved := scalarResource("cpus", 1, "web")
+	reserved.Reservation = &mesos.Resource_ReservationInfo{Principal: proto.String("p")}
+	reserve := mesos.Offer_Operation{
+		Type:    mesos.RESERVE.Enum(),
+		Reserve: &mesos.Offer_Operation_Reserve{Resources: []mesos.Resource{reserved}},
+	}
+	unreserve := mesos.Offer_Operation{
+		Type:      mesos.UNRESERVE.Enum(),
+		Unreserve: &mesos.Offer_Operation_Unreserve{Resources: []mesos.Resource{reserved}},
+	}
+	cpus := func(value float64) mesos.Resource { return scalarResource("cpus", value, "*") }
+	tests := []struct {
+		name       string
+		operations []mesos.Offer_Operation
+		left       string
+		launched   []string
+		invalid    []string
+		err        bool
+	}{
+		{
+			name:       "launch",
+			operations: []mesos.Offer_Operation{launchOperation([]mesos.TaskInfo{testTask("t1", cpus(1), scalarResource("mem", 64, "*"))})},
+			left:       "cpus(*):1;mem(*):64",
+			launched:   []string{"t1"},
+		},
+		{
+			name: "tasks beyond the offer are left out",
+			operations: []mesos.Offer_Operation{
+				launchOperation([]mesos.TaskInfo{testTask("t1", cpus(1.5)), testTask("t2", cpus(1))}),
+				launchOperation([]mesos.TaskInfo{testTask("t3", cpus(0.5))}),
+			},
+			left:     "mem(*):128",
+			launched: []string{"t1", "t3"},
+			invalid:  []string{"t2"},
+		},
+		{
+			name:       "launch on a new reservation",
+			operations: []mesos.Offer_Operation{reserve, launchOperation([]mesos.TaskInfo{testTask("t1", reserved)})},
+			left:       "cpus(*):1;mem(*):128",
+			launched:   []string{"t1"},
+		},
+		{
+			name:       "launch on a reservation which is not there",
+			operations: []mesos.Offer_Operation{launchOperation([]mesos.TaskInfo{testTask("t1", reserved), testTask("t2", cpus(1))})},
+			left:       "cpus(*):1;mem(*):128",
+			launched:   []string{"t2"},
+			invalid:    []string{"t1"},
+		},
+		{
+			name:       "task with invalid resources",
+			operations: []mesos.Offer_Operation{launchOperation([]mesos.TaskInfo{testTask("t1", cpus(-1))})},
+			left:       "cpus(*):2;mem(*):128",
+			invalid:    []string{"t1"},
+		},
+		{
+			name:       "unreserve what is not reserved",
+			operations: []mesos.Offer_Operation{unreserve, launchOperation([]mesos.TaskInfo{testTask("t1", cpus(1))})},
+			err:        true,
+		},
+	}
+	for _, test := range tests {
+		left, launch, invalid, err := resolvePlan(offered, test.operations)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if left.String() != test.left {
+			t.Errorf("%s: got %s left, want %s", test.name, left, test.left)
+		}
+		launched := []string{}
+		for _, op := range launch {
+			for _, task := range op.GetLaunch().GetTaskInfos() {
+				launched = append(launched, task.TaskID.Value)
+			}
+		}
+		invalidIDs := []string{}
+		for id := range invalid {
+			invalidIDs = append(invalidIDs, id)
+		}
+		sort.Strings(invalidIDs)
+		if fmt.Sprint(launched) != fmt.Sprint(test.launched) {
+			t.Errorf("%s: launched %v, want %v", test.name, launched, test.launched)
+		}
+		if fmt.Sprint(invalidIDs) != fmt.Sprint(test.invalid) {
+			t.Errorf("%s: invalid %v, want %v", test.name, invalidIDs, test.invalid)
+		}
+	}
+	if offered.String() != "cpus(*):2;mem(*):128" {
+		t.Errorf("offered resources changed to %s", offered)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+const (
+	portAllocationSequential = "sequential"
+	portAllocationRandom     = "random"
+
+	portProtocolTCP = "tcp"
+	portProtocolUDP = "udp"
+)
+
+// portNamePattern keeps port names usable in environment variable names and DNS records
+var portNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// portLabel names a port of a job in errors
+func portLabel(i int, p portSpec) string {
+	if p.Name != "" {
+		return fmt.Sprintf("port %q", p.Name)
+	}
+	return fmt.Sprintf("ports[%d]", i)
+}
+
+// portEnvName is the environment variable a named port is passed to its task with, e.g.
+// PORT_HTTP_ADMIN for http-admin
+func portEnvName(name string) string {
+	return "PORT_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// allocatePorts picks a host port for each port of a job from the available ranges, which must
+// be sorted and squashed. Ports which ask for a host port get it, the others get the lowest port
+// left or, with random allocation, any of them. The host ports are in the order of the specs.
+func allocatePorts(available mesos.Ranges, specs []portSpec, allocation string) ([]uint64, error) {
+	hostPorts := make([]uint64, len(specs))
+	left := available
+	unasked := 0
+	for i, p := range specs {
+		if p.HostPort == 0 {
+			unasked++
+			continue
+		}
+		port := uint64(p.HostPort)
+		var ok bool
+		// Partition leaves the ranges it is called on as they are
+		if left, ok = left.Partition(port); !ok {
+			return nil, fmt.Errorf("%s: host port %d is not offered or already taken", portLabel(i, p), port)
+		}
+		hostPorts[i] = port
+	}
+	if uint64(unasked) > left.Size() {
+		return nil, fmt.Errorf("needs %d ports, %d left", unasked, left.Size())
+	}
+	for i, p := range specs {
+		if p.HostPort != 0 {
+			continue
+		}
+		port := left.Min()
+		if allocation == portAllocationRandom {
+			port = nthPort(left, uint64(rand.Int63n(int64(left.Size()))))
+		}
+		left, _ = left.Partition(port)
+		hostPorts[i] = port
+	}
+	return hostPorts, nil
+}
+
+// nthPort is the port at index n of the ranges counted from their lowest port
+func nthPort(ranges mesos.Ranges, n uint64) uint64 {
+	for _, r := range ranges {
+		if size := r.End - r.Begin + 1; n >= size {
+			n -= size
+			continue
+		}
+		return r.Begin + n
+	}
+	panic("port index out of ranges")
+}
+
+// validatePorts checks the ports of a job, with fail of its validate
+func validatePorts(ports []portSpec, fail func(format string, args ...interface{})) {
+	names := make(map[string]bool)
+	hostPorts := make(map[int]bool)
+	for i, p := range ports {
+		label := portLabel(i, p)
+		if p.ContainerPort < 0 || p.ContainerPort > 65535 {
+			fail("%s: invalid container port %d", label, p.ContainerPort)
+		}
+		if p.HostPort < 0 || p.HostPort > 65535 {
+			fail("%s: invalid host port %d", label, p.HostPort)
+		} else if p.HostPort > 0 {
+			if hostPorts[p.HostPort] {
+				fail("%s: host port %d is asked for more than once", label, p.HostPort)
+			}
+			hostPorts[p.HostPort] = true
+		}
+		if p.Protocol != portProtocolTCP && p.Protocol != portProtocolUDP {
+			fail("%s: protocol must be %s or %s, got %q", label, portProtocolTCP, portProtocolUDP, p.Protocol)
+		}
+		if p.Name == "" {
+			continue
+		}
+		if !portNamePattern.MatchString(p.Name) {
+			fail("%s: names may only have lowercase letters, digits and dashes inside", label)
+		}
+		if names[p.Name] {
+			fail("%s: defined more than once", label)
+		}
+		names[p.Name] = true
+	}
+}
+
+// newDiscoveryInfo tells the ports of a task with their names and protocols to the frameworks
+// and tools which discover services through Mesos
+func newDiscoveryInfo(j *jobSpec, hostPorts []uint64) *mesos.DiscoveryInfo {
+	if len(hostPorts) == 0 {
+		return nil
+	}
+	info := &mesos.DiscoveryInfo{
+		Visibility: mesos.FRAMEWORK,
+		Name:       proto.String(j.Name),
+		Ports:      &mesos.Ports{},
+	}
+	for i, p := range j.Ports {
+		port := mesos.Port{Number: uint32(hostPorts[i]), Protocol: proto.String(p.Protocol)}
+		if p.Name != "" {
+			port.Name = proto.String(p.Name)
+		}
+		info.Ports.Ports = append(info.Ports.Ports, port)
+	}
+	return info
+}
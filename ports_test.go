@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mesos/mesos-go"
+)
+
+func TestAllocatePorts(t *testing.T) {
+	tests := []struct {
+		name      string
+		available mesos.Ranges
+		specs     []portSpec
+		want      []uint64
+		err       string
+	}{
+		{
+			name:      "sequential from the lowest port",
+			available: mesos.Ranges{{Begin: 31000, End: 31002}},
+			specs:     []portSpec{{}, {}},
+			want:      []uint64{31000, 31001},
+		},
+		{
+			name:      "across ranges",
+			available: mesos.Ranges{{Begin: 31000, End: 31000}, {Begin: 32000, End: 32001}},
+			specs:     []portSpec{{}, {}, {}},
+			want:      []uint64{31000, 32000, 32001},
+		},
+		{
+			name:      "asked for host ports first",
+			available: mesos.Ranges{{Begin: 31000, End: 31002}},
+			specs:     []portSpec{{}, {HostPort: 31000}},
+			want:      []uint64{31001, 31000},
+		},
+		{
+			name:      "asked for host port not offered",
+			available: mesos.Ranges{{Begin: 31000, End: 31002}},
+			specs:     []portSpec{{Name: "http", HostPort: 8080}},
+			err:       `port "http": host port 8080 is not offered or already taken`,
+		},
+		{
+			name:      "too few ports",
+			available: mesos.Ranges{{Begin: 31000, End: 31001}},
+			specs:     []portSpec{{HostPort: 31001}, {}, {}},
+			err:       "needs 2 ports, 1 left",
+		},
+		{
+			name:      "no ports",
+			available: mesos.Ranges{},
+			specs:     []portSpec{{}},
+			err:       "needs 1 ports, 0 left",
+		},
+	}
+	for _, test := range tests {
+		got, err := allocatePorts(test.available, test.specs, portAllocationSequential)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAllocatePortsRandom(t *testing.T) {
+	available := mesos.Ranges{{Begin: 31000, End: 31004}, {Begin: 32000, End: 32004}}
+	for i := 0; i < 100; i++ {
+		got, err := allocatePorts(available, []portSpec{{}, {HostPort: 32002}, {}, {}}, portAllocationRandom)
+		if err != nil {
+			t.Fatalf("unexpected error %s", err)
+		}
+		if got[1] != 32002 {
+			t.Fatalf("got host port %d, want 32002", got[1])
+		}
+		seen := make(map[uint64]bool)
+		for _, port := range got {
+			if seen[port] || available.Search(port) < 0 {
+				t.Fatalf("got %v, ports must be offered and distinct", got)
+			}
+			seen[port] = true
+		}
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []portSpec
+		want  []string
+	}{
+		{
+			name: "valid",
+			ports: []portSpec{
+				{Name: "http", ContainerPort: 8080, Protocol: portProtocolTCP},
+				{Name: "dns-udp", HostPort: 31053, Protocol: portProtocolUDP},
+				{Protocol: portProtocolTCP},
+			},
+		},
+		{
+			name:  "out of range",
+			ports: []portSpec{{ContainerPort: 70000, HostPort: -1, Protocol: portProtocolTCP}},
+			want:  []string{"ports[0]: invalid container port 70000", "ports[0]: invalid host port -1"},
+		},
+		{
+			name:  "host port twice",
+			ports: []portSpec{{HostPort: 31000, Protocol: portProtocolTCP}, {HostPort: 31000, Protocol: portProtocolUDP}},
+			want:  []string{"ports[1]: host port 31000 is asked for more than once"},
+		},
+		{
+			name:  "unknown protocol",
+			ports: []portSpec{{Name: "web", Protocol: "sctp"}},
+			want:  []string{`port "web": protocol must be tcp or udp, got "sctp"`},
+		},
+		{
+			name:  "bad and duplicate names",
+			ports: []portSpec{{Name: "Admin_Port", Protocol: portProtocolTCP}, {Name: "a", Protocol: portProtocolTCP}, {Name: "a", Protocol: portProtocolTCP}},
+			want: []string{
+				`port "Admin_Port": names may only have lowercase letters, digits and dashes inside`,
+				`port "a": defined more than once`,
+			},
+		},
+	}
+	for _, test := range tests {
+		got := []string{}
+		validatePorts(test.ports, func(format string, args ...interface{}) {
+			got = append(got, fmt.Sprintf(format, args...))
+		})
+		if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	jobQueued    = "queued"
+	jobLaunched  = "launched"
+	jobCancelled = "cancelled"
+	jobFailed    = "failed"
+	// jobFinished is a batch job whose task ended without failing
+	jobFinished = "finished"
+	// jobStopped is an instance of a service which was scaled down
+	jobStopped = "stopped"
+	// jobDeleted is a job deleted after its task ended
+	jobDeleted = "deleted"
+)
+
+// maxEndedJobs is how many jobs which ended the queue keeps, the oldest are forgotten
+const maxEndedJobs = 1000
+
+const (
+	serviceInitialBackoff = time.Duration(1) * time.Second
+	serviceMaxBackoff     = time.Duration(5) * time.Minute
+	// serviceBackoffReset is how long a task must have run for its next relaunch to be immediate
+	serviceBackoffReset = time.Duration(1) * time.Minute
+)
+
+var (
+	errJobNotFound     = errors.New("job not found")
+	errJobRunning      = errors.New("job is running, kill its task first")
+	errServiceNotFound = errors.New("service not found")
+	errServiceExists   = errors.New("service already exists")
+	errDeploying       = errors.New("service is being deployed")
+)
+
+// job is one instance of a job spec waiting for, or running on, a task. It goes back into the
+// queue when its task fails.
+type job struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Instance    int       `json:"instance"`
+	State       string    `json:"state"`
+	Attempt     int       `json:"attempt"`
+	TaskID      string    `json:"taskID,omitempty"`
+	SubmittedAt time.Time `json:"submittedAt"`
+	// QueuedAt is when the job last entered the queue, or is allowed to leave it after backoff
+	QueuedAt time.Time `json:"queuedAt"`
+	// Version is the version of the service spec the job runs
+	Version int `json:"version,omitempty"`
+	// Restarts counts the relaunches of a service instance, NotBefore delays the next one
+	Restarts  int        `json:"restarts,omitempty"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	spec      *jobSpec
+	backoff   time.Duration
+}
+
+// volume is the persistent volume of one instance of a stateful job, which outlives its tasks
+type volume struct {
+	ID       string `json:"id"`
+	AgentID  string `json:"agentID"`
+	Hostname string `json:"hostname"`
+	// Created is set once a task ran with the volume or it was offered, until then creating it
+	// may have failed
+	Created bool `json:"created"`
+	// Destroy is set once the job was deleted, the volume is destroyed when its agent offers it
+	Destroy bool `json:"destroy,omitempty"`
+}
+
+// volumeKey identifies the volume of an instance of a job, instances of later versions of a
+// service take over the volumes of the instances they replace
+func volumeKey(name string, instance int) string {
+	return fmt.Sprintf("%s/%d", name, instance)
+}
+
+// service is a service job with its current spec, and the deployment replacing the instances of
+// earlier specs, if there is one
+type service struct {
+	spec        *jobSpec
+	lastVersion int
+	deployment  *deployment
+}
+
+// deployment is a rolling upgrade from one version of a service spec to another
+type deployment struct {
+	from      *jobSpec
+	to        *jobSpec
+	instances int
+	// failures counts the tasks of the new version which ended during the deployment
+	failures  int
+	rollback  bool
+	startedAt time.Time
+}
+
+type deploymentStatus struct {
+	From      int       `json:"from"`
+	To        int       `json:"to"`
+	Failures  int       `json:"failures"`
+	Rollback  bool      `json:"rollback"`
+	StartedAt time.Time `json:"startedAt"`
+}
+
+func (d *deployment) status() *deploymentStatus {
+	return &deploymentStatus{
+		From:      d.from.version,
+		To:        d.to.version,
+		Failures:  d.failures,
+		Rollback:  d.rollback,
+		StartedAt: d.startedAt,
+	}
+}
+
+// serviceStatus is the desired and actual size of a service
+type serviceStatus struct {
+	Name       string            `json:"name"`
+	Version    int               `json:"version"`
+	Instances  int               `json:"instances"`
+	Queued     int               `json:"queued"`
+	Launched   int               `json:"launched"`
+	Deployment *deploymentStatus `json:"deployment,omitempty"`
+}
+
+// commandQueue holds the jobs waiting for offers in FIFO order. It is shared by the driver
+// callbacks and the HTTP API, which run on different goroutines.
+type commandQueue struct {
+	sync.Mutex
+	pending *list.List
+	jobs    map[string]*job
+	lastID  int
+	// services are by name, the Instances of their spec is the desired number of tasks
+	services map[string]*service
+	// volumes are by volumeKey
+	volumes map[string]*volume
+	// ended are the IDs of the jobs which ended in the order they did
+	ended    []string
+	maxEnded int
+}
+
+func newCommandQueue() *commandQueue {
+	return &commandQueue{
+		pending:  list.New(),
+		jobs:     make(map[string]*job),
+		services: make(map[string]*service),
+		volumes:  make(map[string]*volume),
+		maxEnded: maxEndedJobs,
+	}
+}
+
+// submit queues all instances of a job spec. A service must have a name no other service has.
+func (q *commandQueue) submit(spec *jobSpec) ([]job, error) {
+	jobs, _, err := q.submitRunning(spec, nil)
+	return jobs, err
+}
+
+// submitRunning submits a job spec whose first instances still run on the given tasks, which
+// were launched for it before a failover. Only the other instances are queued. The tasks beyond
+// the instances of the job are returned.
+func (q *commandQueue) submitRunning(spec *jobSpec, taskIDs []string) ([]job, []string, error) {
+	q.Lock()
+	defer q.Unlock()
+	if spec.Type == jobTypeService {
+		if _, ok := q.services[spec.Name]; ok {
+			return nil, nil, errServiceExists
+		}
+		spec.version = 1
+		q.services[spec.Name] = &service{spec: spec, lastVersion: 1}
+	}
+	jobs := []job{}
+	for i := 0; i < spec.Instances; i++ {
+		if i < len(taskIDs) {
+			j := q.newJob(spec, i)
+			j.State = jobLaunched
+			j.TaskID = taskIDs[i]
+			jobs = append(jobs, *j)
+			continue
+		}
+		jobs = append(jobs, q.push(spec, i))
+	}
+	if len(taskIDs) > spec.Instances {
+		return jobs, taskIDs[spec.Instances:], nil
+	}
+	return jobs, nil, nil
+}
+
+// push queues one instance of a job spec and returns a snapshot of it, the lock must be held
+func (q *commandQueue) push(spec *jobSpec, instance int) job {
+	j := q.newJob(spec, instance)
+	q.pending.PushBack(j)
+	return *j
+}
+
+// newJob adds a queued instance of a job spec without putting it into the queue, the lock must
+// be held
+func (q *commandQueue) newJob(spec *jobSpec, instance int) *job {
+	q.lastID++
+	j := &job{
+		ID:          fmt.Sprintf("job-%d", q.lastID),
+		Name:        spec.Name,
+		Instance:    instance,
+		Version:     spec.version,
+		spec:        spec,
+		State:       jobQueued,
+		SubmittedAt: time.Now(),
+	}
+	j.QueuedAt = j.SubmittedAt
+	q.jobs[j.ID] = j
+	return j
+}
+
+// pop takes the first queued job which fits and is not backing off out of the queue and marks
+// it launched. Jobs with a volume fit with the volume of their instance, if it has one.
+func (q *commandQueue) pop(fits func(*jobSpec, *volume) bool) (job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	for e := q.pending.Front(); e != nil; e = e.Next() {
+		j := e.Value.(*job)
+		var v *volume
+		if j.spec.Volume != nil {
+			if existing, ok := q.volumes[volumeKey(j.Name, j.Instance)]; ok {
+				c := *existing
+				v = &c
+			}
+		}
+		if (j.NotBefore != nil && now.Before(*j.NotBefore)) || !fits(j.spec, v) {
+			continue
+		}
+		q.pending.Remove(e)
+		j.State = jobLaunched
+		return *j, true
+	}
+	return job{}, false
+}
+
+// setTask remembers which task runs the job
+func (q *commandQueue) setTask(id, taskID string) {
+	q.Lock()
+	defer q.Unlock()
+	if j, ok := q.jobs[id]; ok {
+		j.TaskID = taskID
+	}
+}
+
+// requeue puts a job back at the front of the queue whose task was never launched, as if it had
+// not been popped
+func (q *commandQueue) requeue(id, taskID string) {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	if !ok || j.State != jobLaunched || j.TaskID != taskID {
+		return
+	}
+	j.State = jobQueued
+	j.TaskID = ""
+	q.pending.PushFront(j)
+}
+
+// retry puts a launched job back at the end of the queue, unless it ran out of attempts
+func (q *commandQueue) retry(id string, maxRetries int) (job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	if !ok || j.State != jobLaunched {
+		return job{}, false
+	}
+	if j.Attempt >= maxRetries {
+		q.end(j, jobFailed)
+		return *j, false
+	}
+	j.Attempt++
+	j.State = jobQueued
+	j.QueuedAt = time.Now()
+	q.pending.PushBack(j)
+	return *j, true
+}
+
+// relaunch puts an instance of a service whose task ended back into the queue. The relaunch is
+// delayed with exponential backoff, unless the task ran for long enough to count as healthy.
+// Instances which were scaled down are not relaunched, nor are instances of the version a
+// deployment replaces. Instances of the version it deploys count as failures of the deployment.
+func (q *commandQueue) relaunch(id string, ranFor time.Duration) (job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	if !ok || j.State != jobLaunched {
+		return job{}, false
+	}
+	if svc, ok := q.services[j.Name]; ok && svc.deployment != nil {
+		d := svc.deployment
+		if j.spec != d.to {
+			q.end(j, jobStopped)
+			return *j, false
+		}
+		d.failures++
+	}
+	if ranFor >= serviceBackoffReset {
+		j.backoff = 0
+	}
+	notBefore := time.Now().Add(j.backoff)
+	j.NotBefore = &notBefore
+	j.backoff *= 2
+	if j.backoff == 0 {
+		j.backoff = serviceInitialBackoff
+	}
+	if j.backoff > serviceMaxBackoff {
+		j.backoff = serviceMaxBackoff
+	}
+	j.Restarts++
+	j.State = jobQueued
+	j.QueuedAt = notBefore
+	q.pending.PushBack(j)
+	return *j, true
+}
+
+func (q *commandQueue) isService(id string) bool {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	return ok && j.spec.Type == jobTypeService
+}
+
+// scale changes the number of instances of a service. Missing instances are queued, instances
+// beyond the new number are stopped; those which were launched are returned, their tasks have
+// to be killed.
+func (q *commandQueue) scale(name string, instances int) ([]job, error) {
+	q.Lock()
+	defer q.Unlock()
+	svc, ok := q.services[name]
+	if !ok {
+		return nil, errServiceNotFound
+	}
+	if svc.deployment != nil {
+		return nil, errDeploying
+	}
+	spec := svc.spec
+	spec.Instances = instances
+
+	active := make(map[int]bool)
+	stopped := []job{}
+	for _, j := range q.jobs {
+		if j.spec != spec || (j.State != jobQueued && j.State != jobLaunched) {
+			continue
+		}
+		if j.Instance < instances {
+			active[j.Instance] = true
+			continue
+		}
+		if j.State == jobLaunched {
+			stopped = append(stopped, *j)
+		} else {
+			q.remove(j)
+		}
+		q.end(j, jobStopped)
+	}
+	for i := 0; i < instances; i++ {
+		if !active[i] {
+			q.push(spec, i)
+		}
+	}
+	return stopped, nil
+}
+
+// serviceStatuses returns every service, ordered by name
+func (q *commandQueue) serviceStatuses() []serviceStatus {
+	q.Lock()
+	defer q.Unlock()
+	statuses := []serviceStatus{}
+	for name, svc := range q.services {
+		status := serviceStatus{Name: name, Version: svc.spec.version, Instances: svc.spec.Instances}
+		if svc.deployment != nil {
+			status.Deployment = svc.deployment.status()
+		}
+		for _, j := range q.jobs {
+			if j.Name != name || j.spec.Type != jobTypeService {
+				continue
+			}
+			switch j.State {
+			case jobQueued:
+				status.Queued++
+			case jobLaunched:
+				status.Launched++
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// deploy starts a rolling upgrade of a service to a new version of its spec
+func (q *commandQueue) deploy(spec *jobSpec) (*deploymentStatus, error) {
+	q.Lock()
+	defer q.Unlock()
+	svc, ok := q.services[spec.Name]
+	if !ok {
+		return nil, errServiceNotFound
+	}
+	if svc.deployment != nil {
+		return nil, errDeploying
+	}
+	svc.lastVersion++
+	spec.version = svc.lastVersion
+	svc.deployment = &deployment{from: svc.spec, to: spec, instances: spec.Instances, startedAt: time.Now()}
+	svc.spec = spec
+	return svc.deployment.status(), nil
+}
+
+// deployments returns the names of the services which are being deployed
+func (q *commandQueue) deployments() []string {
+	q.Lock()
+	defer q.Unlock()
+	names := []string{}
+	for name, svc := range q.services {
+		if svc.deployment != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// deploymentState returns a snapshot of the deployment of a service together with all of its
+// queued and launched instances, whatever their version
+func (q *commandQueue) deploymentState(name string) (deployment, []job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	svc, ok := q.services[name]
+	if !ok || svc.deployment == nil {
+		return deployment{}, nil, false
+	}
+	jobs := []job{}
+	for _, j := range q.jobs {
+		if j.Name == name && j.spec.Type == jobTypeService && (j.State == jobQueued || j.State == jobLaunched) {
+			jobs = append(jobs, *j)
+		}
+	}
+	return *svc.deployment, jobs, true
+}
+
+// addInstance queues an instance of the version a service is being deployed to
+func (q *commandQueue) addInstance(name string, instance int) (job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	svc, ok := q.services[name]
+	if !ok || svc.deployment == nil {
+		return job{}, false
+	}
+	return q.push(svc.deployment.to, instance), true
+}
+
+// stop stops an instance of a service and returns it as it was before
+func (q *commandQueue) stop(id string) (job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	if !ok || (j.State != jobQueued && j.State != jobLaunched) {
+		return job{}, false
+	}
+	before := *j
+	if j.State == jobQueued {
+		q.remove(j)
+	}
+	q.end(j, jobStopped)
+	return before, true
+}
+
+// finish marks a batch job finished whose task ended without failing
+func (q *commandQueue) finish(id, taskID string) (job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	if !ok || j.State != jobLaunched || j.TaskID != taskID {
+		return job{}, false
+	}
+	q.end(j, jobFinished)
+	return *j, true
+}
+
+// end puts a job into a state it never leaves, and forgets the jobs which ended before the last
+// maxEnded ones. A job which ended already, e.g. a failed job being deleted, only changes its
+// state. The lock must be held.
+func (q *commandQueue) end(j *job, state string) {
+	ended := j.State != jobQueued && j.State != jobLaunched
+	j.State = state
+	if ended {
+		return
+	}
+	q.ended = append(q.ended, j.ID)
+	for len(q.ended) > q.maxEnded {
+		delete(q.jobs, q.ended[0])
+		q.ended = q.ended[1:]
+	}
+}
+
+// rollback turns a deployment around, back to the version it started from
+func (q *commandQueue) rollback(name string) {
+	q.Lock()
+	defer q.Unlock()
+	svc, ok := q.services[name]
+	if !ok || svc.deployment == nil {
+		return
+	}
+	d := svc.deployment
+	d.from, d.to = d.to, d.from
+	d.instances = d.to.Instances
+	d.failures = 0
+	d.rollback = true
+	svc.spec = d.to
+}
+
+// endDeployment finishes the deployment of a service
+func (q *commandQueue) endDeployment(name string) {
+	q.Lock()
+	defer q.Unlock()
+	if svc, ok := q.services[name]; ok {
+		svc.deployment = nil
+	}
+}
+
+// remove takes a queued job out of the pending list, the lock must be held
+func (q *commandQueue) remove(j *job) {
+	for e := q.pending.Front(); e != nil; e = e.Next() {
+		if e.Value.(*job) == j {
+			q.pending.Remove(e)
+			return
+		}
+	}
+}
+
+// delete deletes a job which is queued or whose task ended, running says whether it has a task
+// which did not end yet. The volume of the job is destroyed.
+func (q *commandQueue) delete(id string, running bool) (job, error) {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, errJobNotFound
+	}
+	switch j.State {
+	case jobQueued:
+		q.remove(j)
+		q.end(j, jobCancelled)
+	case jobLaunched:
+		if running {
+			return *j, errJobRunning
+		}
+		q.end(j, jobDeleted)
+	case jobFailed, jobFinished, jobStopped:
+		q.end(j, jobDeleted)
+	default:
+		return *j, errJobNotFound
+	}
+	if v, ok := q.volumes[volumeKey(j.Name, j.Instance)]; ok && j.spec.Volume != nil {
+		v.Destroy = true
+	}
+	return *j, nil
+}
+
+// volume returns the volume of an instance of a job
+func (q *commandQueue) volume(name string, instance int) (volume, bool) {
+	q.Lock()
+	defer q.Unlock()
+	v, ok := q.volumes[volumeKey(name, instance)]
+	if !ok {
+		return volume{}, false
+	}
+	return *v, true
+}
+
+// setVolume remembers the volume a task of an instance of a job is launched with
+func (q *commandQueue) setVolume(name string, instance int, v volume) {
+	q.Lock()
+	defer q.Unlock()
+	q.volumes[volumeKey(name, instance)] = &v
+}
+
+// volumeCreated marks a volume as existing
+func (q *commandQueue) volumeCreated(id string) {
+	q.Lock()
+	defer q.Unlock()
+	for _, v := range q.volumes {
+		if v.ID == id {
+			v.Created = true
+		}
+	}
+}
+
+// volumeOffered records a volume found in an offer and returns whether it is to be destroyed.
+// Volumes we don't know about, e.g. after a restart, are adopted by the instance of the job they
+// were created for.
+func (q *commandQueue) volumeOffered(key string, v volume) bool {
+	q.Lock()
+	defer q.Unlock()
+	existing, ok := q.volumes[key]
+	if !ok {
+		v.Created = true
+		q.volumes[key] = &v
+		return false
+	}
+	if existing.ID != v.ID || existing.AgentID != v.AgentID {
+		return false
+	}
+	existing.Created = true
+	return existing.Destroy
+}
+
+// forgetVolume forgets a volume which was never created, e.g. because the operations creating
+// it were not accepted
+func (q *commandQueue) forgetVolume(key, id string) {
+	q.Lock()
+	defer q.Unlock()
+	if v, ok := q.volumes[key]; ok && v.ID == id && !v.Created {
+		delete(q.volumes, key)
+	}
+}
+
+// agentVolumesLost forgets the volumes which were being created on a lost agent and returns
+// their IDs, the instances get new ones elsewhere. Volumes which exist stay, the agent may
+// come back.
+func (q *commandQueue) agentVolumesLost(agentID string) []string {
+	q.Lock()
+	defer q.Unlock()
+	ids := []string{}
+	for key, v := range q.volumes {
+		if v.AgentID == agentID && !v.Created {
+			ids = append(ids, v.ID)
+			delete(q.volumes, key)
+		}
+	}
+	return ids
+}
+
+// volumeDestroyed forgets a volume
+func (q *commandQueue) volumeDestroyed(key string) {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.volumes, key)
+}
+
+func (q *commandQueue) get(id string) (job, bool) {
+	q.Lock()
+	defer q.Unlock()
+	j, ok := q.jobs[id]
+	if !ok {
+		return job{}, false
+	}
+	return *j, true
+}
+
+// queued returns the jobs waiting for offers, in the order they will be launched
+func (q *commandQueue) queued() []job {
+	q.Lock()
+	defer q.Unlock()
+	jobs := []job{}
+	for e := q.pending.Front(); e != nil; e = e.Next() {
+		jobs = append(jobs, *e.Value.(*job))
+	}
+	return jobs
+}
+
+func (q *commandQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+	return q.pending.Len()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func fitsAll(*jobSpec, *volume) bool { return true }
+
+// launchNow launches a queued job right away, whatever its backoff
+func launchNow(q *commandQueue, id string) {
+	q.Lock()
+	defer q.Unlock()
+	j := q.jobs[id]
+	q.remove(j)
+	j.State = jobLaunched
+}
+
+func instances(jobs []job) []int {
+	numbers := []int{}
+	for _, j := range jobs {
+		numbers = append(numbers, j.Instance)
+	}
+	return numbers
+}
+
+func TestCommandQueueScale(t *testing.T) {
+	tests := []struct {
+		name     string
+		launched int
+		scaleTo  int
+		stopped  []int
+		queued   []int
+		running  int
+	}{
+		{name: "up", launched: 2, scaleTo: 5, stopped: []int{}, queued: []int{2, 3, 4}, running: 2},
+		{name: "same", launched: 1, scaleTo: 3, stopped: []int{}, queued: []int{1, 2}, running: 1},
+		{name: "down, stopping launched instances", launched: 3, scaleTo: 1, stopped: []int{1, 2}, queued: []int{}, running: 1},
+		{name: "down, dropping queued instances", launched: 1, scaleTo: 2, stopped: []int{}, queued: []int{1}, running: 1},
+		{name: "to zero", launched: 0, scaleTo: 0, stopped: []int{}, queued: []int{}, running: 0},
+	}
+	for _, test := range tests {
+		q := newCommandQueue()
+		if _, err := q.submit(testJob(t, `{"name": "web", "type": "service", "instances": 3, "cmd": "x"}`)); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < test.launched; i++ {
+			q.pop(fitsAll)
+		}
+		stopped, err := q.scale("web", test.scaleTo)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", test.name, err)
+			continue
+		}
+		got := instances(stopped)
+		// stopped instances come in map order
+		sort.Ints(got)
+		if fmt.Sprint(got) != fmt.Sprint(test.stopped) {
+			t.Errorf("%s: stopped %v, want %v", test.name, got, test.stopped)
+		}
+		if got := instances(q.queued()); fmt.Sprint(got) != fmt.Sprint(test.queued) {
+			t.Errorf("%s: queued %v, want %v", test.name, got, test.queued)
+		}
+		status := q.serviceStatuses()[0]
+		if status.Instances != test.scaleTo || status.Launched != test.running {
+			t.Errorf("%s: got %d instances with %d launched, want %d with %d",
+				test.name, status.Instances, status.Launched, test.scaleTo, test.running)
+		}
+	}
+}
+
+func TestCommandQueueRelaunch(t *testing.T) {
+	q := newCommandQueue()
+	jobs, _ := q.submit(testJob(t, `{"name": "web", "type": "service", "instances": 1, "cmd": "x"}`))
+	id := jobs[0].ID
+	steps := []struct {
+		ranFor time.Duration
+		delay  time.Duration
+	}{
+		{ranFor: time.Second, delay: 0},
+		{ranFor: time.Second, delay: serviceInitialBackoff},
+		{ranFor: time.Second, delay: 2 * serviceInitialBackoff},
+		{ranFor: time.Second, delay: 4 * serviceInitialBackoff},
+		// a task which ran long enough resets the backoff
+		{ranFor: serviceBackoffReset, delay: 0},
+		{ranFor: time.Second, delay: serviceInitialBackoff},
+	}
+	for i, step := range steps {
+		launchNow(q, id)
+		before := time.Now()
+		j, ok := q.relaunch(id, step.ranFor)
+		if !ok {
+			t.Fatalf("relaunch %d: not relaunched", i)
+		}
+		if delay := j.NotBefore.Sub(before); delay < step.delay || delay > step.delay+time.Second/2 {
+			t.Errorf("relaunch %d: delayed by %s, want %s", i, delay, step.delay)
+		}
+		if j.Restarts != i+1 || j.State != jobQueued {
+			t.Errorf("relaunch %d: got %d restarts and state %s", i, j.Restarts, j.State)
+		}
+	}
+
+	j := q.jobs[id]
+	j.backoff = serviceMaxBackoff
+	launchNow(q, id)
+	q.relaunch(id, time.Second)
+	if j.backoff != serviceMaxBackoff {
+		t.Errorf("got backoff %s, want at most %s", j.backoff, serviceMaxBackoff)
+	}
+}
+
+func TestCommandQueueScaleErrors(t *testing.T) {
+	q := newCommandQueue()
+	if _, err := q.scale("web", 1); err != errServiceNotFound {
+		t.Errorf("unknown service: got %v, want %v", err, errServiceNotFound)
+	}
+	q.submit(testJob(t, `{"name": "web", "type": "service", "instances": 1, "cmd": "x"}`))
+	q.deploy(testJob(t, `{"name": "web", "type": "service", "instances": 1, "cmd": "y"}`))
+	if _, err := q.scale("web", 2); err != errDeploying {
+		t.Errorf("deploying service: got %v, want %v", err, errDeploying)
+	}
+}
+
+func TestCommandQueueRelaunchSkipped(t *testing.T) {
+	q := newCommandQueue()
+	jobs, _ := q.submit(testJob(t, `{"name": "web", "type": "service", "instances": 2, "cmd": "x"}`))
+	if _, ok := q.relaunch(jobs[0].ID, time.Second); ok {
+		t.Errorf("queued instance relaunched")
+	}
+	if _, ok := q.relaunch("job-99", time.Second); ok {
+		t.Errorf("unknown job relaunched")
+	}
+
+	launchNow(q, jobs[1].ID)
+	q.scale("web", 1)
+	if _, ok := q.relaunch(jobs[1].ID, time.Second); ok {
+		t.Errorf("instance which was scaled down relaunched")
+	}
+
+	launchNow(q, jobs[0].ID)
+	q.deploy(testJob(t, `{"name": "web", "type": "service", "instances": 1, "cmd": "y"}`))
+	if _, ok := q.relaunch(jobs[0].ID, time.Second); ok {
+		t.Errorf("instance of the version being replaced relaunched")
+	}
+	if j, _ := q.get(jobs[0].ID); j.State != jobStopped {
+		t.Errorf("replaced instance is %s, want %s", j.State, jobStopped)
+	}
+	added, _ := q.addInstance("web", 0)
+	launchNow(q, added.ID)
+	if _, ok := q.relaunch(added.ID, time.Second); !ok {
+		t.Errorf("instance of the new version not relaunched")
+	}
+	if d, _, _ := q.deploymentState("web"); d.failures != 1 {
+		t.Errorf("got %d deployment failures, want 1", d.failures)
+	}
+}
+
+func TestCommandQueuePrunesEndedJobs(t *testing.T) {
+	q := newCommandQueue()
+	q.maxEnded = 2
+	spec := testJob(t, `{"name": "batch", "cmd": "true", "instances": 5}`)
+	jobs, err := q.submit(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jobs[:4] {
+		launchNow(q, j.ID)
+		q.setTask(j.ID, "task-"+j.ID)
+	}
+
+	steps := []struct {
+		name  string
+		end   func() (job, bool)
+		state string
+	}{
+		{name: "finished", end: func() (job, bool) { return q.finish(jobs[0].ID, "task-"+jobs[0].ID) }, state: jobFinished},
+		{name: "gave up", end: func() (job, bool) { return q.retry(jobs[1].ID, 0) }, state: jobFailed},
+		{name: "finished twice", end: func() (job, bool) { return q.finish(jobs[1].ID, "task-"+jobs[1].ID) }},
+		{name: "another task", end: func() (job, bool) { return q.finish(jobs[2].ID, "other") }},
+		{name: "finished last", end: func() (job, bool) { return q.finish(jobs[2].ID, "task-"+jobs[2].ID) }, state: jobFinished},
+		{name: "deleted after it failed", end: func() (job, bool) {
+			j, err := q.delete(jobs[1].ID, false)
+			return j, err == nil
+		}, state: jobDeleted},
+	}
+	for _, step := range steps {
+		j, _ := step.end()
+		if j.State != step.state {
+			t.Errorf("%s: got state %q, want %q", step.name, j.State, step.state)
+		}
+	}
+
+	for i, kept := range []bool{false, true, true, true, true} {
+		if _, ok := q.get(jobs[i].ID); ok != kept {
+			t.Errorf("job %d: kept is %t, want %t", i, ok, kept)
+		}
+	}
+}
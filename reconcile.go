@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mesos/mesos-go"
+)
+
+const (
+	reconcileInitialBackoff = time.Duration(1) * time.Second
+	reconcileMaxBackoff     = time.Duration(60) * time.Second
+	// reconcileSettle is how long the master gets to answer the implicit reconciliation, the
+	// answers have no end
+	reconcileSettle = time.Duration(5) * time.Second
+)
+
+// reconciler runs at most one reconciliation at a time, a new one cancels the running one
+type reconciler struct {
+	sync.Mutex
+	stop chan struct{}
+}
+
+// start cancels any running reconciliation and starts a new one in the background, which calls
+// reconciled once the master had time to answer it
+func (r *reconciler) start(driver schedulerDriver, tasks *taskRegistry, reconciled func()) {
+	r.Lock()
+	defer r.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+	}
+	r.stop = make(chan struct{})
+	go r.run(driver, tasks, reconciled, r.stop)
+}
+
+// run does explicit reconciliation for every non-terminal task we know about, retrying with
+// backoff until each of them got a status update after we started, then asks the master for
+// everything else with an implicit reconciliation.
+func (r *reconciler) run(driver schedulerDriver, tasks *taskRegistry, reconciled func(), stop chan struct{}) {
+	started := time.Now()
+	backoff := reconcileInitialBackoff
+	for {
+		pending := tasks.list(func(t *taskRecord) bool {
+			return !isTerminal(t.state) && t.updatedAt.Before(started)
+		})
+		if len(pending) == 0 {
+			break
+		}
+
+		statuses := []mesos.TaskStatus{}
+		for _, task := range pending {
+			status := mesos.TaskStatus{
+				TaskID: mesos.TaskID{Value: task.taskID},
+				State:  task.state.Enum(),
+			}
+			if task.slaveID != "" {
+				status.AgentID = &mesos.AgentID{Value: task.slaveID}
+			}
+			statuses = append(statuses, status)
+		}
+		log.WithFields(log.Fields{"tasks": len(statuses), "backoff": backoff.String()}).Info("explicit reconciliation")
+		if err := driver.ReconcileTasks(statuses); err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("explicit reconciliation failed")
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > reconcileMaxBackoff {
+			backoff = reconcileMaxBackoff
+		}
+	}
+
+	log.Info("implicit reconciliation")
+	if err := driver.ReconcileTasks([]mesos.TaskStatus{}); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("implicit reconciliation failed")
+	}
+	select {
+	case <-stop:
+	case <-time.After(reconcileSettle):
+		reconciled()
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mesos/mesos-go"
+)
+
+// reconcileDriver answers each explicit reconciliation with the states asked for, except for the
+// tasks in silent the first time, and stops the reconciliation at the implicit one
+type reconcileDriver struct {
+	schedulerDriver
+	tasks  *taskRegistry
+	silent map[string]bool
+	stop   chan struct{}
+	calls  []string
+}
+
+func (d *reconcileDriver) ReconcileTasks(statuses []mesos.TaskStatus) error {
+	if len(statuses) == 0 {
+		d.calls = append(d.calls, "implicit")
+		close(d.stop)
+		return nil
+	}
+	asked := []string{}
+	for _, status := range statuses {
+		task := fmt.Sprintf("%s %s", status.TaskID.Value, status.GetState())
+		if status.AgentID != nil {
+			task += " on " + status.AgentID.Value
+		}
+		asked = append(asked, task)
+		if d.silent[status.TaskID.Value] {
+			delete(d.silent, status.TaskID.Value)
+			continue
+		}
+		d.tasks.update(status)
+	}
+	sort.Strings(asked)
+	d.calls = append(d.calls, strings.Join(asked, ", "))
+	return nil
+}
+
+func TestReconcilerRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []mesos.TaskStatus
+		silent   []string
+		calls    []string
+	}{
+		{
+			name:  "no tasks",
+			calls: []string{"implicit"},
+		},
+		{
+			name: "explicit before implicit, without tasks which ended",
+			statuses: []mesos.TaskStatus{
+				{TaskID: mesos.TaskID{Value: "t1"}, State: mesos.TASK_RUNNING.Enum(), AgentID: &mesos.AgentID{Value: "a1"}},
+				{TaskID: mesos.TaskID{Value: "t2"}, State: mesos.TASK_STAGING.Enum()},
+				{TaskID: mesos.TaskID{Value: "t3"}, State: mesos.TASK_FINISHED.Enum(), AgentID: &mesos.AgentID{Value: "a1"}},
+			},
+			calls: []string{"t1 TASK_RUNNING on a1, t2 TASK_STAGING", "implicit"},
+		},
+		{
+			name: "unanswered tasks are asked for again",
+			statuses: []mesos.TaskStatus{
+				{TaskID: mesos.TaskID{Value: "t1"}, State: mesos.TASK_RUNNING.Enum(), AgentID: &mesos.AgentID{Value: "a1"}},
+				{TaskID: mesos.TaskID{Value: "t2"}, State: mesos.TASK_RUNNING.Enum(), AgentID: &mesos.AgentID{Value: "a2"}},
+			},
+			silent: []string{"t2"},
+			calls:  []string{"t1 TASK_RUNNING on a1, t2 TASK_RUNNING on a2", "t2 TASK_RUNNING on a2", "implicit"},
+		},
+	}
+	for _, test := range tests {
+		tasks := newTaskRegistry()
+		for _, status := range test.statuses {
+			tasks.update(status)
+		}
+		d := &reconcileDriver{tasks: tasks, silent: make(map[string]bool), stop: make(chan struct{})}
+		for _, taskID := range test.silent {
+			d.silent[taskID] = true
+		}
+		// the reconciliation starts after the tasks were last updated
+		time.Sleep(time.Millisecond)
+
+		reconciled := false
+		r := &reconciler{}
+		r.run(d, tasks, func() { reconciled = true }, d.stop)
+		if fmt.Sprint(d.calls) != fmt.Sprint(test.calls) {
+			t.Errorf("%s: got calls %q, want %q", test.name, d.calls, test.calls)
+		}
+		if reconciled {
+			t.Errorf("%s: reconciled after the reconciliation was stopped", test.name)
+		}
+	}
+}
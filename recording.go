@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mesos/mesos-go"
+)
+
+// recordingVersion is bumped whenever recordings change in a way older replays can't read
+const recordingVersion = 1
+
+// eventDisconnected has no event of the scheduler API, it marks a broken subscription in a recording
+const eventDisconnected = "DISCONNECTED"
+
+// A recording is a file of JSON lines. The first line is a recordingHeader, every other line a
+// recordedEvent with either a callback of the scheduler, in the form of the API event which caused
+// it, or an ACCEPT call the scheduler made, so that a replay can tell which tasks were launched.
+type recordingHeader struct {
+	Version   int                 `json:"version"`
+	Started   time.Time           `json:"started"`
+	Framework mesos.FrameworkInfo `json:"framework"`
+}
+
+type recordedEvent struct {
+	Time  time.Time       `json:"time"`
+	Event *schedulerEvent `json:"event,omitempty"`
+	Call  *schedulerCall  `json:"call,omitempty"`
+}
+
+// recorder writes a recording, for all drivers of a run, so reconnects end up in the same file
+type recorder struct {
+	sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newRecorder(path string, framework mesos.FrameworkInfo) (*recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &recorder{file: file, encoder: json.NewEncoder(file)}
+	header := recordingHeader{Version: recordingVersion, Started: time.Now(), Framework: framework}
+	if err := r.encoder.Encode(header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *recorder) record(e recordedEvent) {
+	e.Time = time.Now()
+	r.Lock()
+	defer r.Unlock()
+	if err := r.encoder.Encode(e); err != nil {
+		log.WithFields(log.Fields{"file": r.file.Name(), "err": err}).Error("record event failed")
+	}
+}
+
+func (r *recorder) event(e *schedulerEvent) {
+	r.record(recordedEvent{Event: e})
+}
+
+func (r *recorder) close() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.file.Close()
+}
+
+// newRecordingDriverFactory records every callback of the drivers which connect creates
+func newRecordingDriverFactory(connect driverFactory, r *recorder) driverFactory {
+	return func(master string, framework mesos.FrameworkInfo, sched scheduler) schedulerDriver {
+		return connect(master, framework, &recordingScheduler{sched: sched, recorder: r})
+	}
+}
+
+// recordingScheduler writes each callback to the recording before passing it on. The scheduler
+// gets a recordingDriver, which records the offers it accepts.
+type recordingScheduler struct {
+	sched    scheduler
+	recorder *recorder
+}
+
+func (s *recordingScheduler) wrap(driver schedulerDriver) schedulerDriver {
+	return &recordingDriver{schedulerDriver: driver, recorder: s.recorder}
+}
+
+func (s *recordingScheduler) Registered(driver schedulerDriver, frameworkID mesos.FrameworkID, masterInfo *mesos.MasterInfo) {
+	s.recorder.event(&schedulerEvent{
+		Type:       eventSubscribed,
+		Subscribed: &subscribedEvent{FrameworkID: frameworkID, MasterInfo: masterInfo},
+	})
+	s.sched.Registered(s.wrap(driver), frameworkID, masterInfo)
+}
+
+func (s *recordingScheduler) Disconnected(driver schedulerDriver) {
+	s.recorder.event(&schedulerEvent{Type: eventDisconnected})
+	s.sched.Disconnected(s.wrap(driver))
+}
+
+func (s *recordingScheduler) ResourceOffers(driver schedulerDriver, offers []mesos.Offer) {
+	s.recorder.event(&schedulerEvent{Type: eventOffers, Offers: &offersEvent{Offers: offers}})
+	s.sched.ResourceOffers(s.wrap(driver), offers)
+}
+
+func (s *recordingScheduler) OfferRescinded(driver schedulerDriver, offerID mesos.OfferID) {
+	s.recorder.event(&schedulerEvent{Type: eventRescind, Rescind: &rescindEvent{OfferID: offerID}})
+	s.sched.OfferRescinded(s.wrap(driver), offerID)
+}
+
+func (s *recordingScheduler) StatusUpdate(driver schedulerDriver, status mesos.TaskStatus) {
+	s.recorder.event(&schedulerEvent{Type: eventUpdate, Update: &updateEvent{Status: status}})
+	s.sched.StatusUpdate(s.wrap(driver), status)
+}
+
+func (s *recordingScheduler) FrameworkMessage(driver schedulerDriver, executorID mesos.ExecutorID, agentID mesos.AgentID, data []byte) {
+	s.recorder.event(&schedulerEvent{
+		Type:    eventMessage,
+		Message: &messageEvent{AgentID: agentID, ExecutorID: executorID, Data: data},
+	})
+	s.sched.FrameworkMessage(s.wrap(driver), executorID, agentID, data)
+}
+
+func (s *recordingScheduler) SlaveLost(driver schedulerDriver, agentID mesos.AgentID) {
+	s.recorder.event(&schedulerEvent{Type: eventFailure, Failure: &failureEvent{AgentID: &agentID}})
+	s.sched.SlaveLost(s.wrap(driver), agentID)
+}
+
+func (s *recordingScheduler) ExecutorLost(driver schedulerDriver, executorID mesos.ExecutorID, agentID mesos.AgentID, status int) {
+	code := int32(status)
+	s.recorder.event(&schedulerEvent{
+		Type:    eventFailure,
+		Failure: &failureEvent{AgentID: &agentID, ExecutorID: &executorID, Status: &code},
+	})
+	s.sched.ExecutorLost(s.wrap(driver), executorID, agentID, status)
+}
+
+func (s *recordingScheduler) Error(driver schedulerDriver, message string) {
+	s.recorder.event(&schedulerEvent{Type: eventError, Error: &errorEvent{Message: message}})
+	s.sched.Error(s.wrap(driver), message)
+}
+
+// recordingDriver records the ACCEPT calls of the scheduler, all other calls go straight through
+type recordingDriver struct {
+	schedulerDriver
+	recorder *recorder
+}
+
+func (d *recordingDriver) AcceptOffers(offerIDs []mesos.OfferID, operations []mesos.Offer_Operation, filters *mesos.Filters) error {
+	d.recorder.record(recordedEvent{Call: &schedulerCall{
+		Type:   callAccept,
+		Accept: &acceptCall{OfferIDs: offerIDs, Operations: operations, Filters: filters},
+	}})
+	return d.schedulerDriver.AcceptOffers(offerIDs, operations, filters)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/mesos/mesos-go"
+)
+
+// recording is a recording read back for a replay
+type recording struct {
+	header recordingHeader
+	events []recordedEvent
+}
+
+func loadRecording(path string) (*recording, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r := &recording{}
+	decoder := json.NewDecoder(file)
+	if err := decoder.Decode(&r.header); err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+	if r.header.Version != recordingVersion {
+		return nil, fmt.Errorf("unsupported recording version %d, expected %d", r.header.Version, recordingVersion)
+	}
+	for {
+		var e recordedEvent
+		if err := decoder.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid event %d: %s", len(r.events)+1, err)
+		}
+		r.events = append(r.events, e)
+	}
+	return r, nil
+}
+
+// replayDecision is a call the scheduler made during a replay. Line is the line of the recording
+// whose callback the scheduler was handling, Time when that callback was recorded.
+type replayDecision struct {
+	Line     int       `json:"line"`
+	Time     time.Time `json:"time"`
+	Call     string    `json:"call"`
+	OfferID  string    `json:"offerID,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Task     string    `json:"task,omitempty"`
+	TaskID   string    `json:"taskID,omitempty"`
+	// RecordedTaskID is the task the recorded run launched on the same offer under the same name
+	RecordedTaskID string `json:"recordedTaskID,omitempty"`
+}
+
+// newReplayDriverFactory replays the recording instead of connecting to the detected master, and
+// writes the decisions of the scheduler to report as JSON lines, if it is not nil
+func newReplayDriverFactory(rec *recording, report io.Writer) driverFactory {
+	return func(_ string, _ mesos.FrameworkInfo, sched scheduler) schedulerDriver {
+		return newReplayDriver(rec, sched, report)
+	}
+}
+
+// replayDriver feeds the callbacks of a recording into the scheduler, one after the other without
+// waiting in between, and reports the calls the scheduler makes in response. Tasks the scheduler
+// launches like the recorded run did take over the status updates of the recorded tasks, all
+// other recorded updates reach the scheduler unchanged.
+type replayDriver struct {
+	sync.Mutex
+	rec    *recording
+	sched  scheduler
+	report *json.Encoder
+	// current is the index of the event being replayed
+	current int
+	offers  map[string]mesos.Offer
+	// recordedLaunches are the tasks the recorded run launched, by offer ID
+	recordedLaunches map[string][]mesos.TaskInfo
+	// taskIDs maps recorded task IDs to the IDs of the tasks launched in their place
+	taskIDs  map[string]string
+	launches int
+	declines int
+	matched  int
+	hosts    map[string]int
+	stopped  bool
+}
+
+func newReplayDriver(rec *recording, sched scheduler, report io.Writer) *replayDriver {
+	d := &replayDriver{
+		rec:              rec,
+		sched:            sched,
+		offers:           map[string]mesos.Offer{},
+		recordedLaunches: map[string][]mesos.TaskInfo{},
+		taskIDs:          map[string]string{},
+		hosts:            map[string]int{},
+	}
+	if report != nil {
+		d.report = json.NewEncoder(report)
+	}
+	for _, e := range rec.events {
+		if e.Call == nil || e.Call.Type != callAccept || e.Call.Accept == nil || len(e.Call.Accept.OfferIDs) == 0 {
+			continue
+		}
+		offerID := e.Call.Accept.OfferIDs[0].Value
+		for _, op := range e.Call.Accept.Operations {
+			if op.Launch != nil {
+				d.recordedLaunches[offerID] = append(d.recordedLaunches[offerID], op.Launch.TaskInfos...)
+			}
+		}
+	}
+	return d
+}
+
+func (d *replayDriver) Run() error {
+	log.WithFields(log.Fields{
+		"version": d.rec.header.Version,
+		"started": d.rec.header.Started,
+		"events":  len(d.rec.events),
+	}).Info("replaying recording")
+	for i, e := range d.rec.events {
+		d.Lock()
+		if d.stopped {
+			d.Unlock()
+			return nil
+		}
+		d.current = i
+		d.Unlock()
+		// recorded calls only tell what the recorded run did
+		if e.Event != nil {
+			d.replay(e.Event)
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	log.WithFields(log.Fields{
+		"launches":          d.launches,
+		"declines":          d.declines,
+		"matchingRecording": d.matched,
+		"tasksPerHost":      d.hosts,
+	}).Info("replay finished")
+	return nil
+}
+
+func (d *replayDriver) replay(e *schedulerEvent) {
+	switch {
+	case e.Type == eventHeartbeat:
+	case e.Type == eventDisconnected:
+		d.sched.Disconnected(d)
+	case e.Type == eventSubscribed && e.Subscribed != nil:
+		d.sched.Registered(d, e.Subscribed.FrameworkID, e.Subscribed.MasterInfo)
+	case e.Type == eventOffers && e.Offers != nil:
+		d.Lock()
+		for _, offer := range e.Offers.Offers {
+			d.offers[offer.ID.Value] = offer
+		}
+		d.Unlock()
+		d.sched.ResourceOffers(d, e.Offers.Offers)
+	case e.Type == eventRescind && e.Rescind != nil:
+		d.sched.OfferRescinded(d, e.Rescind.OfferID)
+	case e.Type == eventUpdate && e.Update != nil:
+		status := e.Update.Status
+		d.Lock()
+		if taskID, ok := d.taskIDs[status.TaskID.Value]; ok {
+			status.TaskID = mesos.TaskID{Value: taskID}
+		}
+		d.Unlock()
+		d.sched.StatusUpdate(d, status)
+	case e.Type == eventMessage && e.Message != nil:
+		d.sched.FrameworkMessage(d, e.Message.ExecutorID, e.Message.AgentID, e.Message.Data)
+	case e.Type == eventFailure && e.Failure != nil && e.Failure.ExecutorID != nil && e.Failure.AgentID != nil:
+		status := 0
+		if e.Failure.Status != nil {
+			status = int(*e.Failure.Status)
+		}
+		d.sched.ExecutorLost(d, *e.Failure.ExecutorID, *e.Failure.AgentID, status)
+	case e.Type == eventFailure && e.Failure != nil && e.Failure.AgentID != nil:
+		d.sched.SlaveLost(d, *e.Failure.AgentID)
+	case e.Type == eventError && e.Error != nil:
+		d.sched.Error(d, e.Error.Message)
+	default:
+		log.WithFields(log.Fields{"type": e.Type}).Warn("ignoring unknown recorded event")
+	}
+}
+
+// decide reports a call of the scheduler, the lock must be held
+func (d *replayDriver) decide(decision replayDecision) {
+	e := d.rec.events[d.current]
+	decision.Line = d.current + 2
+	decision.Time = e.Time
+	log.WithFields(log.Fields{
+		"line":           decision.Line,
+		"call":           decision.Call,
+		"offerID":        decision.OfferID,
+		"hostname":       decision.Hostname,
+		"task":           decision.Task,
+		"recordedTaskID": decision.RecordedTaskID,
+	}).Info("replay decision")
+	if d.report == nil {
+		return
+	}
+	if err := d.report.Encode(decision); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("write replay report failed")
+	}
+}
+
+func (d *replayDriver) AcceptOffers(offerIDs []mesos.OfferID, operations []mesos.Offer_Operation, filters *mesos.Filters) error {
+	if len(offerIDs) == 0 {
+		return errors.New("no offers to accept")
+	}
+	d.Lock()
+	defer d.Unlock()
+	offerID := offerIDs[0].Value
+	hostname := d.offers[offerID].Hostname
+	for _, op := range operations {
+		if op.Launch == nil {
+			d.decide(replayDecision{Call: op.GetType().String(), OfferID: offerID, Hostname: hostname})
+			continue
+		}
+		for _, task := range op.Launch.TaskInfos {
+			decision := replayDecision{
+				Call:     "LAUNCH",
+				OfferID:  offerID,
+				Hostname: hostname,
+				Task:     task.Name,
+				TaskID:   task.TaskID.Value,
+			}
+			recorded := d.recordedLaunches[offerID]
+			for i, r := range recorded {
+				if r.Name == task.Name {
+					decision.RecordedTaskID = r.TaskID.Value
+					d.taskIDs[r.TaskID.Value] = task.TaskID.Value
+					d.recordedLaunches[offerID] = append(recorded[:i], recorded[i+1:]...)
+					d.matched++
+					break
+				}
+			}
+			d.launches++
+			d.hosts[hostname]++
+			d.decide(decision)
+		}
+	}
+	return nil
+}
+
+func (d *replayDriver) DeclineOffer(offerID mesos.OfferID, filters *mesos.Filters) error {
+	d.Lock()
+	defer d.Unlock()
+	d.declines++
+	d.decide(replayDecision{Call: callDecline, OfferID: offerID.Value, Hostname: d.offers[offerID.Value].Hostname})
+	return nil
+}
+
+func (d *replayDriver) KillTask(taskID mesos.TaskID, agentID *mesos.AgentID, policy *killPolicy) error {
+	d.Lock()
+	defer d.Unlock()
+	d.decide(replayDecision{Call: callKill, TaskID: taskID.Value})
+	return nil
+}
+
+// ReconcileTasks is not reported, the reconciler runs on a timer and not in response to callbacks
+func (d *replayDriver) ReconcileTasks(statuses []mesos.TaskStatus) error {
+	return nil
+}
+
+func (d *replayDriver) Stop(failover bool) error {
+	d.Lock()
+	defer d.Unlock()
+	d.stopped = true
+	return nil
+}
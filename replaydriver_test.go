@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/mesos/mesos-go"
+)
+
+// replayScheduler launches one task named task on the offers of host and declines the others
+type replayScheduler struct {
+	scheduler
+	host     string
+	task     string
+	statuses []string
+}
+
+func (s *replayScheduler) ResourceOffers(driver schedulerDriver, offers []mesos.Offer) {
+	for _, offer := range offers {
+		if offer.Hostname != s.host {
+			driver.DeclineOffer(offer.ID, nil)
+			continue
+		}
+		task := mesos.TaskInfo{Name: s.task, TaskID: mesos.TaskID{Value: s.task + ".replayed"}, AgentID: offer.AgentID}
+		driver.AcceptOffers([]mesos.OfferID{offer.ID}, []mesos.Offer_Operation{launchOperation([]mesos.TaskInfo{task})}, nil)
+	}
+}
+
+func (s *replayScheduler) StatusUpdate(driver schedulerDriver, status mesos.TaskStatus) {
+	s.statuses = append(s.statuses, status.TaskID.Value+" "+status.GetState().String())
+}
+
+func TestReplayDriverDecisions(t *testing.T) {
+	offer := func(id, hostname string) mesos.Offer {
+		return mesos.Offer{ID: mesos.OfferID{Value: id}, AgentID: mesos.AgentID{Value: hostname}, Hostname: hostname}
+	}
+	update := func(taskID string) recordedEvent {
+		status := mesos.TaskStatus{TaskID: mesos.TaskID{Value: taskID}, State: mesos.TASK_RUNNING.Enum()}
+		return recordedEvent{Event: &schedulerEvent{Type: eventUpdate, Update: &updateEvent{Status: status}}}
+	}
+	// the recorded run launched web on h1 and declined h2
+	recorded := mesos.TaskInfo{Name: "web", TaskID: mesos.TaskID{Value: "web.recorded"}}
+	rec := &recording{events: []recordedEvent{
+		{Event: &schedulerEvent{Type: eventOffers, Offers: &offersEvent{Offers: []mesos.Offer{offer("o1", "h1"), offer("o2", "h2")}}}},
+		{Call: &schedulerCall{Type: callAccept, Accept: &acceptCall{
+			OfferIDs:   []mesos.OfferID{{Value: "o1"}},
+			Operations: []mesos.Offer_Operation{launchOperation([]mesos.TaskInfo{recorded})},
+		}}},
+		update("web.recorded"),
+		update("db.recorded"),
+	}}
+
+	tests := []struct {
+		name      string
+		host      string
+		task      string
+		decisions []string
+		statuses  []string
+	}{
+		{
+			name:      "launched like the recorded run",
+			host:      "h1",
+			task:      "web",
+			decisions: []string{"2 LAUNCH o1 h1 web.replayed for web.recorded", "2 DECLINE o2 h2"},
+			statuses:  []string{"web.replayed TASK_RUNNING", "db.recorded TASK_RUNNING"},
+		},
+		{
+			name:      "launched on another host",
+			host:      "h2",
+			task:      "web",
+			decisions: []string{"2 DECLINE o1 h1", "2 LAUNCH o2 h2 web.replayed"},
+			statuses:  []string{"web.recorded TASK_RUNNING", "db.recorded TASK_RUNNING"},
+		},
+		{
+			name:      "launched another task",
+			host:      "h1",
+			task:      "api",
+			decisions: []string{"2 LAUNCH o1 h1 api.replayed", "2 DECLINE o2 h2"},
+			statuses:  []string{"web.recorded TASK_RUNNING", "db.recorded TASK_RUNNING"},
+		},
+	}
+	for _, test := range tests {
+		sched := &replayScheduler{host: test.host, task: test.task}
+		report := &bytes.Buffer{}
+		if err := newReplayDriver(rec, sched, report).Run(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		decisions := []string{}
+		decoder := json.NewDecoder(report)
+		for decoder.More() {
+			d := replayDecision{}
+			if err := decoder.Decode(&d); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			decision := fmt.Sprintf("%d %s %s %s", d.Line, d.Call, d.OfferID, d.Hostname)
+			if d.TaskID != "" {
+				decision += " " + d.TaskID
+			}
+			if d.RecordedTaskID != "" {
+				decision += " for " + d.RecordedTaskID
+			}
+			decisions = append(decisions, decision)
+		}
+		if fmt.Sprint(decisions) != fmt.Sprint(test.decisions) {
+			t.Errorf("%s: got decisions %q, want %q", test.name, decisions, test.decisions)
+		}
+		if fmt.Sprint(sched.statuses) != fmt.Sprint(test.statuses) {
+			t.Errorf("%s: got statuses %q, want %q", test.name, sched.statuses, test.statuses)
+		}
+	}
+}
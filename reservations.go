@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+const (
+	// reservationLabel marks our reservations, its value is the role they are for
+	reservationLabel          = "rendler-reservation"
+	defaultPrincipal          = "rendler"
+	defaultReservationName    = "default"
+	reservationReleaseTimeout = time.Duration(30) * time.Second
+	reservationCheckInterval  = time.Duration(1) * time.Second
+)
+
+// reservableResources are the scalar resources a target can reserve
+var reservableResources = []string{"cpus", "mem", "disk"}
+
+// reservationTarget is how much of each resource the role should have reserved, on each of the
+// agents if there are any, otherwise in total across the cluster:
+//
+//	{"reservations": [{"name": "db", "agents": ["host1", "host2"], "cpus": 2, "mem": 4096},
+//	                  {"name": "spare", "cpus": 4, "mem": 2048}]}
+type reservationTarget struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+	// Agents are IDs or hostnames of agents
+	Agents []string `json:"agents,omitempty"`
+	CPUs   float64  `json:"cpus"`
+	Mem    float64  `json:"mem"`
+	Disk   float64  `json:"disk"`
+}
+
+type reservationFile struct {
+	Reservations []*reservationTarget `json:"reservations"`
+}
+
+func (t *reservationTarget) amount(name string) float64 {
+	switch name {
+	case "cpus":
+		return t.CPUs
+	case "mem":
+		return t.Mem
+	case "disk":
+		return t.Disk
+	}
+	return 0
+}
+
+// perAgent reports whether the amounts are for each of the agents rather than in total
+func (t *reservationTarget) perAgent() bool {
+	return len(t.Agents) > 0
+}
+
+func (t *reservationTarget) onAgent(offer *mesos.Offer) bool {
+	for _, agent := range t.Agents {
+		if agent == offer.AgentID.Value || agent == offer.Hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks a target, role is the framework role, the only one it can reserve for
+func (t *reservationTarget) validate(role string) validationErrors {
+	errs := validationErrors{}
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Sprintf("reservation %q: ", t.Name)+fmt.Sprintf(format, args...))
+	}
+	if t.Role == "" {
+		t.Role = role
+	}
+	if t.Role == string(mesos.RoleDefault) {
+		fail("resources can't be reserved for role %q", t.Role)
+	} else if t.Role != role {
+		fail("role %q is not the framework role %q", t.Role, role)
+	}
+	for _, name := range reservableResources {
+		if t.amount(name) < 0 {
+			fail("%s must not be negative", name)
+		}
+	}
+	return errs
+}
+
+// parseReservationTargets decodes and validates a reservation file
+func parseReservationTargets(data []byte, role string) ([]*reservationTarget, error) {
+	file := reservationFile{}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	errs := validationErrors{}
+	names := make(map[string]bool)
+	for i, t := range file.Reservations {
+		if t == nil {
+			errs = append(errs, fmt.Sprintf("reservations[%d]: empty reservation", i))
+			continue
+		}
+		if t.Name == "" {
+			t.Name = defaultReservationName
+		}
+		errs = append(errs, t.validate(role)...)
+		if names[t.Name] {
+			errs = append(errs, fmt.Sprintf("reservation %q: defined more than once", t.Name))
+		}
+		names[t.Name] = true
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return file.Reservations, nil
+}
+
+func loadReservationTargets(path string, role string) ([]*reservationTarget, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseReservationTargets(data, role)
+}
+
+// reservationManager makes the reservations of the role match the targets. Our reservations
+// carry the principal of the framework and a reservationLabel, so that they are recognised after
+// a restart. Reservations with the same principal can't be told apart by their labels, so those
+// on an agent count towards the targets for that agent first and the rest towards the targets
+// in total.
+//
+// As the master only tells us what an agent holds when it offers it, the manager knows the
+// reservations of an agent from its last offer together with those of our tasks running there.
+// Until every agent made an offer, targets in total may be overshot for a while, the excess is
+// unreserved once it is offered.
+type reservationManager struct {
+	sync.Mutex
+	targets   []*reservationTarget
+	role      string
+	principal string
+	tasks     *taskRegistry
+	// known are the amounts of our reservations by agent ID and resource name
+	known     map[string]map[string]float64
+	hostnames map[string]string
+	// releasing unreserves everything, the framework is being torn down
+	releasing bool
+}
+
+func newReservationManager(targets []*reservationTarget, role, principal string, tasks *taskRegistry) *reservationManager {
+	return &reservationManager{
+		targets:   targets,
+		role:      role,
+		principal: principal,
+		tasks:     tasks,
+		known:     make(map[string]map[string]float64),
+		hostnames: make(map[string]string),
+	}
+}
+
+// reservation is the ReservationInfo of our reservations
+func (m *reservationManager) reservation() *mesos.Resource_ReservationInfo {
+	return &mesos.Resource_ReservationInfo{
+		Principal: proto.String(m.principal),
+		Labels:    &mesos.Labels{Labels: []mesos.Label{{Key: reservationLabel, Value: proto.String(m.role)}}},
+	}
+}
+
+// ours reports whether a resource is reserved by us
+func (m *reservationManager) ours(r *mesos.Resource) bool {
+	if r.GetRole() != m.role || r.Reservation == nil || r.Reservation.GetPrincipal() != m.principal {
+		return false
+	}
+	for _, label := range r.Reservation.GetLabels().GetLabels() {
+		if label.Key == reservationLabel {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *reservationManager) reservedResource(name string, amount float64) mesos.Resource {
+	r := *mesos.BuildResource().Name(name).Scalar(amount).Role(m.role).Resource
+	r.Reservation = m.reservation()
+	return r
+}
+
+// reserved sums our reservations in resources by resource name
+func (m *reservationManager) reserved(resources mesos.Resources) map[string]float64 {
+	amounts := make(map[string]float64)
+	for i := range resources {
+		r := &resources[i]
+		if m.ours(r) && r.GetType() == mesos.SCALAR {
+			amounts[r.GetName()] += r.GetScalar().GetValue()
+		}
+	}
+	return amounts
+}
+
+// pinned is how much the targets for the agent of the offer want reserved there
+func (m *reservationManager) pinned(offer *mesos.Offer, name string) float64 {
+	amount := 0.0
+	for _, t := range m.targets {
+		if t.perAgent() && t.onAgent(offer) {
+			amount += t.amount(name)
+		}
+	}
+	return amount
+}
+
+// want is how much should be reserved on the agent of the offer, the lock must be held. It is
+// what the targets for the agent want, and what the targets in total miss without the agent.
+func (m *reservationManager) want(offer *mesos.Offer, name string) float64 {
+	if m.releasing {
+		return 0
+	}
+	total := 0.0
+	for _, t := range m.targets {
+		if !t.perAgent() {
+			total += t.amount(name)
+		}
+	}
+	pinned := m.pinned(offer, name)
+	elsewhere := 0.0
+	for agentID, amounts := range m.known {
+		if agentID == offer.AgentID.Value {
+			continue
+		}
+		// what other agents hold beyond their own targets counts towards the total
+		elsewhere += math.Max(0, amounts[name]-m.pinnedOn(agentID, name))
+	}
+	return pinned + math.Max(0, total-elsewhere)
+}
+
+// pinnedOn is pinned for an agent we know by its ID only, the lock must be held
+func (m *reservationManager) pinnedOn(agentID, name string) float64 {
+	hostname := m.hostnames[agentID]
+	return m.pinned(&mesos.Offer{AgentID: mesos.AgentID{Value: agentID}, Hostname: hostname}, name)
+}
+
+// reconcile reserves and unreserves resources of the offers so that the reservations of their
+// agents come closer to the targets. It returns the offers it did not use, those it accepted, and
+// those it failed to accept.
+func (m *reservationManager) reconcile(driver schedulerDriver, offers []mesos.Offer) (unused, used, failed []mesos.Offer) {
+	m.Lock()
+	defer m.Unlock()
+	for i := range offers {
+		offer := &offers[i]
+		operations, planned := m.operations(offer)
+		if len(operations) == 0 {
+			unused = append(unused, *offer)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"offerID":    offer.ID.Value,
+			"hostname":   offer.Hostname,
+			"operations": operations,
+		}).Info("changing reservations")
+		if err := driver.AcceptOffers([]mesos.OfferID{offer.ID}, operations, defaultFilter); err != nil {
+			if err != errDryRun {
+				log.WithFields(log.Fields{"offerID": offer.ID.Value, "err": err}).Error("change reservations failed")
+			}
+			failed = append(failed, *offer)
+			continue
+		}
+		m.known[offer.AgentID.Value] = planned
+		used = append(used, *offer)
+	}
+	return unused, used, failed
+}
+
+// operations records what is reserved on the agent of the offer and returns the RESERVE and
+// UNRESERVE operations which move it towards the targets, with what is reserved there once they
+// are accepted. The lock must be held.
+func (m *reservationManager) operations(offer *mesos.Offer) ([]mesos.Offer_Operation, map[string]float64) {
+	resources := mesos.Resources(offer.Resources)
+	offered := m.reserved(resources)
+	agentID := offer.AgentID.Value
+	have := m.reserved(m.inUse(agentID))
+	for name, amount := range offered {
+		have[name] += amount
+	}
+	m.known[agentID] = have
+	m.hostnames[agentID] = offer.Hostname
+	planned := make(map[string]float64)
+	for name, amount := range have {
+		planned[name] = amount
+	}
+
+	reserve, unreserve := []mesos.Resource{}, []mesos.Resource{}
+	for _, name := range reservableResources {
+		delta := m.want(offer, name) - have[name]
+		if delta > scalarEpsilon {
+			available := 0.0
+			if v := resources.SumScalars(mesos.NamedResources(name).And(mesos.UnreservedResources)); v != nil {
+				available = v.Value
+			}
+			if amount := math.Min(delta, available); amount > scalarEpsilon {
+				planned[name] += amount
+				reserve = append(reserve, m.reservedResource(name, amount))
+			}
+		} else if delta < -scalarEpsilon {
+			// reservations in use by tasks can't be unreserved
+			if amount := math.Min(-delta, offered[name]); amount > scalarEpsilon {
+				planned[name] -= amount
+				unreserve = append(unreserve, m.reservedResource(name, amount))
+			}
+		}
+	}
+
+	operations := []mesos.Offer_Operation{}
+	if len(unreserve) > 0 {
+		operations = append(operations, mesos.Offer_Operation{
+			Type:      mesos.UNRESERVE.Enum(),
+			Unreserve: &mesos.Offer_Operation_Unreserve{Resources: unreserve},
+		})
+	}
+	if len(reserve) > 0 {
+		operations = append(operations, mesos.Offer_Operation{
+			Type:    mesos.RESERVE.Enum(),
+			Reserve: &mesos.Offer_Operation_Reserve{Resources: reserve},
+		})
+	}
+	return operations, planned
+}
+
+// inUse returns the resources of our tasks on the agent which have not ended
+func (m *reservationManager) inUse(agentID string) mesos.Resources {
+	resources := mesos.Resources{}
+	for _, task := range m.tasks.list(func(t *taskRecord) bool { return t.slaveID == agentID && !isTerminal(t.state) }) {
+		resources.Add(task.resources...)
+	}
+	return resources
+}
+
+// usedBy reports whether the task runs on any of our reservations
+func (m *reservationManager) usedBy(task *taskRecord) bool {
+	for i := range task.resources {
+		if m.ours(&task.resources[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// agentLost forgets the reservations of an agent, they are gone with it
+func (m *reservationManager) agentLost(agentID string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.known, agentID)
+	delete(m.hostnames, agentID)
+}
+
+// outstanding sums up all reservations we know of, the lock must be held
+func (m *reservationManager) outstanding() float64 {
+	sum := 0.0
+	for _, amounts := range m.known {
+		for _, amount := range amounts {
+			sum += amount
+		}
+	}
+	return sum
+}
+
+// release unreserves every reservation of ours as its agent offers it, and waits until they are
+// all gone or the timeout passed. Reservations still used by tasks are released only once the
+// tasks ended.
+func (m *reservationManager) release(timeout time.Duration) {
+	m.Lock()
+	m.releasing = true
+	m.Unlock()
+	deadline := time.Now().Add(timeout)
+	for {
+		m.Lock()
+		left := m.outstanding()
+		m.Unlock()
+		if left < scalarEpsilon {
+			log.Info("all reservations released")
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Warn("release reservations timed out, some stay reserved")
+			return
+		}
+		log.Info("waiting for reservations to be released")
+		time.Sleep(reservationCheckInterval)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+// operationsDriver accepts offers and records their operations
+type operationsDriver struct {
+	schedulerDriver
+	operations []string
+}
+
+func (d *operationsDriver) AcceptOffers(offerIDs []mesos.OfferID, operations []mesos.Offer_Operation, filters *mesos.Filters) error {
+	for _, op := range operations {
+		resources := append(op.GetReserve().GetResources(), op.GetUnreserve().GetResources()...)
+		amounts := []string{}
+		for _, r := range resources {
+			amounts = append(amounts, fmt.Sprintf("%s:%g", r.GetName(), r.GetScalar().GetValue()))
+		}
+		d.operations = append(d.operations, op.GetType().String()+" "+strings.Join(amounts, ";"))
+	}
+	return nil
+}
+
+func TestReservationManagerReconcile(t *testing.T) {
+	rendler := newReservationManager(nil, "web", "rendler", nil)
+	ours := func(name string, amount float64) mesos.Resource { return rendler.reservedResource(name, amount) }
+	theirs := func(name string, amount float64) mesos.Resource {
+		r := rendler.reservedResource(name, amount)
+		r.Reservation.Principal = proto.String("other")
+		return r
+	}
+	tests := []struct {
+		name      string
+		targets   []*reservationTarget
+		releasing bool
+		offered   mesos.Resources
+		// running are the resources of a task of ours on the agent
+		running    mesos.Resources
+		operations []string
+	}{
+		{
+			name:       "reserve a target in total",
+			targets:    []*reservationTarget{{CPUs: 2, Mem: 128}},
+			offered:    mesos.Resources{scalarResource("cpus", 4, "*"), scalarResource("mem", 1024, "*")},
+			operations: []string{"RESERVE cpus:2;mem:128"},
+		},
+		{
+			name:       "reserve what is available",
+			targets:    []*reservationTarget{{CPUs: 8}},
+			offered:    mesos.Resources{scalarResource("cpus", 4, "*")},
+			operations: []string{"RESERVE cpus:4"},
+		},
+		{
+			name:    "reserved already",
+			targets: []*reservationTarget{{CPUs: 2}},
+			offered: mesos.Resources{ours("cpus", 2), scalarResource("cpus", 2, "*")},
+		},
+		{
+			name:       "reservations of another principal don't count",
+			targets:    []*reservationTarget{{CPUs: 2}},
+			offered:    mesos.Resources{theirs("cpus", 2), scalarResource("cpus", 2, "*")},
+			operations: []string{"RESERVE cpus:2"},
+		},
+		{
+			name:       "unreserve beyond the target",
+			targets:    []*reservationTarget{{CPUs: 1}},
+			offered:    mesos.Resources{ours("cpus", 3)},
+			operations: []string{"UNRESERVE cpus:2"},
+		},
+		{
+			name:    "target for another agent",
+			targets: []*reservationTarget{{Agents: []string{"h2"}, CPUs: 2}},
+			offered: mesos.Resources{scalarResource("cpus", 4, "*")},
+		},
+		{
+			name:       "target for the agent",
+			targets:    []*reservationTarget{{Agents: []string{"h1"}, CPUs: 2}},
+			offered:    mesos.Resources{scalarResource("cpus", 4, "*")},
+			operations: []string{"RESERVE cpus:2"},
+		},
+		{
+			name:       "released during teardown",
+			targets:    []*reservationTarget{{CPUs: 2, Mem: 128}},
+			releasing:  true,
+			offered:    mesos.Resources{ours("cpus", 2), ours("mem", 128), scalarResource("cpus", 2, "*")},
+			operations: []string{"UNRESERVE cpus:2;mem:128"},
+		},
+		{
+			name:       "released during teardown except what a task uses",
+			targets:    []*reservationTarget{{CPUs: 2}},
+			releasing:  true,
+			offered:    mesos.Resources{ours("cpus", 1)},
+			running:    mesos.Resources{ours("cpus", 1)},
+			operations: []string{"UNRESERVE cpus:1"},
+		},
+	}
+	for _, test := range tests {
+		tasks := newTaskRegistry()
+		offer := mesos.Offer{ID: mesos.OfferID{Value: "o1"}, AgentID: mesos.AgentID{Value: "a1"}, Hostname: "h1", Resources: test.offered}
+		if len(test.running) > 0 {
+			tasks.add(&mesos.TaskInfo{TaskID: mesos.TaskID{Value: "t1"}, AgentID: offer.AgentID, Resources: test.running}, &offer, "")
+		}
+		m := newReservationManager(test.targets, "web", "rendler", tasks)
+		m.releasing = test.releasing
+		d := &operationsDriver{}
+		unused, used, _ := m.reconcile(d, []mesos.Offer{offer})
+		if fmt.Sprint(d.operations) != fmt.Sprint(test.operations) {
+			t.Errorf("%s: got operations %q, want %q", test.name, d.operations, test.operations)
+		}
+		if len(used)+len(unused) != 1 || (len(used) == 1) != (len(test.operations) > 0) {
+			t.Errorf("%s: %d offers used and %d unused", test.name, len(used), len(unused))
+		}
+	}
+}
@@ -1,19 +1,21 @@
 package main
 
 import (
-	"container/list"
 	"flag"
 	"fmt"
-	"net"
+	"io"
 	"os"
 	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/golang/protobuf/proto"
-	"github.com/mesos/mesos-go/mesosproto"
-	"github.com/mesos/mesos-go/mesosutil"
-	"github.com/mesos/mesos-go/scheduler"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+	"github.com/pborman/uuid"
 )
 
 const (
@@ -22,187 +24,274 @@ const (
 	containerTypeMesosWithImage = "mesosprotoWithImage"
 	taskCPUs                    = 0.1
 	taskMem                     = 50.0
-	shutdownTimeout             = time.Duration(3) * time.Second
+	shutdownFailover            = "failover"
+	shutdownDrain               = "drain"
+	shutdownTeardown            = "teardown"
+	drainCheckInterval          = time.Duration(1) * time.Second
 	dockerNetworkBridge         = "bridge"
 	dockerNetworkHost           = "host"
 	dockerNetworkNone           = "none"
 )
 
 var (
-	taskCount = 0
-)
-
-var (
-	defaultFilter = &mesosproto.Filters{RefuseSeconds: proto.Float64(1)}
+	defaultFilter = &mesos.Filters{RefuseSeconds: proto.Float64(1)}
 )
 
 type demoScheduler struct {
 	enableCheckPoint bool
 	justPrintOffers  bool
-	enableContainer  bool
 	role             string
-	containerType    string
-	image            string
-	network          string
-	networkName      string
-	exposePorts      []int
-	reserveCPUs      float64
-	reserveMem       float64
-	alreadyReserved  bool
-	shellCmdQueue    *list.List
-	shutdown         chan struct{}
-}
-
-// handleSignal catch interrupt
-func (s *demoScheduler) handleSignal(driver scheduler.SchedulerDriver) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	principal        string
+	reservations     *reservationManager
+	maxRetries       int
+	shellCmdQueue    *commandQueue
+	tasks            *taskRegistry
+	reconciler       reconciler
+	killer           *taskKiller
+	metrics          *schedulerMetrics
+	store            frameworkStore
+	// shutdown is closed on the first signal, from then on nothing is launched anymore
+	shutdown chan struct{}
+	// stopped is closed once the shutdown is done and the driver stops. Kills made while shutting
+	// down are retried until then.
+	stopped      chan struct{}
+	shutdownMode string
+	drainTimeout time.Duration
+	// driver is the driver of the current subscription, for calls which are not made in callbacks
+	driverLock sync.Mutex
+	driver     schedulerDriver
+	// startJobs are the jobs the scheduler was started with. They are submitted once the tasks
+	// of the framework it fails over to were reconciled, or right away for a new framework.
+	startJobsLock sync.Mutex
+	startJobs     []*jobSpec
+}
+
+// handleSignal shuts down on SIGINT or SIGTERM according to the shutdown mode. Once it is done
+// it sends on stop whether to stop the driver with failover. A second signal exits right away.
+func (s *demoScheduler) handleSignal(stop chan<- bool) {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	sig := <-c
-	if sig != os.Interrupt {
-		return
+	log.WithFields(log.Fields{"signal": sig.String(), "mode": s.shutdownMode}).Info("RENDLER is shutting down")
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- s.shutDown()
+	}()
+	select {
+	case failover := <-done:
+		close(s.stopped)
+		stop <- failover
+	case sig := <-c:
+		log.WithFields(log.Fields{"signal": sig.String()}).Warn("second signal, exiting right away")
+		os.Exit(1)
 	}
+}
 
-	log.Println("RENDLER is shutting down")
+// shutDown stops launching tasks and winds down according to the shutdown mode, it returns
+// whether to stop the driver with failover
+func (s *demoScheduler) shutDown() bool {
 	close(s.shutdown)
+	switch s.shutdownMode {
+	case shutdownFailover:
+		return true
+	case shutdownDrain:
+		// services keep running for the next scheduler, with the reservations they run on
+		s.drain()
+		return true
+	default:
+		s.releaseReservations()
+		return false
+	}
+}
 
-	select {
-	case <-time.After(shutdownTimeout):
+// start runs what the scheduler does in the background. The killer and the health monitor keep
+// running until the scheduler stopped, so that kills made while shutting down end their tasks.
+func (s *demoScheduler) start() {
+	s.killer = newTaskKiller(s.currentDriver)
+	go s.killer.run(s.stopped)
+	go runHealthMonitor(s.tasks, s.killTask, s.stopped)
+	go s.runDeployments(s.shutdown)
+}
+
+// drain waits until every batch task ended, or the drain timeout passed. Services keep running
+// for the next scheduler.
+func (s *demoScheduler) drain() {
+	deadline := time.Now().Add(s.drainTimeout)
+	for {
+		running := 0
+		for _, task := range s.tasks.list(func(t *taskRecord) bool { return !isTerminal(t.state) }) {
+			if !s.shellCmdQueue.isService(task.jobID) {
+				running++
+			}
+		}
+		if running == 0 {
+			log.Info("all batch tasks ended")
+			return
+		}
+		if time.Now().After(deadline) {
+			log.WithFields(log.Fields{"tasks": running}).Warn("drain timed out")
+			return
+		}
+		log.WithFields(log.Fields{"tasks": running}).Info("waiting for batch tasks to end")
+		time.Sleep(drainCheckInterval)
 	}
+}
 
-	driver.Stop(false)
+// containerType names the kind of tasks a job runs for metrics, like the -containerType flag
+func containerType(j *jobSpec) string {
+	if j.Container == nil {
+		return "shell"
+	}
+	return j.Container.Type
 }
 
-func (s *demoScheduler) newShellCommandTask(cmd string, offer *mesosproto.Offer) *mesosproto.TaskInfo {
-	taskCount = taskCount + 1
-	task := &mesosproto.TaskInfo{
-		TaskId: &mesosproto.TaskID{
-			Value: proto.String(fmt.Sprintf("ShellCommandTask-%d", taskCount)),
-		},
-		Name:    proto.String(fmt.Sprintf("ShellCommandTask-%d", taskCount)),
-		SlaveId: offer.SlaveId,
-		Resources: []*mesosproto.Resource{
-			mesosutil.NewScalarResource("cpus", taskCPUs),
-			mesosutil.NewScalarResource("mem", taskMem),
-		},
-		Command: &mesosproto.CommandInfo{
-			Value: proto.String(cmd),
+// newTask builds the TaskInfo of one instance of a job with the factory of its container type,
+// the task is launched with the resources it claimed from the offer
+func (s *demoScheduler) newTask(j *jobSpec, offer *mesos.Offer, claim *resourceClaim) *mesos.TaskInfo {
+	if j.Container == nil {
+		return s.newShellCommandTask(j, offer, claim)
+	}
+	switch j.Container.Type {
+	case containerTypeDocker:
+		return s.newDockerContainerTask(j, offer, claim)
+	case containerTypeMesos:
+		return s.newMesosContainerTask(j, offer, claim)
+	case containerTypeMesosWithImage:
+		return s.newMesosContainerWithDockerImageTask(j, offer, claim)
+	}
+	panic("unsupported container type")
+}
+
+// newTaskInfo fills in what every kind of task has in common. Task IDs get a random suffix,
+// so that they stay unique when a restarted scheduler fails over to its old framework.
+func newTaskInfo(j *jobSpec, offer *mesos.Offer, claim *resourceClaim) *mesos.TaskInfo {
+	task := &mesos.TaskInfo{
+		TaskID: mesos.TaskID{
+			Value: fmt.Sprintf("%s.%s", j.Name, uuid.New()),
 		},
+		Name:        j.Name,
+		AgentID:     offer.AgentID,
+		Resources:   claim.resources.Clone(),
+		Command:     newCommandInfo(j, claim.hostPorts),
+		HealthCheck: newHealthCheck(j, claim.hostPorts),
+		Discovery:   newDiscoveryInfo(j, claim.hostPorts),
+	}
+	if len(j.Labels) > 0 {
+		task.Labels = &mesos.Labels{}
+		for key, value := range j.Labels {
+			task.Labels.Labels = append(task.Labels.Labels,
+				mesos.Label{Key: key, Value: proto.String(value)})
+		}
 	}
 	return task
 }
 
-func (s *demoScheduler) newDockerContainerTask(cmd string, offer *mesosproto.Offer) *mesosproto.TaskInfo {
-	taskCount = taskCount + 1
+// newCommandInfo runs cmd through the shell, or args directly. The host ports are passed to the
+// task as PORT0, PORT1, ... and those of named ports as PORT_<NAME> too
+func newCommandInfo(j *jobSpec, hostPorts []uint64) *mesos.CommandInfo {
+	command := &mesos.CommandInfo{}
+	if len(j.Args) > 0 {
+		command.Shell = proto.Bool(false)
+		command.Arguments = j.Args
+		// docker runs the arguments with the entrypoint of the image
+		if j.Container == nil || j.Container.Type != containerTypeDocker {
+			command.Value = proto.String(j.Args[0])
+		}
+	} else if j.Cmd != "" {
+		command.Value = proto.String(j.Cmd)
+	} else {
+		command.Shell = proto.Bool(false)
+	}
+
+	variables := []mesos.Environment_Variable{}
+	for name, value := range j.Env {
+		variables = append(variables, mesos.Environment_Variable{Name: name, Value: value})
+	}
+	for i, hostPort := range hostPorts {
+		variables = append(variables, mesos.Environment_Variable{
+			Name:  fmt.Sprintf("PORT%d", i),
+			Value: fmt.Sprintf("%d", hostPort),
+		})
+		if name := j.Ports[i].Name; name != "" {
+			variables = append(variables, mesos.Environment_Variable{
+				Name:  portEnvName(name),
+				Value: fmt.Sprintf("%d", hostPort),
+			})
+		}
+	}
+	if len(variables) > 0 {
+		command.Environment = &mesos.Environment{Variables: variables}
+	}
+
+	for _, uri := range j.URIs {
+		command.URIs = append(command.URIs, mesos.CommandInfo_URI{Value: uri})
+	}
+	return command
+}
 
-	var dockerNetwork *mesosproto.ContainerInfo_DockerInfo_Network
-	switch s.network {
+func dockerNetwork(network string) (*mesos.ContainerInfo_DockerInfo_Network, error) {
+	switch network {
 	case dockerNetworkNone:
-		dockerNetwork = mesosproto.ContainerInfo_DockerInfo_NONE.Enum()
+		return mesos.NONE.Enum(), nil
 	case dockerNetworkBridge:
-		dockerNetwork = mesosproto.ContainerInfo_DockerInfo_BRIDGE.Enum()
+		return mesos.BRIDGE.Enum(), nil
 	case dockerNetworkHost:
-		dockerNetwork = mesosproto.ContainerInfo_DockerInfo_HOST.Enum()
-	default:
-		panic("network type not supported")
-	}
-
-	var portMappings []*mesosproto.ContainerInfo_DockerInfo_PortMapping
-	var usedPorts []int
-	if len(s.exposePorts) > 0 {
-		hostPorts := getPorts(offer)
-		if len(s.exposePorts) > len(hostPorts) {
-			panic("not enough ports")
-		}
-		for i, cp := range s.exposePorts {
-			hp := hostPorts[i]
-			pm := &mesosproto.ContainerInfo_DockerInfo_PortMapping{
-				HostPort:      proto.Uint32(uint32(hp)),
-				ContainerPort: proto.Uint32(uint32(cp)),
-				Protocol:      proto.String("tcp"),
+		return mesos.HOST.Enum(), nil
+	}
+	return nil, fmt.Errorf("docker network type %q not supported", network)
+}
+
+func (s *demoScheduler) newShellCommandTask(j *jobSpec, offer *mesos.Offer, claim *resourceClaim) *mesos.TaskInfo {
+	return newTaskInfo(j, offer, claim)
+}
+
+func (s *demoScheduler) newDockerContainerTask(j *jobSpec, offer *mesos.Offer, claim *resourceClaim) *mesos.TaskInfo {
+	network, err := dockerNetwork(j.Container.Network)
+	checkErr(err)
+
+	var portMappings []mesos.ContainerInfo_DockerInfo_PortMapping
+	if *network == mesos.BRIDGE {
+		for i, p := range j.Ports {
+			pm := mesos.ContainerInfo_DockerInfo_PortMapping{
+				HostPort:      uint32(claim.hostPorts[i]),
+				ContainerPort: uint32(p.ContainerPort),
+				Protocol:      proto.String(p.Protocol),
 			}
 			portMappings = append(portMappings, pm)
-			usedPorts = append(usedPorts, int(hp))
 		}
 	}
 
-	resources := []*mesosproto.Resource{
-		mesosutil.NewScalarResource("cpus", taskCPUs),
-		mesosutil.NewScalarResource("mem", taskMem),
-	}
-	for _, hostPort := range usedPorts {
-		resources = append(resources,
-			mesosutil.NewRangesResource("ports",
-				[]*mesosproto.Value_Range{mesosutil.NewValueRange(uint64(hostPort), uint64(hostPort))}))
-	}
-
-	task := &mesosproto.TaskInfo{
-		TaskId: &mesosproto.TaskID{
-			Value: proto.String(fmt.Sprintf("DockerContainerTask-%d", taskCount)),
-		},
-		Name:      proto.String(fmt.Sprintf("DockerContainerTask-%d", taskCount)),
-		SlaveId:   offer.SlaveId,
-		Resources: resources,
-		Command: &mesosproto.CommandInfo{
-			Value: proto.String(cmd),
-		},
-		Container: &mesosproto.ContainerInfo{
-			Type: mesosproto.ContainerInfo_DOCKER.Enum(),
-			Docker: &mesosproto.ContainerInfo_DockerInfo{
-				Image:        proto.String(s.image),
-				Network:      dockerNetwork,
-				PortMappings: portMappings,
-			},
+	task := newTaskInfo(j, offer, claim)
+	task.Container = &mesos.ContainerInfo{
+		Type: mesos.ContainerInfo_DOCKER.Enum(),
+		Docker: &mesos.ContainerInfo_DockerInfo{
+			Image:        j.Container.Image,
+			Network:      network,
+			PortMappings: portMappings,
 		},
 	}
 	return task
 }
 
-func (s *demoScheduler) newMesosContainerTask(cmd string, offer *mesosproto.Offer) *mesosproto.TaskInfo {
-	taskCount = taskCount + 1
-	task := &mesosproto.TaskInfo{
-		TaskId: &mesosproto.TaskID{
-			Value: proto.String(fmt.Sprintf("MesosContainerTask-%d", taskCount)),
-		},
-		Name:    proto.String(fmt.Sprintf("MesosContainerTask-%d", taskCount)),
-		SlaveId: offer.SlaveId,
-		Resources: []*mesosproto.Resource{
-			mesosutil.NewScalarResource("cpus", taskCPUs),
-			mesosutil.NewScalarResource("mem", taskMem),
-		},
-		Command: &mesosproto.CommandInfo{
-			Value: proto.String(cmd),
-		},
-		Container: &mesosproto.ContainerInfo{
-			Type:  mesosproto.ContainerInfo_MESOS.Enum(),
-			Mesos: &mesosproto.ContainerInfo_MesosInfo{},
-		},
+func (s *demoScheduler) newMesosContainerTask(j *jobSpec, offer *mesos.Offer, claim *resourceClaim) *mesos.TaskInfo {
+	task := newTaskInfo(j, offer, claim)
+	task.Container = &mesos.ContainerInfo{
+		Type:  mesos.ContainerInfo_MESOS.Enum(),
+		Mesos: &mesos.ContainerInfo_MesosInfo{},
 	}
 	return task
 }
 
-func (s *demoScheduler) newMesosContainerWithDockerImageTask(cmd string, offer *mesosproto.Offer) *mesosproto.TaskInfo {
-	taskCount = taskCount + 1
-	task := &mesosproto.TaskInfo{
-		TaskId: &mesosproto.TaskID{
-			Value: proto.String(fmt.Sprintf("MesosContainerWithDockerImageTask-%d", taskCount)),
-		},
-		Name:    proto.String(fmt.Sprintf("MesosContainerWithDockerImageTask-%d", taskCount)),
-		SlaveId: offer.SlaveId,
-		Resources: []*mesosproto.Resource{
-			mesosutil.NewScalarResource("cpus", taskCPUs),
-			mesosutil.NewScalarResource("mem", taskMem),
-		},
-		Command: &mesosproto.CommandInfo{
-			Value: proto.String(cmd),
-		},
-		Container: &mesosproto.ContainerInfo{
-			Type: mesosproto.ContainerInfo_MESOS.Enum(),
-			Mesos: &mesosproto.ContainerInfo_MesosInfo{
-				Image: &mesosproto.Image{
-					Type: mesosproto.Image_DOCKER.Enum(),
-					Docker: &mesosproto.Image_Docker{
-						Name: proto.String(s.image),
-					},
+func (s *demoScheduler) newMesosContainerWithDockerImageTask(j *jobSpec, offer *mesos.Offer, claim *resourceClaim) *mesos.TaskInfo {
+	task := newTaskInfo(j, offer, claim)
+	task.Container = &mesos.ContainerInfo{
+		Type: mesos.ContainerInfo_MESOS.Enum(),
+		Mesos: &mesos.ContainerInfo_MesosInfo{
+			Image: &mesos.Image{
+				Type: mesos.Image_DOCKER.Enum(),
+				Docker: &mesos.Image_Docker{
+					Name: j.Container.Image,
 				},
 			},
 		},
@@ -210,190 +299,374 @@ func (s *demoScheduler) newMesosContainerWithDockerImageTask(cmd string, offer *
 	return task
 }
 
-func (s *demoScheduler) Registered(
-	_ scheduler.SchedulerDriver,
-	frameworkID *mesosproto.FrameworkID,
-	masterInfo *mesosproto.MasterInfo) {
-	log.WithFields(log.Fields{"frameworkID": frameworkID, "masterInfo": masterInfo}).Info("framework registered")
+// Registered is called on every subscription, also when we subscribed again to the same
+// framework after the connection broke
+func (s *demoScheduler) Registered(driver schedulerDriver, frameworkID mesos.FrameworkID, masterInfo *mesos.MasterInfo) {
+	log.WithFields(log.Fields{"frameworkID": frameworkID.Value, "masterInfo": masterInfo}).Info("framework registered")
+	if err := s.store.save(frameworkID.Value); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("save framework ID failed")
+	}
+	s.metrics.setConnected(true)
+	s.driverLock.Lock()
+	s.driver = driver
+	s.driverLock.Unlock()
+	s.reconciler.start(driver, s.tasks, s.submitStartJobs)
 }
 
-func (s *demoScheduler) Reregistered(_ scheduler.SchedulerDriver, masterInfo *mesosproto.MasterInfo) {
-	log.WithFields(log.Fields{"masterInfo": masterInfo}).Info("framework re-registered")
+// submitStartJobs submits the jobs the scheduler was started with, the first time it is called.
+// Tasks which were launched for them before a failover and are still running are matched to
+// them by the job name their IDs start with, only the instances without one are queued.
+func (s *demoScheduler) submitStartJobs() {
+	s.startJobsLock.Lock()
+	jobs := s.startJobs
+	s.startJobs = nil
+	s.startJobsLock.Unlock()
+	if len(jobs) == 0 {
+		return
+	}
+
+	running := make(map[string][]string)
+	for _, task := range s.tasks.list(func(t *taskRecord) bool { return t.jobID == "" && !isTerminal(t.state) }) {
+		name := jobName(task.taskID)
+		running[name] = append(running[name], task.taskID)
+	}
+	for _, spec := range jobs {
+		taskIDs := running[spec.Name]
+		sort.Strings(taskIDs)
+		submitted, extra, err := s.shellCmdQueue.submitRunning(spec, taskIDs)
+		if err != nil {
+			log.WithFields(log.Fields{"job": spec.Name, "err": err}).Error("unable to submit job")
+			continue
+		}
+		for _, j := range submitted {
+			if j.State == jobLaunched {
+				s.tasks.reattach(j.TaskID, j.Name, j.ID)
+				log.WithFields(log.Fields{"taskID": j.TaskID, "jobID": j.ID}).Info("task still running, reattached to its job")
+			}
+		}
+		for _, taskID := range extra {
+			log.WithFields(log.Fields{"taskID": taskID, "job": spec.Name}).Warn("task beyond the instances of its job, not reattached")
+		}
+	}
 }
 
-func (s *demoScheduler) Disconnected(scheduler.SchedulerDriver) {
-	log.Println("Framework disconnected with master")
+// currentDriver returns the driver of the last subscription, nil before the first one
+func (s *demoScheduler) currentDriver() schedulerDriver {
+	s.driverLock.Lock()
+	defer s.driverLock.Unlock()
+	return s.driver
 }
 
-func (s *demoScheduler) ResourceOffers(driver scheduler.SchedulerDriver, offers []*mesosproto.Offer) {
-	if s.reserveMem > 0 || s.reserveCPUs > 0 {
-		s.printOffers(offers)
-		if !s.alreadyReserved {
-			s.reserveResources(driver, offers[0])
-		}
-		s.declineOffers(driver, offers[1:])
-		return
-	}
-	if s.justPrintOffers {
-		s.printOffers(offers)
-		return
+// scaleService changes the number of instances of a service and kills the tasks of the instances
+// it stopped
+func (s *demoScheduler) scaleService(name string, instances int) error {
+	stopped, err := s.shellCmdQueue.scale(name, instances)
+	if err != nil {
+		return err
 	}
-	if s.shellCmdQueue.Len() == 0 {
-		s.declineOffers(driver, offers)
-		return
+	log.WithFields(log.Fields{"service": name, "instances": instances, "stopped": len(stopped)}).Info("service scaled")
+	for _, j := range stopped {
+		s.killTask(j.TaskID)
 	}
+	return nil
+}
 
-	if !s.enableContainer {
-		s.runCommandTasks(driver, offers, s.newShellCommandTask)
-		return
+// killTask kills a task which has not ended yet with the kill policy of its job, and reports
+// whether there was such a task
+func (s *demoScheduler) killTask(taskID string) bool {
+	task, ok := s.tasks.get(taskID)
+	if !ok || isTerminal(task.state) {
+		return false
+	}
+	var agentID *mesos.AgentID
+	if task.slaveID != "" {
+		agentID = &mesos.AgentID{Value: task.slaveID}
+	}
+	var policy *killPolicy
+	if j, ok := s.shellCmdQueue.get(task.jobID); ok && j.spec.KillPolicy != nil {
+		policy = newKillPolicy(time.Duration(j.spec.KillPolicy.GracePeriodSeconds * float64(time.Second)))
 	}
+	s.killer.kill(taskID, agentID, policy)
+	return true
+}
 
-	if s.containerType == containerTypeDocker {
-		s.runCommandTasks(driver, offers, s.newDockerContainerTask)
-		return
+// releaseReservations unreserves our reservations before the framework is torn down. The tasks
+// on them would be killed with the framework anyway, they are killed first so that their
+// reservations can be released too.
+func (s *demoScheduler) releaseReservations() {
+	s.killTasks(s.reservations.usedBy)
+	s.reservations.release(reservationReleaseTimeout)
+}
+
+// killTasks kills every task which has not ended yet and matches the filter, and returns their IDs
+func (s *demoScheduler) killTasks(filter func(*taskRecord) bool) []string {
+	killed := []string{}
+	for _, task := range s.tasks.list(filter) {
+		if s.killTask(task.taskID) {
+			killed = append(killed, task.taskID)
+		}
 	}
-	if s.containerType == containerTypeMesos {
-		s.runCommandTasks(driver, offers, s.newMesosContainerTask)
+	return killed
+}
+
+func (s *demoScheduler) Disconnected(schedulerDriver) {
+	log.Println("Framework disconnected with master")
+	s.metrics.setConnected(false)
+}
+
+func (s *demoScheduler) ResourceOffers(driver schedulerDriver, offers []mesos.Offer) {
+	if s.justPrintOffers {
+		s.metrics.offersPrinted(offers)
+		s.printOffers(offers)
 		return
 	}
-	if s.containerType == containerTypeMesosWithImage {
-		s.runCommandTasks(driver, offers, s.newMesosContainerWithDockerImageTask)
+	s.metrics.offersOffered(offers)
+	s.tasks.agentsOffered(offers)
+	offers, used, failed := s.manageVolumes(driver, offers)
+	s.countOffers(used, failed)
+	offers, used, failed = s.reservations.reconcile(driver, offers)
+	s.countOffers(used, failed)
+	if s.shellCmdQueue.Len() == 0 {
+		s.declineOffers(driver, offers)
 		return
 	}
-	panic("unsupported container type")
+	s.runCommandTasks(driver, offers)
 }
 
-func (s *demoScheduler) reserveResources(driver scheduler.SchedulerDriver, offer *mesosproto.Offer) {
-	log.Infof("Reserving CPUs: %f, Mem: %f on offer %s", s.reserveCPUs, s.reserveMem, offer.Id)
-	offerIDs := []*mesosproto.OfferID{offer.Id}
-	cpuResource := mesosutil.NewScalarResource("cpus", s.reserveCPUs)
-	cpuResource.Role = proto.String(s.role)
-	memResource := mesosutil.NewScalarResource("mem", s.reserveMem)
-	memResource.Role = proto.String(s.role)
-
-	resources := []*mesosproto.Resource{cpuResource, memResource}
-	log.WithFields(log.Fields{"resources": resources}).Info("reserve resources")
-	operation := &mesosproto.Offer_Operation {
-			Type: mesosproto.Offer_Operation_RESERVE.Enum(),
-			Reserve: &mesosproto.Offer_Operation_Reserve{
-				Resources: resources,
-			},
+// countOffers counts the offers which were accepted, and those which were not, as declined
+func (s *demoScheduler) countOffers(used, failed []mesos.Offer) {
+	for _, offer := range used {
+		s.metrics.offerUsed(offer.ID)
 	}
-	log.WithFields(log.Fields{"operation": operation}).Info("reserve operation")
-	operations := []*mesosproto.Offer_Operation{}
-	operations = append(operations, operation)
-	log.WithFields(log.Fields{
-		"offer": offer,
-		"operations": operations,
-		"offerIDs": offerIDs,
-	}).Info("reserve resource")
-	status, err := driver.AcceptOffers(offerIDs, operations, defaultFilter)
-	if err != nil {
-		log.WithFields(log.Fields{"status": status, "err": err}).Error("reserve resource failed")
-		panic(err)
+	for _, offer := range failed {
+		s.metrics.offerDeclined(offer.ID)
 	}
-	log.WithFields(log.Fields{
-		"status": status.String(),
-		"offerIDs": offerIDs,
-	}).Info("reserve resource success")
-	s.alreadyReserved = true
 }
 
-func (s *demoScheduler) printOffers(offers []*mesosproto.Offer) {
+func (s *demoScheduler) printOffers(offers []mesos.Offer) {
 	log.Infof("Received %d resource offers", len(offers))
 	for _, offer := range offers {
-		log.WithFields(log.Fields{"offerID": offer.Id, "offer": offer}).Info("offer")
+		log.WithFields(log.Fields{"offerID": offer.ID.Value, "offer": offer}).Info("offer")
 	}
 }
 
-func (s *demoScheduler) declineOffers(driver scheduler.SchedulerDriver, offers []*mesosproto.Offer) {
+func (s *demoScheduler) declineOffers(driver schedulerDriver, offers []mesos.Offer) {
 	log.Debugf("decline %d resource offers", len(offers))
 	for _, offer := range offers {
-		driver.DeclineOffer(offer.Id, defaultFilter)
+		driver.DeclineOffer(offer.ID, defaultFilter)
+		s.metrics.offerDeclined(offer.ID)
 	}
 }
 
-func (s *demoScheduler) runCommandTasks(
-	driver scheduler.SchedulerDriver,
-	offers []*mesosproto.Offer,
-	taskFactory func(cmd string, offer *mesosproto.Offer) *mesosproto.TaskInfo) {
-
+// runCommandTasks places queued jobs on all offers of the batch together, each job with its own
+// placement strategy, then launches the tasks of every offer and declines the unused ones
+func (s *demoScheduler) runCommandTasks(driver schedulerDriver, offers []mesos.Offer) {
 	log.Debugf("Received %d resource offers", len(offers))
-	for _, offer := range offers {
-		log.WithFields(log.Fields{"offer": offer.String()}).Debugf("offer")
-		select {
-		case <-s.shutdown:
-			log.Println("Shutting down: declining offer on [", offer.Hostname, "]")
-			driver.DeclineOffer(offer.Id, defaultFilter)
+	select {
+	case <-s.shutdown:
+		log.Println("Shutting down: declining", len(offers), "offers")
+		s.declineOffers(driver, offers)
+		return
+	default:
+	}
+
+	batch := newPlacementBatch(offers, s.tasks, s.role)
+	for {
+		j, ok := s.shellCmdQueue.pop(batch.fits)
+		if !ok {
+			break
+		}
+		var v *volume
+		if existing, ok := s.shellCmdQueue.volume(j.Name, j.Instance); ok && j.spec.Volume != nil {
+			v = &existing
+		}
+		slot, claim := batch.place(j.spec, v)
+		task := s.newTask(j.spec, slot.offer, claim)
+		if j.spec.Volume != nil {
+			slot.operations = append(slot.operations, s.attachVolume(j, slot.offer, task)...)
+			if v == nil {
+				created, _ := s.shellCmdQueue.volume(j.Name, j.Instance)
+				slot.newVolumes[volumeKey(j.Name, j.Instance)] = created.ID
+			}
+		}
+		log.WithFields(log.Fields{"task": task, "jobID": j.ID, "placement": j.spec.Placement}).Info("command task")
+		s.tasks.add(task, slot.offer, j.ID)
+		s.shellCmdQueue.setTask(j.ID, task.TaskID.Value)
+		slot.tasks = append(slot.tasks, *task)
+		slot.jobs = append(slot.jobs, j)
+	}
+
+	for _, slot := range batch.slots {
+		if len(slot.tasks) == 0 {
+			log.WithFields(log.Fields{
+				"offerID":  slot.offer.ID.Value,
+				"hostname": slot.offer.Hostname,
+				"reasons":  slot.declineReasons(),
+			}).Info("decline offer")
+			driver.DeclineOffer(slot.offer.ID, defaultFilter)
+			s.metrics.offerDeclined(slot.offer.ID)
 			continue
-		default:
-		}
-
-		tasks := []*mesosproto.TaskInfo{}
-		tasksToLaunch := maxTasksForOffer(offer)
-		log.Debugf("tasksToLaunch = %d\n", tasksToLaunch)
-		for tasksToLaunch > 0 {
-			if s.shellCmdQueue.Front() != nil {
-				cmd := s.shellCmdQueue.Front().Value.(string)
-				s.shellCmdQueue.Remove(s.shellCmdQueue.Front())
-				task := taskFactory(cmd, offer)
-				log.WithFields(log.Fields{"task": task}).Info("command task")
-				tasks = append(tasks, task)
-				tasksToLaunch--
+		}
+		operations := append(slot.operations, launchOperation(slot.tasks))
+		if err := driver.AcceptOffers([]mesos.OfferID{slot.offer.ID}, operations, defaultFilter); err != nil {
+			if err != errDryRun {
+				log.WithFields(log.Fields{"offerID": slot.offer.ID.Value, "err": err}).Error("launch tasks failed")
 			}
-			if s.shellCmdQueue.Front() == nil {
-				break
+			s.unlaunch(slot)
+			s.metrics.offerDeclined(slot.offer.ID)
+			continue
+		}
+		for i, task := range slot.tasks {
+			// tasks which the plan left out as invalid failed already, they were never sent
+			if record, ok := s.tasks.get(task.TaskID.Value); ok && record.state == mesos.TASK_ERROR {
+				continue
 			}
+			s.metrics.taskLaunched(containerType(slot.jobs[i].spec), task.TaskID.Value, slot.jobs[i].QueuedAt)
 		}
+		s.metrics.offerUsed(slot.offer.ID)
+	}
+}
 
-		if len(tasks) == 0 {
-			driver.DeclineOffer(offer.Id, defaultFilter)
-		} else {
-			driver.LaunchTasks([]*mesosproto.OfferID{offer.Id}, tasks, defaultFilter)
+// unlaunch undoes the launch of the tasks of an offer which was not accepted: their jobs go back
+// to the front of the queue in their order, and the volumes which were to be created for them
+// are forgotten. Tasks which failed meanwhile were handled by their status update.
+func (s *demoScheduler) unlaunch(slot *offerSlot) {
+	for i := len(slot.tasks) - 1; i >= 0; i-- {
+		taskID := slot.tasks[i].TaskID.Value
+		if s.tasks.unlaunch(taskID) {
+			s.shellCmdQueue.requeue(slot.jobs[i].ID, taskID)
 		}
 	}
+	for key, id := range slot.newVolumes {
+		s.shellCmdQueue.forgetVolume(key, id)
+	}
 }
 
-func (s *demoScheduler) StatusUpdate(driver scheduler.SchedulerDriver, status *mesosproto.TaskStatus) {
+func (s *demoScheduler) StatusUpdate(driver schedulerDriver, status mesos.TaskStatus) {
 	reason := ""
 	if status.Reason != nil {
 		reason = status.Reason.String()
 	}
 	log.WithFields(log.Fields{
-		"taskID":          *status.TaskId.Value,
-		"status":          status.State.String(),
+		"taskID":          status.TaskID.Value,
+		"status":          status.GetState().String(),
 		"reason":          reason,
-		"source":          status.Source.String(),
+		"source":          status.GetSource().String(),
 		"containerStatus": status.ContainerStatus,
+		"healthy":         status.Healthy,
 	}).Info("received task status")
+
+	s.metrics.taskStatus(status)
+	task, wasTerminal := s.tasks.update(status)
+	if isTerminal(task.state) {
+		s.killer.done(task.taskID)
+	}
+	if task.state == mesos.TASK_RUNNING {
+		for _, r := range task.resources {
+			if r.IsPersistentVolume() {
+				s.shellCmdQueue.volumeCreated(r.GetDisk().GetPersistence().GetID())
+			}
+		}
+	}
+	log.WithFields(log.Fields{
+		"taskID":  task.taskID,
+		"state":   task.state.String(),
+		"slaveID": task.slaveID,
+		"updates": len(task.history),
+	}).Debug("task state updated")
+	if !wasTerminal && s.needsReplacement(task) {
+		s.handleTaskFailure(task)
+	} else if !wasTerminal && isTerminal(task.state) && task.jobID != "" {
+		s.shellCmdQueue.finish(task.jobID, task.taskID)
+	}
+}
+
+// needsReplacement reports whether the job of a task which just ended has to run again: every
+// task of a service, and failed tasks of batch jobs. A task which ends while unhealthy was
+// killed by its health check or by the health monitor.
+func (s *demoScheduler) needsReplacement(task *taskRecord) bool {
+	if !isTerminal(task.state) {
+		return false
+	}
+	return isFailure(task.state) || task.isUnhealthy() || s.shellCmdQueue.isService(task.jobID)
+}
+
+// handleTaskFailure puts the job of a failed task back into the queue until it ran out of
+// retries. Instances of a service are relaunched without limit, with backoff.
+func (s *demoScheduler) handleTaskFailure(task *taskRecord) {
+	fields := log.Fields{"taskID": task.taskID, "state": task.state.String(), "jobID": task.jobID}
+	if task.jobID == "" {
+		log.WithFields(fields).Warn("task failed, job unknown, not retrying")
+		return
+	}
+	if s.shellCmdQueue.isService(task.jobID) {
+		j, ok := s.shellCmdQueue.relaunch(task.jobID, time.Since(task.launchedAt))
+		if !ok {
+			log.WithFields(fields).Info("service instance ended, not relaunching")
+			return
+		}
+		fields["restarts"] = j.Restarts
+		fields["notBefore"] = *j.NotBefore
+		log.WithFields(fields).Warn("service instance ended, relaunching")
+		return
+	}
+	j, ok := s.shellCmdQueue.retry(task.jobID, s.maxRetries)
+	fields["attempt"] = j.Attempt
+	if !ok {
+		log.WithFields(fields).Error("task failed, giving up")
+		return
+	}
+	log.WithFields(fields).Warn("task failed, retrying")
 }
 
 func (s *demoScheduler) FrameworkMessage(
-	driver scheduler.SchedulerDriver,
-	executorID *mesosproto.ExecutorID,
-	slaveID *mesosproto.SlaveID,
-	message string) {
+	driver schedulerDriver,
+	executorID mesos.ExecutorID,
+	slaveID mesos.AgentID,
+	data []byte) {
 
 	log.WithFields(log.Fields{
-		"executorID": executorID,
-		"slaveID":    slaveID,
-		"message":    message,
+		"executorID": executorID.Value,
+		"slaveID":    slaveID.Value,
+		"message":    string(data),
 	}).Info("got a framework message")
 }
 
-func (s *demoScheduler) OfferRescinded(_ scheduler.SchedulerDriver, offerID *mesosproto.OfferID) {
-	log.Printf("Offer %s rescinded", offerID)
+func (s *demoScheduler) OfferRescinded(_ schedulerDriver, offerID mesos.OfferID) {
+	log.Printf("Offer %s rescinded", offerID.Value)
+	s.metrics.offerRescinded(offerID)
 }
-func (s *demoScheduler) SlaveLost(_ scheduler.SchedulerDriver, slaveID *mesosproto.SlaveID) {
-	log.Printf("Slave %s lost", slaveID)
+func (s *demoScheduler) SlaveLost(_ schedulerDriver, slaveID mesos.AgentID) {
+	log.Printf("Slave %s lost", slaveID.Value)
+	s.reservations.agentLost(slaveID.Value)
+	for _, id := range s.shellCmdQueue.agentVolumesLost(slaveID.Value) {
+		log.WithFields(log.Fields{"volume": id, "slaveID": slaveID.Value}).Warn("volume being created lost with slave")
+	}
+	for _, task := range s.tasks.slaveLost(slaveID.Value) {
+		log.WithFields(log.Fields{"taskID": task.taskID, "slaveID": task.slaveID}).Warn("task lost with slave")
+		s.killer.done(task.taskID)
+		s.handleTaskFailure(task)
+	}
 }
-func (s *demoScheduler) ExecutorLost(_ scheduler.SchedulerDriver, executorID *mesosproto.ExecutorID, slaveID *mesosproto.SlaveID,
+func (s *demoScheduler) ExecutorLost(_ schedulerDriver, executorID mesos.ExecutorID, slaveID mesos.AgentID,
 	status int) {
-	log.Printf("Executor %s on slave %s was lost", executorID, slaveID)
+	log.Printf("Executor %s on slave %s was lost", executorID.Value, slaveID.Value)
+	for _, task := range s.tasks.executorLost(executorID.Value, slaveID.Value) {
+		log.WithFields(log.Fields{"taskID": task.taskID, "executorID": task.executorID}).Warn("task lost with executor")
+		s.killer.done(task.taskID)
+		s.handleTaskFailure(task)
+	}
 }
 
-func (s *demoScheduler) Error(_ scheduler.SchedulerDriver, err string) {
+func (s *demoScheduler) Error(_ schedulerDriver, err string) {
 	log.Printf("Receiving an error: %s", err)
+	s.metrics.errorReceived()
+	// the master forgot about us (e.g. the failover timeout expired), register as a new framework next time
+	if strings.Contains(err, "Framework has been removed") || strings.Contains(err, "Completed framework") {
+		if clearErr := s.store.clear(); clearErr != nil {
+			log.WithFields(log.Fields{"err": clearErr}).Error("clear framework ID failed")
+		}
+	}
 }
 
 func init() {
@@ -402,10 +675,14 @@ func init() {
 }
 
 func main() {
-	master := flag.String("master", "127.0.1.1:5050", "Location of leading Mesos master")
-	host := flag.String("host", "127.0.0.1", "ip address which the framework bind")
+	if len(os.Args) > 1 && os.Args[1] == "journal" {
+		os.Exit(journalCommand(os.Args[2:]))
+	}
+	master := flag.String("master", "127.0.1.1:5050",
+		"Location of leading Mesos master, a comma separated list of masters, or zk://host1:2181,host2:2181/mesos")
 	role := flag.String("role", "*", "framework role")
-	taskNum := flag.Int("taskNum", 1, "number of tasks")
+	taskNum := flag.Int("taskNum", 1, "number of tasks to queue at start, more can be submitted through -api")
+	service := flag.Bool("service", false, "keep -taskNum tasks running, relaunching them whenever they end")
 	cmd := flag.String("cmd", "while true; do echo command running; sleep 10; done", "shell command")
 	justPrintOffers := flag.Bool("justPrintOffers", false, "do nothing bug print offers")
 	enableContainer := flag.Bool("enableContainer", false, "wether to use a container")
@@ -416,58 +693,319 @@ func main() {
 	network := flag.String("network", "host", "docker containerizer: docker network type, host|bridge|none|...")
 	networkName := flag.String("networkName", "", "mesos containerizer: name of CNI network to join")
 	expose := flag.String("expose", "", "comma separated container ports e.g. 8080,8090,9000")
-	reserveCPUs := flag.Float64("reserveCPUs", 0.0, "reserve cpus for role")
-	reserveMem := flag.Float64("reserveMem", 0.0, "reserve mem for role")
+	reserveCPUs := flag.Float64("reserveCPUs", 0.0, "cpus to keep reserved for role across the cluster, replaced by -reservations")
+	reserveMem := flag.Float64("reserveMem", 0.0, "mem to keep reserved for role across the cluster, replaced by -reservations")
+	reservationsFile := flag.String("reservations", "", "JSON file of resources to keep reserved for role, in total or per agent")
+	principal := flag.String("principal", defaultPrincipal, "framework principal, our reservations are made with it")
+	maxRetries := flag.Int("maxRetries", 3, "how many times a failed or lost command is retried")
+	stateFile := flag.String("stateFile", "rendler.state", "file to save the framework ID in")
+	failoverTimeout := flag.Duration("failoverTimeout", time.Duration(168)*time.Hour,
+		"how long the master keeps our tasks running after the scheduler went away")
+	apiAddr := flag.String("api", "", "address to serve the HTTP API on, e.g. :8000, disabled if empty")
+	zkServers := flag.String("zk", "", "comma separated zookeeper servers for leader election, e.g. zk1:2181,zk2:2181")
+	zkPath := flag.String("zkPath", "/rendler", "znode to run the leader election on")
+	zkSessionTimeout := flag.Duration("zkSessionTimeout", time.Duration(10)*time.Second, "zookeeper session timeout")
+	placement := flag.String("placement", placementFirstFit, "how to pick offers for tasks: firstFit|bestFit|spread|random")
+	portAllocation := flag.String("portAllocation", portAllocationSequential, "how to pick host ports from offers: sequential|random")
+	reservedOnly := flag.Bool("reservedOnly", false, "run tasks only on resources reserved for role")
+	jobsFile := flag.String("jobs", "", "JSON or YAML job spec file, replaces -cmd, -taskNum and the container flags")
+	fakeClusterFile := flag.String("fakeCluster", "",
+		"JSON description of a fake cluster to run against in-process instead of a Mesos master")
+	recordFile := flag.String("record", "", "file to record all callbacks and launches in, for -replay")
+	replayFile := flag.String("replay", "", "recording to replay instead of connecting to a Mesos master")
+	replayReport := flag.String("replayReport", "", "file to write the decisions made during -replay to as JSON lines")
+	shutdownMode := flag.String("shutdown", shutdownTeardown,
+		"what to do on SIGTERM or SIGINT: failover keeps the tasks running for the next scheduler, drain waits for the batch tasks to end and then fails over, teardown kills all tasks")
+	drainTimeout := flag.Duration("drainTimeout", time.Duration(10)*time.Minute, "how long -shutdown drain waits for batch tasks")
+	journalFile := flag.String("journal", "", "file to append all callbacks to as JSON lines, read with `rendler journal`")
+	journalMaxSize := flag.Int64("journalMaxSize", defaultJournalMaxSize, "size in bytes at which the journal is rotated")
+	journalMaxFiles := flag.Int("journalMaxFiles", defaultJournalMaxFiles, "how many rotated journal files are kept")
+	dryRun := flag.Bool("dryRun", false, "print what would be done with each offer and decline it instead, jobs stay queued")
 	flag.Parse()
 
-	if *enableContainer {
-		if *image == "" {
-			panic("image not specified")
+	switch *shutdownMode {
+	case shutdownFailover, shutdownDrain, shutdownTeardown:
+	default:
+		log.Errorf("Invalid shutdown mode %s", *shutdownMode)
+		os.Exit(1)
+	}
+
+	var jobs []*jobSpec
+	if *jobsFile != "" {
+		var err error
+		jobs, err = loadJobSpecs(*jobsFile)
+		if err != nil {
+			log.Errorf("Invalid job spec file %s: %s", *jobsFile, err)
+			os.Exit(1)
+		}
+	} else {
+		j := &jobSpec{Instances: *taskNum, Cmd: *cmd, Placement: *placement, PortAllocation: *portAllocation,
+			ReservedOnly: *reservedOnly}
+		if *service {
+			j.Type = jobTypeService
+		}
+		if *enableContainer {
+			j.Container = &containerSpec{
+				Type:        *containerType,
+				Image:       *image,
+				Network:     *network,
+				NetworkName: *networkName,
+			}
+		}
+		for _, port := range getContainerPorts(*expose) {
+			j.Ports = append(j.Ports, portSpec{ContainerPort: port})
+		}
+		j.setDefaults()
+		if *taskNum == 0 {
+			j.Instances = 0
+		} else if errs := j.validate(); len(errs) > 0 {
+			log.Errorf("Invalid flags: %s", errs)
+			os.Exit(1)
+		}
+		jobs = []*jobSpec{j}
+	}
+	for _, j := range jobs {
+		if errs := j.checkRole(*role); len(errs) > 0 {
+			log.Errorf("Invalid job %s: %s", j.Name, errs)
+			os.Exit(1)
 		}
 	}
 
-	exposePorts := getContainerPorts(*expose)
+	var reservations []*reservationTarget
+	if *reservationsFile != "" {
+		var err error
+		reservations, err = loadReservationTargets(*reservationsFile, *role)
+		if err != nil {
+			log.Errorf("Invalid reservation file %s: %s", *reservationsFile, err)
+			os.Exit(1)
+		}
+	} else if *reserveCPUs > 0 || *reserveMem > 0 {
+		t := &reservationTarget{Name: defaultReservationName, CPUs: *reserveCPUs, Mem: *reserveMem}
+		if errs := t.validate(*role); len(errs) > 0 {
+			log.Errorf("Invalid flags: %s", errs)
+			os.Exit(1)
+		}
+		reservations = []*reservationTarget{t}
+	}
 
 	demoSche := &demoScheduler{
-		enableContainer:  *enableContainer,
 		justPrintOffers:  *justPrintOffers,
 		enableCheckPoint: *enableCheckPoint,
 		role:             *role,
-		containerType:    *containerType,
-		image:            *image,
-		exposePorts:      exposePorts,
-		reserveCPUs:      *reserveCPUs,
-		reserveMem:      *reserveMem,
-		network:          *network,
-		networkName:      *networkName,
-		alreadyReserved:  false,
+		principal:        *principal,
+		maxRetries:       *maxRetries,
+		store:            newFileFrameworkStore(*stateFile),
 		shutdown:         make(chan struct{}),
-		shellCmdQueue:    list.New(),
+		stopped:          make(chan struct{}),
+		shutdownMode:     *shutdownMode,
+		drainTimeout:     *drainTimeout,
+		shellCmdQueue:    newCommandQueue(),
+		tasks:            newTaskRegistry(),
+		metrics:          newSchedulerMetrics(),
 	}
-	for i := 0; i < *taskNum; i++ {
-		demoSche.shellCmdQueue.PushBack(*cmd)
+	demoSche.reservations = newReservationManager(reservations, *role, *principal, demoSche.tasks)
+	for _, j := range jobs {
+		if j.Instances > 0 {
+			demoSche.startJobs = append(demoSche.startJobs, j)
+		}
 	}
 
-	driver, err := scheduler.NewMesosSchedulerDriver(scheduler.DriverConfig{
-		Master: *master,
-		Framework: &mesosproto.FrameworkInfo{
-			Name:       proto.String("RENDLER"),
-			User:       proto.String(""),
-			Role:       proto.String(*role),
-			Checkpoint: proto.Bool(*enableCheckPoint),
-		},
-		Scheduler:      demoSche,
-		BindingAddress: net.ParseIP(*host),
-	})
+	demoSche.start()
+	if *apiAddr != "" {
+		go (&apiServer{s: demoSche}).serve(*apiAddr)
+	}
+
+	framework := mesos.FrameworkInfo{
+		Name:            "RENDLER",
+		User:            "",
+		Role:            proto.String(*role),
+		Principal:       proto.String(*principal),
+		Checkpoint:      proto.Bool(*enableCheckPoint),
+		FailoverTimeout: proto.Float64(failoverTimeout.Seconds()),
+	}
+
+	connect := newHTTPDriverFactory()
+	detector, err := newMasterDetector(*master)
 	if err != nil {
-		log.Printf("Unable to create scheduler driver: %s", err)
+		log.Printf("Invalid master %s: %s", *master, err)
+		return
+	}
+	if *fakeClusterFile != "" {
+		if *zkServers != "" {
+			log.Errorf("-fakeCluster cannot be used with -zk")
+			os.Exit(1)
+		}
+		cluster, err := loadFakeCluster(*fakeClusterFile)
+		if err != nil {
+			log.Errorf("Invalid fake cluster %s: %s", *fakeClusterFile, err)
+			os.Exit(1)
+		}
+		connect = newFakeDriverFactory(cluster)
+		detector = staticMasterDetector("fake")
+		demoSche.store = &memoryFrameworkStore{}
+	}
+	if *replayFile != "" {
+		if *zkServers != "" || *fakeClusterFile != "" {
+			log.Errorf("-replay cannot be used with -zk or -fakeCluster")
+			os.Exit(1)
+		}
+		rec, err := loadRecording(*replayFile)
+		if err != nil {
+			log.Errorf("Invalid recording %s: %s", *replayFile, err)
+			os.Exit(1)
+		}
+		var report io.Writer
+		if *replayReport != "" {
+			file, err := os.Create(*replayReport)
+			if err != nil {
+				log.Errorf("Unable to create replay report %s: %s", *replayReport, err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			report = file
+		}
+		connect = newReplayDriverFactory(rec, report)
+		detector = staticMasterDetector("replay")
+		demoSche.store = &memoryFrameworkStore{}
+	}
+	if *recordFile != "" {
+		rec, err := newRecorder(*recordFile, framework)
+		if err != nil {
+			log.Errorf("Unable to record to %s: %s", *recordFile, err)
+			os.Exit(1)
+		}
+		defer rec.close()
+		connect = newRecordingDriverFactory(connect, rec)
+	}
+	if *journalFile != "" {
+		j, err := newJournal(*journalFile, *journalMaxSize, *journalMaxFiles)
+		if err != nil {
+			log.Errorf("Unable to open journal %s: %s", *journalFile, err)
+			os.Exit(1)
+		}
+		defer j.close()
+		connect = newJournalDriverFactory(connect, j)
+	}
+	// plans are checked closest to the scheduler, so that recordings and journals hold what
+	// reached the master
+	connect = newPlanningDriverFactory(connect, *dryRun)
+
+	stop := make(chan bool, 1)
+	go demoSche.handleSignal(stop)
+	if *zkServers == "" {
+		runFramework(demoSche, framework, detector, connect, stop, nil)
+		log.Println("Exiting...")
 		return
 	}
 
-	go demoSche.handleSignal(driver)
-
-	if status, err := driver.Run(); err != nil {
-		log.Printf("Framework stopped with status %s and error: %s\n", status.String(), err.Error())
+	elector, err := newLeaderElector(strings.Split(*zkServers, ","), *zkPath, *zkSessionTimeout)
+	if err != nil {
+		log.Printf("Unable to connect to zookeeper: %s", err)
+		return
+	}
+	defer elector.close()
+	demoSche.store = newZkFrameworkStore(elector.conn, elector.path+"/"+frameworkIDNode)
+	// a standby replica has nothing to shut down, it just leaves the election
+campaign:
+	for {
+		lost, err := elector.campaign(demoSche.shutdown)
+		if err == errCampaignCanceled {
+			break
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"err": err}).Error("leader election failed, retrying")
+			select {
+			case <-time.After(*zkSessionTimeout):
+			case <-demoSche.shutdown:
+				break campaign
+			}
+			continue
+		}
+		if !runFramework(demoSche, framework, detector, connect, stop, lost) {
+			break
+		}
+		// another replica leads now, stand by to take over from it
+		elector.resign()
 	}
 	log.Println("Exiting...")
 }
+
+// runFramework runs a scheduler driver against the leading master, and replaces it with a new
+// one, failing over to the same framework, whenever another master takes over. It returns when
+// the framework is stopped through stop, or true when lost is closed: we are no longer the
+// leader and stopped with failover, so that the tasks keep running for the new leader.
+func runFramework(s *demoScheduler, framework mesos.FrameworkInfo, detector masterDetector, connect driverFactory,
+	stop <-chan bool, lost <-chan struct{}) bool {
+	stopDetector := make(chan struct{})
+	defer close(stopDetector)
+	leaders := detector.detect(stopDetector)
+
+	var driver schedulerDriver
+	var done chan struct{}
+	stopDriver := func(failover bool) {
+		if driver == nil {
+			return
+		}
+		driver.Stop(failover)
+		<-done
+		driver = nil
+		done = nil
+	}
+
+	for {
+		select {
+		case master, ok := <-leaders:
+			if !ok {
+				log.Println("Master detection stopped")
+				stopDriver(true)
+				return false
+			}
+			stopDriver(true)
+			log.WithFields(log.Fields{"master": master}).Info("connecting to leading master")
+			d, err := newDriver(s, master, framework, connect)
+			if err != nil {
+				log.Printf("Unable to create scheduler driver: %s", err)
+				return false
+			}
+			driver = d
+			done = make(chan struct{})
+			go func(done chan struct{}) {
+				defer close(done)
+				if err := d.Run(); err != nil {
+					log.Printf("Framework stopped with error: %s\n", err.Error())
+				}
+			}(done)
+		case <-done:
+			return false
+		case <-lost:
+			log.Println("Lost leadership, stopping the driver")
+			stopDriver(true)
+			return true
+		case failover := <-stop:
+			stopDriver(failover)
+			// a torn down framework can't be failed over to, the next start registers a new one
+			if !failover {
+				if err := s.store.clear(); err != nil {
+					log.WithFields(log.Fields{"err": err}).Error("clear framework ID failed")
+				}
+			}
+			return false
+		}
+	}
+}
+
+// newDriver creates a driver which subscribes with the FrameworkID from the store, if any
+func newDriver(s *demoScheduler, master string, framework mesos.FrameworkInfo, connect driverFactory) (schedulerDriver, error) {
+	frameworkID, err := s.store.load()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load framework ID: %s", err)
+	}
+	if frameworkID != "" {
+		log.WithFields(log.Fields{"frameworkID": frameworkID}).Info("failing over to existing framework")
+		framework.ID = &mesos.FrameworkID{Value: frameworkID}
+	} else {
+		// a new framework has no tasks yet
+		s.submitStartJobs()
+	}
+	return connect(master, framework, s), nil
+}
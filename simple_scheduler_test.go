@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mesos/mesos-go"
+)
+
+func TestJobName(t *testing.T) {
+	tests := map[string]string{
+		"web.8f1c2a4e-6b1d-4c55-9b8a-1d0c8f6e2f3a": "web",
+		"web":  "",
+		".abc": "",
+		"":     "",
+	}
+	for taskID, want := range tests {
+		if got := jobName(taskID); got != want {
+			t.Errorf("%q: got %q, want %q", taskID, got, want)
+		}
+	}
+}
+
+// TestSubmitStartJobs fails over to a framework whose tasks were reconciled, and submits the jobs
+// the scheduler was started with
+func TestSubmitStartJobs(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     string
+		running  []string
+		ended    []string
+		attached []string
+		queued   []int
+		extra    int
+	}{
+		{
+			name:   "no tasks",
+			spec:   `{"name": "web", "type": "service", "instances": 2, "cmd": "x"}`,
+			queued: []int{0, 1},
+		},
+		{
+			name:     "some instances still run",
+			spec:     `{"name": "web", "type": "service", "instances": 3, "cmd": "x"}`,
+			running:  []string{"web.b", "web.a", "webapp.c"},
+			ended:    []string{"web.d"},
+			attached: []string{"web.a", "web.b"},
+			queued:   []int{2},
+		},
+		{
+			name:     "more tasks than instances",
+			spec:     `{"name": "web", "instances": 1, "cmd": "x"}`,
+			running:  []string{"web.a", "web.b"},
+			attached: []string{"web.a"},
+			queued:   []int{},
+			extra:    1,
+		},
+	}
+	for _, test := range tests {
+		s := &demoScheduler{shellCmdQueue: newCommandQueue(), tasks: newTaskRegistry()}
+		status := func(taskID string, state mesos.TaskState) {
+			s.tasks.update(mesos.TaskStatus{TaskID: mesos.TaskID{Value: taskID}, State: state.Enum()})
+		}
+		for _, taskID := range test.running {
+			status(taskID, mesos.TASK_RUNNING)
+		}
+		for _, taskID := range test.ended {
+			status(taskID, mesos.TASK_FINISHED)
+		}
+		s.startJobs = []*jobSpec{testJob(t, test.spec)}
+		s.submitStartJobs()
+		// a later reconciliation submits nothing again
+		s.submitStartJobs()
+
+		launched := []string{}
+		for i := 1; ; i++ {
+			j, ok := s.shellCmdQueue.get(fmt.Sprintf("job-%d", i))
+			if !ok {
+				break
+			}
+			if j.State != jobLaunched {
+				continue
+			}
+			launched = append(launched, fmt.Sprintf("%d:%s", j.Instance, j.TaskID))
+			task, _ := s.tasks.get(j.TaskID)
+			if task.name != "web" || task.jobID != j.ID {
+				t.Errorf("%s: task %s has name %q and job %q, want web and %s", test.name, j.TaskID, task.name, task.jobID, j.ID)
+			}
+		}
+		want := []string{}
+		for i, taskID := range test.attached {
+			want = append(want, fmt.Sprintf("%d:%s", i, taskID))
+		}
+		if fmt.Sprint(launched) != fmt.Sprint(want) {
+			t.Errorf("%s: reattached %v, want %v", test.name, launched, want)
+		}
+		if got := instances(s.shellCmdQueue.queued()); fmt.Sprint(got) != fmt.Sprint(test.queued) {
+			t.Errorf("%s: queued %v, want %v", test.name, got, test.queued)
+		}
+		unattached := s.tasks.list(func(t *taskRecord) bool { return jobName(t.taskID) == "web" && t.jobID == "" && !isTerminal(t.state) })
+		if len(unattached) != test.extra {
+			t.Errorf("%s: %d tasks left unattached, want %d", test.name, len(unattached), test.extra)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/samuel/go-zookeeper/zk"
+)
+
+// frameworkStore persists the FrameworkID, so that a restarted scheduler can fail over
+// to the framework it registered before instead of orphaning its tasks
+type frameworkStore interface {
+	// load returns the saved FrameworkID, or "" if there is none
+	load() (string, error)
+	save(frameworkID string) error
+	clear() error
+}
+
+type frameworkState struct {
+	FrameworkID string `json:"frameworkID"`
+}
+
+// fileFrameworkStore keeps the FrameworkID in a local JSON file
+type fileFrameworkStore struct {
+	path string
+}
+
+func newFileFrameworkStore(path string) *fileFrameworkStore {
+	return &fileFrameworkStore{path: path}
+}
+
+func (f *fileFrameworkStore) load() (string, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	state := frameworkState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return "", err
+	}
+	return state.FrameworkID, nil
+}
+
+// save writes to a temporary file first, so a crash never leaves a half written state file
+func (f *fileFrameworkStore) save(frameworkID string) error {
+	data, err := json.Marshal(frameworkState{FrameworkID: frameworkID})
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path)
+}
+
+func (f *fileFrameworkStore) clear() error {
+	err := os.Remove(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// zkFrameworkStore keeps the FrameworkID in a znode, so that every scheduler replica of
+// a leader election fails over to the same framework
+type zkFrameworkStore struct {
+	conn *zk.Conn
+	path string
+}
+
+func newZkFrameworkStore(conn *zk.Conn, path string) *zkFrameworkStore {
+	return &zkFrameworkStore{conn: conn, path: path}
+}
+
+func (z *zkFrameworkStore) load() (string, error) {
+	data, _, err := z.conn.Get(z.path)
+	if err == zk.ErrNoNode {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	state := frameworkState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return "", err
+	}
+	return state.FrameworkID, nil
+}
+
+func (z *zkFrameworkStore) save(frameworkID string) error {
+	data, err := json.Marshal(frameworkState{FrameworkID: frameworkID})
+	if err != nil {
+		return err
+	}
+	_, err = z.conn.Set(z.path, data, -1)
+	if err == zk.ErrNoNode {
+		_, err = z.conn.Create(z.path, data, 0, zk.WorldACL(zk.PermAll))
+	}
+	return err
+}
+
+func (z *zkFrameworkStore) clear() error {
+	err := z.conn.Delete(z.path, -1)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	return err
+}
+
+// memoryFrameworkStore forgets the FrameworkID on exit, it is used with a fake cluster which
+// must not leave its framework behind for a real master
+type memoryFrameworkStore struct {
+	frameworkID string
+}
+
+func (m *memoryFrameworkStore) load() (string, error) {
+	return m.frameworkID, nil
+}
+
+func (m *memoryFrameworkStore) save(frameworkID string) error {
+	m.frameworkID = frameworkID
+	return nil
+}
+
+func (m *memoryFrameworkStore) clear() error {
+	m.frameworkID = ""
+	return nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+// taskRecord is everything the scheduler knows about one task
+type taskRecord struct {
+	taskID     string
+	name       string
+	cmd        string
+	slaveID    string
+	hostname   string
+	attributes map[string]string
+	labels     map[string]string
+	resources  mesos.Resources
+	executorID string
+	jobID      string
+	state      mesos.TaskState
+	launchedAt time.Time
+	updatedAt  time.Time
+	history    []*mesos.TaskStatus
+	// healthy is the result of the last health check, nil until the first check
+	healthy        *bool
+	unhealthySince time.Time
+	// unhealthyTimeout is how long the task may stay unhealthy, zero without a health check
+	unhealthyTimeout time.Duration
+	killRequestedAt  time.Time
+}
+
+// isUnhealthy reports whether the last health check of the task failed
+func (t *taskRecord) isUnhealthy() bool {
+	return t.healthy != nil && !*t.healthy
+}
+
+// copy returns a snapshot of the record which is safe to use without holding the registry lock
+func (t *taskRecord) copy() *taskRecord {
+	c := *t
+	c.history = make([]*mesos.TaskStatus, len(t.history))
+	copy(c.history, t.history)
+	return &c
+}
+
+// maxEndedTasks is how many tasks which ended the registry keeps, the oldest are forgotten
+const maxEndedTasks = 1000
+
+// taskRegistry keeps the current state of every task, keyed by TaskID, and of the last
+// maxEndedTasks tasks which ended. Driver callbacks run on other goroutines, so all access goes
+// through the lock.
+type taskRegistry struct {
+	sync.RWMutex
+	tasks map[string]*taskRecord
+	// ended are the IDs of the tasks which ended in the order they did, forgotten counts the
+	// tasks which were pruned by their final state
+	ended     []string
+	maxEnded  int
+	forgotten map[mesos.TaskState]int
+}
+
+func newTaskRegistry() *taskRegistry {
+	return &taskRegistry{
+		tasks:     make(map[string]*taskRecord),
+		maxEnded:  maxEndedTasks,
+		forgotten: make(map[mesos.TaskState]int),
+	}
+}
+
+// isTerminal reports whether a task in this state will never change again
+func isTerminal(state mesos.TaskState) bool {
+	switch state {
+	case mesos.TASK_FINISHED,
+		mesos.TASK_FAILED,
+		mesos.TASK_KILLED,
+		mesos.TASK_ERROR,
+		mesos.TASK_LOST:
+		return true
+	}
+	return false
+}
+
+// isFailure reports whether a task in this state ended without doing its work
+func isFailure(state mesos.TaskState) bool {
+	switch state {
+	case mesos.TASK_FAILED,
+		mesos.TASK_ERROR,
+		mesos.TASK_LOST:
+		return true
+	}
+	return false
+}
+
+// add records a task which is about to be launched on the given offer
+func (r *taskRegistry) add(task *mesos.TaskInfo, offer *mesos.Offer, jobID string) {
+	now := time.Now()
+	record := &taskRecord{
+		taskID:     task.TaskID.Value,
+		name:       task.Name,
+		slaveID:    offer.AgentID.Value,
+		hostname:   offer.Hostname,
+		attributes: offerAttributes(offer),
+		resources:  mesos.Resources(task.Resources).Clone(),
+		jobID:      jobID,
+		state:      mesos.TASK_STAGING,
+		launchedAt: now,
+		updatedAt:  now,
+		// the timeout starts with the first failure, after the grace period
+		unhealthyTimeout: unhealthyTimeout(task.HealthCheck),
+	}
+	if task.Labels != nil {
+		record.labels = make(map[string]string)
+		for _, label := range task.Labels.Labels {
+			record.labels[label.Key] = label.GetValue()
+		}
+	}
+	if task.Executor != nil {
+		record.executorID = task.Executor.ExecutorID.Value
+	}
+	if task.Command != nil {
+		record.cmd = task.Command.GetValue()
+	}
+	// command tasks run under an executor which has the same ID as the task
+	if record.executorID == "" {
+		record.executorID = record.taskID
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	r.tasks[record.taskID] = record
+}
+
+// jobName returns the name of the job a task was launched for, task IDs are <name>.<uuid>
+func jobName(taskID string) string {
+	if i := strings.Index(taskID, "."); i > 0 {
+		return taskID[:i]
+	}
+	return ""
+}
+
+// reattach gives a task which update added on the fly the name and job it was launched for
+func (r *taskRegistry) reattach(taskID, name, jobID string) {
+	r.Lock()
+	defer r.Unlock()
+	if record, ok := r.tasks[taskID]; ok {
+		record.name = name
+		record.jobID = jobID
+	}
+}
+
+// agentsOffered fills in the hostname and attributes of the agents of the offers for the tasks
+// on them which update added on the fly, e.g. after a failover, so that constraints count them
+func (r *taskRegistry) agentsOffered(offers []mesos.Offer) {
+	agents := make(map[string]*mesos.Offer)
+	for i := range offers {
+		agents[offers[i].AgentID.Value] = &offers[i]
+	}
+	r.Lock()
+	defer r.Unlock()
+	for _, record := range r.tasks {
+		offer, ok := agents[record.slaveID]
+		if !ok || record.hostname != "" || isTerminal(record.state) {
+			continue
+		}
+		record.hostname = offer.Hostname
+		record.attributes = offerAttributes(offer)
+	}
+}
+
+// unlaunch forgets a task which was added but never launched, because the offer it was to be
+// launched with was not accepted. Tasks which got a status update meanwhile are kept.
+func (r *taskRegistry) unlaunch(taskID string) bool {
+	r.Lock()
+	defer r.Unlock()
+	record, ok := r.tasks[taskID]
+	if !ok || record.state != mesos.TASK_STAGING || len(record.history) > 0 {
+		return false
+	}
+	delete(r.tasks, taskID)
+	return true
+}
+
+// update applies a status update and returns a snapshot of the updated record, and whether
+// the task was already terminal before. Tasks we did not launch ourselves (e.g. before a
+// restart) are added on the fly.
+func (r *taskRegistry) update(status mesos.TaskStatus) (*taskRecord, bool) {
+	taskID := status.TaskID.Value
+
+	r.Lock()
+	defer r.Unlock()
+	record, ok := r.tasks[taskID]
+	if !ok {
+		record = &taskRecord{
+			taskID:     taskID,
+			executorID: status.GetExecutorID().GetValue(),
+		}
+		r.tasks[taskID] = record
+	}
+	wasTerminal := ok && isTerminal(record.state)
+	if slaveID := status.GetAgentID().GetValue(); slaveID != "" {
+		record.slaveID = slaveID
+	}
+	record.state = status.GetState()
+	record.updatedAt = time.Now()
+	if status.Healthy != nil {
+		if !*status.Healthy && !record.isUnhealthy() {
+			record.unhealthySince = record.updatedAt
+		}
+		record.healthy = proto.Bool(*status.Healthy)
+	}
+	record.history = append(record.history, &status)
+	snapshot := record.copy()
+	if !wasTerminal && isTerminal(record.state) {
+		r.taskEnded(record)
+	}
+	return snapshot, wasTerminal
+}
+
+// taskEnded keeps a task which just ended, and prunes the tasks which ended before the last
+// maxEnded ones. Their final status was acknowledged long ago. The caller must hold the lock.
+func (r *taskRegistry) taskEnded(record *taskRecord) {
+	// a task which was lost may come back and end again, it is kept once
+	for _, taskID := range r.ended {
+		if taskID == record.taskID {
+			return
+		}
+	}
+	r.ended = append(r.ended, record.taskID)
+	for len(r.ended) > r.maxEnded {
+		taskID := r.ended[0]
+		r.ended = r.ended[1:]
+		if old, ok := r.tasks[taskID]; ok && isTerminal(old.state) {
+			r.forgotten[old.state]++
+			delete(r.tasks, taskID)
+		}
+	}
+}
+
+// unhealthy returns the running tasks which stayed unhealthy for longer than their timeout and
+// records that they are being killed, so that they are killed again only after another timeout
+func (r *taskRegistry) unhealthy(now time.Time) []*taskRecord {
+	r.Lock()
+	defer r.Unlock()
+	tasks := []*taskRecord{}
+	for _, record := range r.tasks {
+		if isTerminal(record.state) || !record.isUnhealthy() || record.unhealthyTimeout == 0 {
+			continue
+		}
+		if now.Sub(record.unhealthySince) < record.unhealthyTimeout ||
+			now.Sub(record.killRequestedAt) < record.unhealthyTimeout {
+			continue
+		}
+		record.killRequestedAt = now
+		tasks = append(tasks, record.copy())
+	}
+	return tasks
+}
+
+// slaveLost marks every unfinished task on the slave as lost and returns them
+func (r *taskRegistry) slaveLost(slaveID string) []*taskRecord {
+	r.Lock()
+	defer r.Unlock()
+	lost := []*taskRecord{}
+	for _, record := range r.tasks {
+		if record.slaveID != slaveID || isTerminal(record.state) {
+			continue
+		}
+		r.markLost(record, mesos.REASON_AGENT_REMOVED, "slave lost")
+		lost = append(lost, record.copy())
+	}
+	return lost
+}
+
+// executorLost marks every unfinished task of the executor as lost and returns them
+func (r *taskRegistry) executorLost(executorID, slaveID string) []*taskRecord {
+	r.Lock()
+	defer r.Unlock()
+	lost := []*taskRecord{}
+	for _, record := range r.tasks {
+		if record.executorID != executorID || record.slaveID != slaveID || isTerminal(record.state) {
+			continue
+		}
+		r.markLost(record, mesos.REASON_EXECUTOR_TERMINATED, "executor lost")
+		lost = append(lost, record.copy())
+	}
+	return lost
+}
+
+// markLost appends a synthetic TASK_LOST status, the caller must hold the lock
+func (r *taskRegistry) markLost(record *taskRecord, reason mesos.TaskStatus_Reason, message string) {
+	now := time.Now()
+	status := &mesos.TaskStatus{
+		TaskID:    mesos.TaskID{Value: record.taskID},
+		State:     mesos.TASK_LOST.Enum(),
+		Source:    mesos.SOURCE_MASTER.Enum(),
+		Reason:    reason.Enum(),
+		Message:   proto.String(message),
+		AgentID:   &mesos.AgentID{Value: record.slaveID},
+		Timestamp: proto.Float64(float64(now.UnixNano()) / float64(time.Second)),
+	}
+	record.state = mesos.TASK_LOST
+	record.updatedAt = now
+	record.history = append(record.history, status)
+	r.taskEnded(record)
+}
+
+// get returns a snapshot of one task
+func (r *taskRegistry) get(taskID string) (*taskRecord, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	record, ok := r.tasks[taskID]
+	if !ok {
+		return nil, false
+	}
+	return record.copy(), true
+}
+
+// list returns snapshots of all tasks, optionally filtered
+func (r *taskRegistry) list(filter func(*taskRecord) bool) []*taskRecord {
+	r.RLock()
+	defer r.RUnlock()
+	records := []*taskRecord{}
+	for _, record := range r.tasks {
+		if filter == nil || filter(record) {
+			records = append(records, record.copy())
+		}
+	}
+	return records
+}
+
+// states counts the tasks the registry keeps by state, and separately those which ended and
+// were pruned since by their final state
+func (r *taskRegistry) states() (states, forgotten map[mesos.TaskState]int) {
+	r.RLock()
+	defer r.RUnlock()
+	states = make(map[mesos.TaskState]int)
+	for _, record := range r.tasks {
+		states[record.state]++
+	}
+	forgotten = make(map[mesos.TaskState]int)
+	for state, n := range r.forgotten {
+		forgotten[state] = n
+	}
+	return states, forgotten
+}
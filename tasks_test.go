@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mesos/mesos-go"
+)
+
+func TestTaskRegistryPrunesEndedTasks(t *testing.T) {
+	r := newTaskRegistry()
+	r.maxEnded = 2
+	offer := &mesos.Offer{AgentID: mesos.AgentID{Value: "a1"}, Hostname: "h1"}
+	for i := 0; i < 4; i++ {
+		id := fmt.Sprintf("t%d", i)
+		r.add(&mesos.TaskInfo{TaskID: mesos.TaskID{Value: id}, Name: id, AgentID: offer.AgentID}, offer, "")
+	}
+	status := func(taskID string, state mesos.TaskState) {
+		r.update(mesos.TaskStatus{TaskID: mesos.TaskID{Value: taskID}, State: state.Enum()})
+	}
+	status("t0", mesos.TASK_RUNNING)
+	status("t0", mesos.TASK_FINISHED)
+	status("t1", mesos.TASK_FAILED)
+	// a duplicate of the final status doesn't count as another task which ended
+	status("t1", mesos.TASK_FAILED)
+	status("t2", mesos.TASK_KILLED)
+	r.slaveLost("a1")
+	// a task which was lost with its agent comes back and ends again
+	status("t3", mesos.TASK_RUNNING)
+	status("t3", mesos.TASK_FINISHED)
+
+	for taskID, kept := range map[string]bool{"t0": false, "t1": false, "t2": true, "t3": true} {
+		if _, ok := r.get(taskID); ok != kept {
+			t.Errorf("%s: kept is %t, want %t", taskID, ok, kept)
+		}
+	}
+	states, forgotten := r.states()
+	want := map[mesos.TaskState]int{
+		mesos.TASK_FINISHED: 1,
+		mesos.TASK_KILLED:   1,
+	}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Errorf("got states %v, want %v", states, want)
+	}
+	want = map[mesos.TaskState]int{
+		mesos.TASK_FINISHED: 1,
+		mesos.TASK_FAILED:   1,
+	}
+	if fmt.Sprint(forgotten) != fmt.Sprint(want) {
+		t.Errorf("got forgotten %v, want %v", forgotten, want)
+	}
+}
+
+func TestTaskRegistryAgentsOffered(t *testing.T) {
+	r := newTaskRegistry()
+	// tasks reconciled after a failover only have their agent
+	for _, taskID := range []string{"web.1", "web.2"} {
+		r.update(mesos.TaskStatus{
+			TaskID:  mesos.TaskID{Value: taskID},
+			State:   mesos.TASK_RUNNING.Enum(),
+			AgentID: &mesos.AgentID{Value: "a1"},
+		})
+	}
+	r.update(mesos.TaskStatus{
+		TaskID:  mesos.TaskID{Value: "web.3"},
+		State:   mesos.TASK_RUNNING.Enum(),
+		AgentID: &mesos.AgentID{Value: "a2"},
+	})
+	r.agentsOffered([]mesos.Offer{{
+		AgentID:  mesos.AgentID{Value: "a1"},
+		Hostname: "h1",
+		Attributes: []mesos.Attribute{{
+			Name: "rack",
+			Type: mesos.TEXT.Enum(),
+			Text: &mesos.Value_Text{Value: "r1"},
+		}},
+	}})
+
+	tests := []struct {
+		taskID   string
+		hostname string
+		rack     string
+	}{
+		{taskID: "web.1", hostname: "h1", rack: "r1"},
+		{taskID: "web.2", hostname: "h1", rack: "r1"},
+		{taskID: "web.3"},
+	}
+	for _, test := range tests {
+		record, ok := r.get(test.taskID)
+		if !ok {
+			t.Errorf("%s: not found", test.taskID)
+			continue
+		}
+		if record.hostname != test.hostname || record.attributes["rack"] != test.rack {
+			t.Errorf("%s: got hostname %q and rack %q, want %q and %q",
+				test.taskID, record.hostname, record.attributes["rack"], test.hostname, test.rack)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+	"github.com/pborman/uuid"
+)
+
+// volumeLabel marks the reservations of our volumes, its value is the volumeKey of the instance
+// the volume belongs to
+const volumeLabel = "rendler-volume"
+
+// offeredVolume returns the persistent volume with the ID if the offer has it
+func offeredVolume(offer *mesos.Offer, id string) *mesos.Resource {
+	for i := range offer.Resources {
+		r := &offer.Resources[i]
+		if r.IsPersistentVolume() && r.GetDisk().GetPersistence().GetID() == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// volumeDisk is the unreserved disk a task of the job needs from the offer besides its own, to
+// create the volume of its instance there if the offer doesn't have it
+func volumeDisk(j *jobSpec, v *volume, offer *mesos.Offer) float64 {
+	if j.Volume == nil || (v != nil && offeredVolume(offer, v.ID) != nil) {
+		return 0
+	}
+	return j.Volume.Size
+}
+
+// newVolumeResource is the persistent volume with the ID for an instance of the job
+func (s *demoScheduler) newVolumeResource(j job, id string) mesos.Resource {
+	r := *mesos.BuildResource().Name("disk").Scalar(j.spec.Volume.Size).Role(s.role).
+		Disk(id, j.spec.Volume.ContainerPath).Resource
+	r.Disk.Volume.Mode = mesos.RW.Enum()
+	r.Disk.Persistence.Principal = proto.String(s.principal)
+	r.Reservation = &mesos.Resource_ReservationInfo{
+		Principal: proto.String(s.principal),
+		Labels: &mesos.Labels{Labels: []mesos.Label{
+			{Key: volumeLabel, Value: proto.String(volumeKey(j.Name, j.Instance))},
+		}},
+	}
+	return r
+}
+
+// withoutDisk is a volume as the reserved disk it was created from
+func withoutDisk(r mesos.Resource) mesos.Resource {
+	stripped := *proto.Clone(&r).(*mesos.Resource)
+	stripped.Disk = nil
+	return stripped
+}
+
+// attachVolume adds the volume of the job's instance to the task and returns the operations to
+// run before the launch: none if the offer has the volume, otherwise RESERVE and CREATE for a
+// new one, which the instance keeps from then on. The offer is from the agent of a volume which
+// is being created, see candidates.
+func (s *demoScheduler) attachVolume(j job, offer *mesos.Offer, task *mesos.TaskInfo) []mesos.Offer_Operation {
+	v, ok := s.shellCmdQueue.volume(j.Name, j.Instance)
+	if ok {
+		if offered := offeredVolume(offer, v.ID); offered != nil {
+			task.Resources = append(task.Resources, *offered)
+			return nil
+		}
+	} else {
+		v.ID = fmt.Sprintf("%s.%d.%s", j.Name, j.Instance, uuid.New())
+	}
+	// a volume which was never seen may not have been created, it is created again on its agent
+	v = volume{ID: v.ID, AgentID: offer.AgentID.Value, Hostname: offer.Hostname}
+	s.shellCmdQueue.setVolume(j.Name, j.Instance, v)
+	r := s.newVolumeResource(j, v.ID)
+	task.Resources = append(task.Resources, r)
+	log.WithFields(log.Fields{"jobID": j.ID, "volume": v.ID, "hostname": v.Hostname}).Info("creating volume")
+	return []mesos.Offer_Operation{
+		{
+			Type:    mesos.RESERVE.Enum(),
+			Reserve: &mesos.Offer_Operation_Reserve{Resources: []mesos.Resource{withoutDisk(r)}},
+		},
+		{
+			Type:   mesos.CREATE.Enum(),
+			Create: &mesos.Offer_Operation_Create{Volumes: []mesos.Resource{r}},
+		},
+	}
+}
+
+// volumeOf returns the volumeKey of one of our volumes
+func (s *demoScheduler) volumeOf(r *mesos.Resource) (string, bool) {
+	if !r.IsPersistentVolume() || r.GetRole() != s.role || r.Reservation.GetPrincipal() != s.principal {
+		return "", false
+	}
+	for _, label := range r.Reservation.GetLabels().GetLabels() {
+		if label.Key != volumeLabel {
+			continue
+		}
+		// the key is name/instance
+		parts := strings.SplitN(label.GetValue(), "/", 2)
+		if len(parts) != 2 {
+			return "", false
+		}
+		if _, err := strconv.Atoi(parts[1]); err != nil {
+			return "", false
+		}
+		return label.GetValue(), true
+	}
+	return "", false
+}
+
+// manageVolumes takes note of our volumes in the offers, and destroys and unreserves those of
+// deleted jobs. It returns the offers it did not use, those it accepted, and those it failed to
+// accept.
+func (s *demoScheduler) manageVolumes(driver schedulerDriver, offers []mesos.Offer) (unused, used, failed []mesos.Offer) {
+	for i := range offers {
+		offer := &offers[i]
+		destroy, unreserve := []mesos.Resource{}, []mesos.Resource{}
+		keys := []string{}
+		for _, r := range offer.Resources {
+			key, ok := s.volumeOf(&r)
+			if !ok {
+				continue
+			}
+			v := volume{ID: r.GetDisk().GetPersistence().GetID(), AgentID: offer.AgentID.Value, Hostname: offer.Hostname}
+			if s.shellCmdQueue.volumeOffered(key, v) {
+				destroy = append(destroy, r)
+				unreserve = append(unreserve, withoutDisk(r))
+				keys = append(keys, key)
+			}
+		}
+		if len(destroy) == 0 {
+			unused = append(unused, *offer)
+			continue
+		}
+		operations := []mesos.Offer_Operation{
+			{Type: mesos.DESTROY.Enum(), Destroy: &mesos.Offer_Operation_Destroy{Volumes: destroy}},
+			{Type: mesos.UNRESERVE.Enum(), Unreserve: &mesos.Offer_Operation_Unreserve{Resources: unreserve}},
+		}
+		fields := log.Fields{"offerID": offer.ID.Value, "hostname": offer.Hostname, "volumes": keys}
+		log.WithFields(fields).Info("destroying volumes")
+		if err := driver.AcceptOffers([]mesos.OfferID{offer.ID}, operations, defaultFilter); err != nil {
+			if err != errDryRun {
+				fields["err"] = err
+				log.WithFields(fields).Error("destroy volumes failed")
+			}
+			failed = append(failed, *offer)
+			continue
+		}
+		for _, key := range keys {
+			s.shellCmdQueue.volumeDestroyed(key)
+		}
+		used = append(used, *offer)
+	}
+	return unused, used, failed
+}
+
+// deleteJob deletes a job which is queued or whose task ended, and destroys its volume
+func (s *demoScheduler) deleteJob(id string) (job, error) {
+	j, ok := s.shellCmdQueue.get(id)
+	if !ok {
+		return job{}, errJobNotFound
+	}
+	task, ok := s.tasks.get(j.TaskID)
+	return s.shellCmdQueue.delete(id, ok && !isTerminal(task.state))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/mesos/mesos-go"
+)
+
+// operationTypes returns the types of the operations, e.g. "RESERVE CREATE"
+func operationTypes(operations []mesos.Offer_Operation) string {
+	types := []string{}
+	for _, op := range operations {
+		types = append(types, op.GetType().String())
+	}
+	return strings.Join(types, " ")
+}
+
+// volumeScheduler is a scheduler for role web with one stateful job, db
+func volumeScheduler(t *testing.T) (*demoScheduler, job) {
+	s := &demoScheduler{role: "web", principal: "rendler", shellCmdQueue: newCommandQueue()}
+	jobs, err := s.shellCmdQueue.submit(testJob(t, `{"name": "db", "cmd": "x", "volume": {"size": 100, "containerPath": "data"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, jobs[0]
+}
+
+func TestAttachVolume(t *testing.T) {
+	tests := []struct {
+		name string
+		// known is the volume of the instance before, if it has one
+		known      *volume
+		offered    bool
+		operations string
+		id         string
+		created    bool
+	}{
+		{name: "new volume", operations: "RESERVE CREATE"},
+		{
+			name:    "offered volume",
+			known:   &volume{ID: "db.0.v1", AgentID: "a1", Hostname: "h1", Created: true},
+			offered: true,
+			id:      "db.0.v1",
+			created: true,
+		},
+		{
+			name:       "volume which was never offered",
+			known:      &volume{ID: "db.0.v1", AgentID: "a1", Hostname: "h1"},
+			operations: "RESERVE CREATE",
+			id:         "db.0.v1",
+		},
+	}
+	for _, test := range tests {
+		s, j := volumeScheduler(t)
+		offer := &mesos.Offer{ID: mesos.OfferID{Value: "o1"}, AgentID: mesos.AgentID{Value: "a1"}, Hostname: "h1"}
+		if test.known != nil {
+			s.shellCmdQueue.setVolume(j.Name, j.Instance, *test.known)
+			if test.offered {
+				offer.Resources = append(offer.Resources, s.newVolumeResource(j, test.known.ID))
+			}
+		}
+		task := &mesos.TaskInfo{}
+		operations := s.attachVolume(j, offer, task)
+		if got := operationTypes(operations); got != test.operations {
+			t.Errorf("%s: got operations %q, want %q", test.name, got, test.operations)
+		}
+		v, ok := s.shellCmdQueue.volume(j.Name, j.Instance)
+		if !ok || v.AgentID != "a1" || v.Created != test.created {
+			t.Errorf("%s: got volume %+v", test.name, v)
+		}
+		if test.id != "" && v.ID != test.id {
+			t.Errorf("%s: got volume ID %s, want %s", test.name, v.ID, test.id)
+		}
+		if len(task.Resources) != 1 || task.Resources[0].GetDisk().GetPersistence().GetID() != v.ID {
+			t.Errorf("%s: task has resources %v, want volume %s", test.name, task.Resources, v.ID)
+		}
+	}
+}
+
+// volumeOperationsDriver accepts offers and records the types of their operations
+type volumeOperationsDriver struct {
+	schedulerDriver
+	operations []string
+}
+
+func (d *volumeOperationsDriver) AcceptOffers(offerIDs []mesos.OfferID, operations []mesos.Offer_Operation, filters *mesos.Filters) error {
+	d.operations = append(d.operations, operationTypes(operations))
+	return nil
+}
+
+func TestManageVolumes(t *testing.T) {
+	tests := []struct {
+		name string
+		// known is the volume of the instance before, if it has one
+		known      *volume
+		principal  string
+		operations []string
+		// volume is the volume of the instance after, if it has one
+		volume *volume
+	}{
+		{
+			name:       "volume of a deleted job",
+			known:      &volume{ID: "db.0.v1", AgentID: "a1", Hostname: "h1", Created: true, Destroy: true},
+			principal:  "rendler",
+			operations: []string{"DESTROY UNRESERVE"},
+		},
+		{
+			name:      "volume being created",
+			known:     &volume{ID: "db.0.v1", AgentID: "a1", Hostname: "h1"},
+			principal: "rendler",
+			volume:    &volume{ID: "db.0.v1", AgentID: "a1", Hostname: "h1", Created: true},
+		},
+		{
+			name:      "volume from before a restart",
+			principal: "rendler",
+			volume:    &volume{ID: "db.0.v1", AgentID: "a1", Hostname: "h1", Created: true},
+		},
+		{
+			name:      "volume of another principal",
+			principal: "other",
+		},
+	}
+	for _, test := range tests {
+		s, j := volumeScheduler(t)
+		if test.known != nil {
+			s.shellCmdQueue.setVolume(j.Name, j.Instance, *test.known)
+		}
+		r := s.newVolumeResource(j, "db.0.v1")
+		r.Reservation.Principal = proto.String(test.principal)
+		offer := mesos.Offer{ID: mesos.OfferID{Value: "o1"}, AgentID: mesos.AgentID{Value: "a1"}, Hostname: "h1", Resources: mesos.Resources{r}}
+		d := &volumeOperationsDriver{}
+		unused, used, _ := s.manageVolumes(d, []mesos.Offer{offer})
+		if fmt.Sprint(d.operations) != fmt.Sprint(test.operations) {
+			t.Errorf("%s: got operations %q, want %q", test.name, d.operations, test.operations)
+		}
+		if len(used) != len(test.operations) || len(used)+len(unused) != 1 {
+			t.Errorf("%s: %d offers used and %d unused", test.name, len(used), len(unused))
+		}
+		v, ok := s.shellCmdQueue.volume(j.Name, j.Instance)
+		if ok != (test.volume != nil) || (ok && v != *test.volume) {
+			t.Errorf("%s: got volume %+v, found %t, want %+v", test.name, v, ok, test.volume)
+		}
+	}
+}